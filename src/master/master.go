@@ -0,0 +1,172 @@
+// Command master runs test scenarios against chatroom servers (see package
+// scenario), replacing master.py
+//
+// Usage:
+//
+//	master [flags] [scenario.input | directory]...
+//
+// With no arguments, master reads a scenario from standard input and prints
+// the replies to its commands, like master.py. Otherwise, it runs each given
+// scenario (and every .input file in the given directories), compares its
+// replies with the matching .output file and reports whether it passed. The
+// exit status is 1 if a scenario failed.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sfurman3/chatroom/scenario"
+)
+
+var (
+	PROCESS       = "./process" // path of the server executable
+	SERVER_FLAGS  = ""          // flags passed to every server
+	JSON          = false       // report results as JSON
+	LOG_DIR       = ""          // directory of the server logs
+	TIMEOUT       = scenario.TIMEOUT
+	READY_TIMEOUT = scenario.READY_TIMEOUT
+)
+
+func init() {
+	flag.StringVar(&PROCESS, "process", PROCESS, "path of the server "+
+		"executable")
+	flag.StringVar(&SERVER_FLAGS, "server-flags", SERVER_FLAGS, "flags "+
+		"passed to every server (separated by spaces)")
+	flag.BoolVar(&JSON, "json", JSON, "report the result of each scenario "+
+		"as a line of JSON")
+	flag.StringVar(&LOG_DIR, "logs", LOG_DIR, "write the standard error "+
+		"of the servers of each scenario to <dir>/<scenario>.err")
+	flag.DurationVar(&TIMEOUT, "timeout", TIMEOUT, "maximum duration of "+
+		"a scenario")
+	flag.DurationVar(&READY_TIMEOUT, "ready-timeout", READY_TIMEOUT,
+		"maximum duration to wait for the servers to be ready after a "+
+			"start or crash")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"usage: master [flags] [scenario.input | directory]...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func main() {
+	if flag.NArg() == 0 {
+		s, err := scenario.Parse("stdin", os.Stdin)
+		if err != nil {
+			fatal(err)
+		}
+		result := run(s)
+		for _, reply := range result.Got {
+			fmt.Println(reply)
+		}
+		if result.Error != "" {
+			fatal(result.Error)
+		}
+		return
+	}
+
+	paths, err := scenarioPaths(flag.Args())
+	if err != nil {
+		fatal(err)
+	}
+	failed := 0
+	for _, path := range paths {
+		s, err := scenario.Load(path)
+		if err != nil {
+			fatal(err)
+		}
+		result := run(s)
+		if !result.Passed {
+			failed++
+		}
+		report(os.Stdout, result)
+	}
+	if !JSON {
+		fmt.Printf("%d passed, %d failed\n", len(paths)-failed, failed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// scenarioPaths returns the given scenarios, replacing each directory with
+// the .input files it contains
+func scenarioPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.input"))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// run runs s with servers started from PROCESS
+func run(s *scenario.Scenario) *scenario.Result {
+	launcher := &scenario.ExecLauncher{Path: PROCESS,
+		Args: strings.Fields(SERVER_FLAGS)}
+	if LOG_DIR != "" {
+		err := os.MkdirAll(LOG_DIR, 0755)
+		if err != nil {
+			fatal(err)
+		}
+		log, err := os.Create(filepath.Join(LOG_DIR, s.Name+".err"))
+		if err != nil {
+			fatal(err)
+		}
+		defer log.Close()
+		launcher.Stderr = log
+	}
+	runner := scenario.Runner{Launcher: launcher, Timeout: TIMEOUT,
+		ReadyTimeout: READY_TIMEOUT}
+	return runner.Run(s)
+}
+
+// report writes the result of a scenario to w
+func report(w io.Writer, result *scenario.Result) {
+	if JSON {
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	status := "PASS"
+	if !result.Passed {
+		status = "FAIL"
+	}
+	fmt.Fprintf(w, "%s %s (%.2fs)\n", status, result.Name,
+		result.Duration.Seconds())
+	if result.Error != "" {
+		fmt.Fprintln(w, "    error:", result.Error)
+	}
+	if !result.Passed && result.Want != nil {
+		fmt.Fprintln(w, "    want:")
+		for _, line := range result.Want {
+			fmt.Fprintln(w, "       ", line)
+		}
+		fmt.Fprintln(w, "    got:")
+		for _, line := range result.Got {
+			fmt.Fprintln(w, "       ", line)
+		}
+	}
+}
+
+// fatal prints err and exits with status 2
+func fatal(err interface{}) {
+	fmt.Fprintln(os.Stderr, "master:", err)
+	os.Exit(2)
+}
@@ -0,0 +1,148 @@
+package scenario
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A Launcher starts servers
+type Launcher interface {
+	// Start starts server id of a system of n servers, which accepts master
+	// connections on the given port (on localhost)
+	Start(id, n, port int) (Server, error)
+}
+
+// A Server is a server started by a Launcher
+type Server interface {
+	// Crash stops the server at once, without giving it a chance to shut
+	// down
+	Crash() error
+
+	// Stop shuts the server down gracefully, and returns once it has
+	// stopped
+	Stop() error
+
+	// Done returns a channel that is closed once the server has stopped
+	Done() <-chan struct{}
+}
+
+// LauncherFunc is a Launcher that calls itself, e.g. to start fake servers in
+// the same process as the Runner
+//
+// NOTE: The server (src/server) keeps its state in package-level variables, so
+// it can only be run as a subprocess (see ExecLauncher).
+type LauncherFunc func(id, n, port int) (Server, error)
+
+func (f LauncherFunc) Start(id, n, port int) (Server, error) {
+	return f(id, n, port)
+}
+
+// Default duration ExecLauncher waits for a server to exit after SIGTERM
+// before killing it
+const STOP_TIMEOUT = 5 * time.Second
+
+// ExecLauncher starts each server as a subprocess, running
+//
+//	<Path> <Args>... <id> <n> <port>
+type ExecLauncher struct {
+	Path string   // path of the server executable (e.g. "./process")
+	Args []string // flags passed before the positional arguments
+	Dir  string   // working directory (the current one if empty)
+
+	// destination of the standard error of every server (discarded if
+	// nil), which may be written concurrently by the servers
+	Stderr io.Writer
+
+	// maximum duration Stop waits for a server to exit after SIGTERM
+	// before killing it (STOP_TIMEOUT if zero)
+	StopTimeout time.Duration
+
+	mutex sync.Mutex // mutex for writing to Stderr
+}
+
+func (l *ExecLauncher) Start(id, n, port int) (Server, error) {
+	args := append(append([]string{}, l.Args...), strconv.Itoa(id),
+		strconv.Itoa(n), strconv.Itoa(port))
+	cmd := exec.Command(l.Path, args...)
+	cmd.Dir = l.Dir
+	if l.Stderr != nil {
+		cmd.Stderr = lockedWriter{l.Stderr, &l.mutex}
+	}
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := l.StopTimeout
+	if timeout == 0 {
+		timeout = STOP_TIMEOUT
+	}
+	proc := &process{cmd: cmd, timeout: timeout, done: make(chan struct{})}
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.done)
+	}()
+	return proc, nil
+}
+
+// process is a server started by ExecLauncher
+type process struct {
+	cmd     *exec.Cmd
+	timeout time.Duration // see ExecLauncher.StopTimeout
+	done    chan struct{} // closed once the process has exited
+	err     error         // result of cmd.Wait (set before done is closed)
+}
+
+func (p *process) Crash() error {
+	err := p.cmd.Process.Kill()
+	<-p.done
+	if errors.Is(err, os.ErrProcessDone) {
+		return nil
+	}
+	return err
+}
+
+// Stop sends SIGTERM to the process and waits for it to exit, killing it if it
+// takes longer than the stop timeout
+//
+// NOTE: An exit status other than 0 (including being killed) is returned as an
+// error.
+func (p *process) Stop() error {
+	err := p.cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return p.err
+	case <-timer.C:
+		p.cmd.Process.Kill()
+		<-p.done
+		return errors.New("server did not stop within " +
+			p.timeout.String())
+	}
+}
+
+func (p *process) Done() <-chan struct{} {
+	return p.done
+}
+
+// lockedWriter is an io.Writer that holds a mutex while writing to w
+type lockedWriter struct {
+	w     io.Writer
+	mutex *sync.Mutex
+}
+
+func (lw lockedWriter) Write(p []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	return lw.w.Write(p)
+}
@@ -0,0 +1,397 @@
+package scenario
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of the Runner
+const (
+	// maximum duration of a scenario (as in master.py)
+	TIMEOUT = 60 * time.Second
+
+	// maximum duration to wait for the servers to agree on which servers
+	// are alive after a server starts or crashes
+	READY_TIMEOUT = 15 * time.Second
+
+	// interval between two checks of whether the servers are ready
+	POLL_INTERVAL = 20 * time.Millisecond
+
+	// time to wait after a server acknowledged a command that has no reply
+	// (e.g. for a broadcast to reach the other servers)
+	SETTLE = 20 * time.Millisecond
+)
+
+// A Runner runs scenarios, starting their servers with Launcher
+//
+// After a server starts, the Runner waits until it accepts master connections
+// and until every running server reports exactly the running servers as alive
+// (i.e. until heartbeats from the new server have been received and it has
+// heard from the others). After a server crashes, it waits until no other
+// server reports it as alive any more. After a command that has no reply, it
+// waits until the server acknowledges it (see server.send) and then for
+// Settle. The sleeps in the scenario are kept as they are.
+type Runner struct {
+	Launcher Launcher
+
+	Timeout      time.Duration // TIMEOUT if zero
+	ReadyTimeout time.Duration // READY_TIMEOUT if zero
+	Settle       time.Duration // SETTLE if zero
+}
+
+// Result is the outcome of a scenario
+type Result struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+
+	// replies printed by the scenario, and the expected ones (nil if
+	// unknown, in which case the scenario passes unless it fails to run)
+	Got  []string `json:"got"`
+	Want []string `json:"want,omitempty"`
+
+	// reason the scenario could not be run to the end
+	Error string `json:"error,omitempty"`
+
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Run runs the scenario s, stopping every server it started before returning
+func (r *Runner) Run(s *Scenario) *Result {
+	start := time.Now()
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = TIMEOUT
+	}
+	readyTimeout := r.ReadyTimeout
+	if readyTimeout == 0 {
+		readyTimeout = READY_TIMEOUT
+	}
+	settle := r.Settle
+	if settle == 0 {
+		settle = SETTLE
+	}
+	run := &run{
+		launcher:     r.Launcher,
+		deadline:     start.Add(timeout),
+		readyTimeout: readyTimeout,
+		settle:       settle,
+		servers:      make(map[int]*server),
+		result: &Result{Name: s.Name, Got: []string{},
+			Want: s.Want},
+	}
+
+	var err error
+	for i := range s.Commands {
+		cmd := &s.Commands[i]
+		err = run.execute(cmd)
+		if err != nil {
+			err = errors.New("line " + strconv.Itoa(cmd.Line) +
+				" (" + commandString(cmd) + "): " + err.Error())
+			break
+		}
+		if cmd.Name == CmdExit {
+			break
+		}
+	}
+	stopErr := run.stopAll()
+	if err == nil {
+		err = stopErr
+	}
+
+	result := run.result
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Passed = err == nil &&
+		(result.Want == nil || matches(result.Got, result.Want))
+	result.Duration = time.Since(start)
+	return result
+}
+
+// matches returns whether the output got is the output want (ignoring
+// surrounding whitespace, as the grading script does)
+func matches(got, want []string) bool {
+	return strings.TrimSpace(strings.Join(got, "\n")) ==
+		strings.TrimSpace(strings.Join(want, "\n"))
+}
+
+// commandString returns the text of cmd as in the scenario
+func commandString(cmd *Command) string {
+	switch cmd.Name {
+	case CmdExit:
+		return CmdExit
+	case CmdSleep:
+		ms := float64(cmd.Sleep) / float64(time.Millisecond)
+		return CmdSleep + " " + strconv.FormatFloat(ms, 'f', -1, 64)
+	case CmdStart:
+		return strconv.Itoa(cmd.Id) + " " + CmdStart + " " +
+			strconv.Itoa(cmd.N) + " " + strconv.Itoa(cmd.Port)
+	case CmdCrash:
+		return strconv.Itoa(cmd.Id) + " " + CmdCrash
+	}
+	return strconv.Itoa(cmd.Id) + " " + cmd.Text
+}
+
+// run is the state of a scenario being run
+type run struct {
+	launcher     Launcher
+	deadline     time.Time     // time by which the scenario must end
+	readyTimeout time.Duration // see Runner.ReadyTimeout
+	settle       time.Duration // see Runner.Settle
+	servers      map[int]*server
+	result       *Result
+}
+
+// server is a running server and the master connection to it
+type server struct {
+	Server
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// execute runs a single command of the scenario
+func (run *run) execute(cmd *Command) error {
+	switch cmd.Name {
+	case CmdExit:
+		return nil
+	case CmdSleep:
+		return run.sleep(cmd.Sleep)
+	case CmdStart:
+		return run.start(cmd)
+	case CmdCrash:
+		return run.crash(cmd.Id)
+	}
+
+	srv := run.servers[cmd.Id]
+	if srv == nil {
+		return errors.New("server " + strconv.Itoa(cmd.Id) +
+			" is not running")
+	}
+	if !cmd.Replies() {
+		err := srv.send(cmd.Text, run.deadline)
+		if err != nil {
+			return err
+		}
+		return run.sleep(run.settle)
+	}
+	reply, err := srv.request(cmd.Text, run.deadline)
+	if err != nil {
+		return err
+	}
+	run.result.Got = append(run.result.Got, reply)
+	return nil
+}
+
+// sleep waits for d, unless the scenario would time out first
+func (run *run) sleep(d time.Duration) error {
+	if time.Now().Add(d).After(run.deadline) {
+		return errors.New("scenario timed out")
+	}
+	time.Sleep(d)
+	return nil
+}
+
+// start starts a server, connects to it and waits until the servers are ready
+func (run *run) start(cmd *Command) error {
+	if run.servers[cmd.Id] != nil {
+		return errors.New("server " + strconv.Itoa(cmd.Id) +
+			" is already running")
+	}
+	proc, err := run.launcher.Start(cmd.Id, cmd.N, cmd.Port)
+	if err != nil {
+		return err
+	}
+	srv := &server{Server: proc}
+
+	// connect as soon as the server listens for masters
+	address := "localhost:" + strconv.Itoa(cmd.Port)
+	readyBy := run.readyBy()
+	for {
+		srv.conn, err = net.DialTimeout("tcp", address, POLL_INTERVAL*5)
+		if err == nil {
+			break
+		}
+		select {
+		case <-proc.Done():
+			return errors.New("server exited before accepting " +
+				"master connections")
+		default:
+		}
+		if time.Now().After(readyBy) {
+			proc.Crash()
+			return errors.New("server did not accept master " +
+				"connections: " + err.Error())
+		}
+		time.Sleep(POLL_INTERVAL)
+	}
+	srv.reader = bufio.NewReader(srv.conn)
+	run.servers[cmd.Id] = srv
+	return run.awaitReady()
+}
+
+// crash kills a server and waits until the others no longer consider it alive
+func (run *run) crash(id int) error {
+	srv := run.servers[id]
+	if srv == nil {
+		return errors.New("server " + strconv.Itoa(id) +
+			" is not running")
+	}
+	delete(run.servers, id)
+	srv.conn.Close()
+	err := srv.Crash()
+	if err != nil {
+		return err
+	}
+	return run.awaitReady()
+}
+
+// stopAll shuts every running server down gracefully, returning the first
+// error
+func (run *run) stopAll() error {
+	var first error
+	for id, srv := range run.servers {
+		srv.conn.Close()
+		err := srv.Stop()
+		if err != nil && first == nil {
+			first = errors.New("stopping server " +
+				strconv.Itoa(id) + ": " + err.Error())
+		}
+		delete(run.servers, id)
+	}
+	return first
+}
+
+// readyBy returns the time by which the servers must be ready
+func (run *run) readyBy() time.Time {
+	readyBy := time.Now().Add(run.readyTimeout)
+	if readyBy.After(run.deadline) {
+		return run.deadline
+	}
+	return readyBy
+}
+
+// awaitReady waits until every running server reports exactly the running
+// servers as alive
+func (run *run) awaitReady() error {
+	want := make([]int, 0, len(run.servers))
+	for id := range run.servers {
+		want = append(want, id)
+	}
+	sort.Ints(want)
+
+	readyBy := run.readyBy()
+	for {
+		ready := true
+		for id, srv := range run.servers {
+			alive, err := srv.alive(readyBy)
+			if err != nil {
+				return errors.New("server " + strconv.Itoa(id) +
+					": " + err.Error())
+			}
+			if !equal(alive, want) {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			return nil
+		}
+		if time.Now().After(readyBy) {
+			return errors.New("servers did not agree that " +
+				formatIds(want) + " are alive within " +
+				run.readyTimeout.String())
+		}
+		time.Sleep(POLL_INTERVAL)
+	}
+}
+
+// write writes a command to the server
+func (srv *server) write(text string, deadline time.Time) error {
+	srv.conn.SetWriteDeadline(deadline)
+	_, err := srv.conn.Write([]byte(text + "\n"))
+	return err
+}
+
+// send sends a command that has no reply to the server and waits until the
+// server acknowledges it
+//
+// The server runs the commands of a master connection in order, so its reply
+// to a "hello" that keeps the protocol version (or to any other command) sent
+// right after the command shows that the command ran.
+func (srv *server) send(text string, deadline time.Time) error {
+	err := srv.write(text, deadline)
+	if err != nil {
+		return err
+	}
+	_, err = srv.request("hello v1", deadline)
+	return err
+}
+
+// request sends a command to the server and returns its reply (without the
+// trailing newline)
+func (srv *server) request(text string, deadline time.Time) (string, error) {
+	err := srv.write(text, deadline)
+	if err != nil {
+		return "", err
+	}
+	srv.conn.SetReadDeadline(deadline)
+	reply, err := srv.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\r\n"), nil
+}
+
+// alive returns the ids (in increasing order) of the servers that the server
+// considers alive
+func (srv *server) alive(deadline time.Time) ([]int, error) {
+	reply, err := srv.request("alive", deadline)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(reply)
+	if len(fields) == 0 || fields[0] != "alive" || len(fields) > 2 {
+		return nil, errors.New("invalid reply to alive: " +
+			strconv.Quote(reply))
+	}
+	ids := []int{}
+	if len(fields) == 2 {
+		for _, field := range strings.Split(fields[1], ",") {
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, errors.New("invalid reply to " +
+					"alive: " + strconv.Quote(reply))
+			}
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// equal returns whether a and b contain the same ids in the same order
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// formatIds returns ids as a comma-separated list
+func formatIds(ids []int) string {
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = strconv.Itoa(id)
+	}
+	return strings.Join(entries, ",")
+}
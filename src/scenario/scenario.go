@@ -0,0 +1,193 @@
+// Package scenario runs test scenarios against a system of chatroom servers,
+// replacing the Python test master (master.py)
+//
+// A scenario is a text file with one command per line, in the format read by
+// master.py (the files in grading_tests and tests):
+//
+//	<id> start <n> <port>   start server <id> of <n> with master port <port>
+//	<id> get                print the reply of server <id> to "get"
+//	<id> alive              print the reply of server <id> to "alive"
+//	<id> broadcast <m>      tell server <id> to broadcast <m>
+//	<id> crash              kill server <id>
+//	sleep <ms>              wait for <ms> milliseconds
+//	exit                    stop every server and end the scenario
+//
+// Any other command of a server (e.g. "<id> get #ops") is sent to it as is, and
+// its reply is printed. The output of a scenario is the list of printed
+// replies, which passes if it matches the expected output (the matching
+// ".output" file).
+//
+// Unlike master.py, which sleeps for 3 seconds after every start and for 1
+// second after every crash, the Runner waits until every running server agrees
+// on which servers are alive (see Runner).
+package scenario
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the commands that do not simply forward their text to a server
+const (
+	CmdStart = "start"
+	CmdCrash = "crash"
+	CmdSleep = "sleep"
+	CmdExit  = "exit"
+)
+
+// A Command is a single line of a scenario
+type Command struct {
+	Line int    // line number in the scenario (starting at 1)
+	Name string // e.g. CmdStart or "get"
+
+	// id of the server the command is for (-1 for CmdSleep and CmdExit)
+	Id int
+
+	// text sent to the server (e.g. "broadcast hello"), which is empty
+	// for CmdStart and CmdCrash
+	Text string
+
+	N     int           // number of servers (CmdStart)
+	Port  int           // master-facing port (CmdStart)
+	Sleep time.Duration // duration (CmdSleep)
+}
+
+// Replies returns whether the server replies to the command (i.e. whether its
+// reply is part of the output)
+func (cmd *Command) Replies() bool {
+	switch cmd.Name {
+	case CmdStart, CmdCrash, CmdSleep, CmdExit, "broadcast":
+		return false
+	}
+	return true
+}
+
+// A Scenario is a list of commands and the output they are expected to produce
+type Scenario struct {
+	Name     string
+	Commands []Command
+
+	// expected output, one reply per line (nil if unknown)
+	Want []string
+}
+
+// Parse reads the commands of a scenario from r
+func Parse(name string, r io.Reader) (*Scenario, error) {
+	s := &Scenario{Name: name}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		cmd, err := parseCommand(text)
+		if err != nil {
+			return nil, errors.New(name + ":" + strconv.Itoa(line) +
+				": " + err.Error())
+		}
+		cmd.Line = line
+		s.Commands = append(s.Commands, cmd)
+		if cmd.Name == CmdExit {
+			break
+		}
+	}
+	return s, scanner.Err()
+}
+
+// parseCommand parses a single (non-empty) line of a scenario
+func parseCommand(text string) (Command, error) {
+	if text == CmdExit {
+		return Command{Name: CmdExit, Id: -1}, nil
+	}
+	first, rest, _ := strings.Cut(text, " ")
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return Command{}, errors.New("invalid command: " +
+			strconv.Quote(text))
+	}
+
+	if first == CmdSleep {
+		ms, err := strconv.ParseFloat(rest, 64)
+		if err != nil || ms < 0 {
+			return Command{}, errors.New("invalid duration: " +
+				strconv.Quote(rest))
+		}
+		sleep := time.Duration(ms * float64(time.Millisecond))
+		return Command{Name: CmdSleep, Id: -1, Sleep: sleep}, nil
+	}
+
+	id, err := strconv.Atoi(first)
+	if err != nil || id < 0 {
+		return Command{}, errors.New("invalid id: " +
+			strconv.Quote(first))
+	}
+	fields := strings.Fields(rest)
+	cmd := Command{Name: fields[0], Id: id}
+	switch cmd.Name {
+	case CmdStart:
+		if len(fields) != 3 {
+			return Command{}, errors.New(
+				"usage: <id> start <n> <port>")
+		}
+		cmd.N, err = strconv.Atoi(fields[1])
+		if err != nil || cmd.N <= 0 {
+			return Command{}, errors.New("invalid number of " +
+				"servers: " + strconv.Quote(fields[1]))
+		}
+		cmd.Port, err = strconv.Atoi(fields[2])
+		if err != nil || cmd.Port <= 0 || cmd.Port > 65535 {
+			return Command{}, errors.New("invalid port: " +
+				strconv.Quote(fields[2]))
+		}
+	case CmdCrash:
+		if len(fields) != 1 {
+			return Command{}, errors.New("usage: <id> crash")
+		}
+	default:
+		cmd.Text = rest
+	}
+	return cmd, nil
+}
+
+// Load reads the scenario in the file at path (e.g. "tests/crash.input") and
+// its expected output from the file with the extension ".output" instead, if
+// there is one
+func Load(path string) (*Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	name := strings.TrimSuffix(path[strings.LastIndex(path, "/")+1:],
+		".input")
+	s, err := Parse(name, file)
+	if err != nil {
+		return nil, err
+	}
+
+	want, err := os.ReadFile(strings.TrimSuffix(path, ".input") + ".output")
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Want = splitLines(string(want))
+	return s, nil
+}
+
+// splitLines returns the lines of output (without surrounding whitespace, as
+// compared by the grading script)
+func splitLines(output string) []string {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return []string{}
+	}
+	return strings.Split(output, "\n")
+}
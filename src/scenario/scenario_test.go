@@ -0,0 +1,269 @@
+package scenario
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse("test", strings.NewReader("0 start 3 10000\n\n"+
+		"sleep 1.5\n0 broadcast hello world\n0 get #ops\n"+
+		"0 crash\nexit\n0 alive\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Command{
+		{Line: 1, Name: CmdStart, Id: 0, N: 3, Port: 10000},
+		{Line: 3, Name: CmdSleep, Id: -1,
+			Sleep: 1500 * time.Microsecond},
+		{Line: 4, Name: "broadcast", Id: 0,
+			Text: "broadcast hello world"},
+		{Line: 5, Name: "get", Id: 0, Text: "get #ops"},
+		{Line: 6, Name: CmdCrash, Id: 0},
+		{Line: 7, Name: CmdExit, Id: -1},
+	}
+	if len(s.Commands) != len(want) {
+		t.Fatalf("parsed %d commands, want %d: %+v", len(s.Commands),
+			len(want), s.Commands)
+	}
+	for i := range want {
+		if s.Commands[i] != want[i] {
+			t.Errorf("command %d = %+v, want %+v", i, s.Commands[i],
+				want[i])
+		}
+	}
+
+	for _, input := range []string{"start 3 10000", "0 start 3",
+		"0 start 0 10000", "sleep soon", "0", "0 crash now"} {
+		_, err := Parse("test", strings.NewReader(input))
+		if err == nil {
+			t.Errorf("%q: parsed without error", input)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alive.input")
+	os.WriteFile(path, []byte("0 start 1 10000\n0 alive\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "alive.output"),
+		[]byte("alive 0\n\n"), 0644)
+
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "alive" || len(s.Commands) != 2 ||
+		strings.Join(s.Want, "|") != "alive 0" {
+		t.Fatalf("loaded %+v", s)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	cluster := &fakeCluster{alive: make(map[int]bool)}
+	ports := freePorts(t, 2)
+	input := "0 start 2 " + ports[0] + "\n1 start 2 " + ports[1] + "\n" +
+		"0 alive\n0 broadcast hello\n0 get\n1 crash\n0 alive\n"
+	s, err := Parse("fake", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Want = []string{"alive 0,1", "messages hello", "alive 0"}
+
+	runner := Runner{Launcher: LauncherFunc(cluster.start)}
+	result := runner.Run(s)
+	if !result.Passed {
+		t.Fatalf("scenario failed: %+v", result)
+	}
+
+	// the fake servers are only noticed to be stopped after FAKE_DELAY
+	runner.Launcher = LauncherFunc(
+		(&fakeCluster{alive: make(map[int]bool)}).start)
+	s.Want = []string{"alive 0,1", "messages", "alive 0"}
+	result = runner.Run(s)
+	if result.Passed {
+		t.Errorf("scenario with unexpected output passed: %+v", result)
+	}
+}
+
+func TestRunnerStartFailure(t *testing.T) {
+	path, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("no false executable")
+	}
+	s, _ := Parse("false", strings.NewReader("0 start 1 "+
+		freePorts(t, 1)[0]+"\n0 alive\n"))
+	runner := Runner{Launcher: &ExecLauncher{Path: path}}
+	result := runner.Run(s)
+	if result.Passed || !strings.Contains(result.Error, "line 1") {
+		t.Fatalf("scenario with a failing server passed or did not "+
+			"report the failing command: %+v", result)
+	}
+}
+
+// TestGradingScenarios runs the scenarios in grading_tests and tests against
+// the server
+func TestGradingScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping scenarios in short mode")
+	}
+	paths, _ := filepath.Glob("../../grading_tests/*.input")
+	extra, _ := filepath.Glob("../../tests/*.input")
+	paths = append(paths, extra...)
+	if len(paths) == 0 {
+		t.Skip("no scenarios in grading_tests or tests")
+	}
+	process := filepath.Join(t.TempDir(), "process")
+	build := exec.Command("go", "build", "-o", process, "../server")
+	output, err := build.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build the server: %v\n%s", err, output)
+	}
+
+	runner := Runner{Launcher: &ExecLauncher{Path: process}}
+	for _, path := range paths {
+		s, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(s.Name, func(t *testing.T) {
+			result := runner.Run(s)
+			if !result.Passed {
+				t.Errorf("error: %s\nwant:\n%s\ngot:\n%s",
+					result.Error,
+					strings.Join(result.Want, "\n"),
+					strings.Join(result.Got, "\n"))
+			}
+		})
+	}
+}
+
+// freePorts returns n ports that are currently free on localhost
+func freePorts(t *testing.T, n int) []string {
+	t.Helper()
+	ports := make([]string, n)
+	for i := range ports {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		ln.Close()
+	}
+	return ports
+}
+
+// fakeCluster is a system of fake servers, which consider each other alive
+// only some time after they start and for some time after they stop (like
+// real servers, which learn of each other through heartbeats)
+type fakeCluster struct {
+	alive    map[int]bool
+	messages []string
+	mutex    sync.Mutex // mutex for accessing contents
+}
+
+// Delay before the servers of a fakeCluster notice that a server started or
+// stopped
+const FAKE_DELAY = 100 * time.Millisecond
+
+func (fc *fakeCluster) start(id, n, port int) (Server, error) {
+	ln, err := net.Listen("tcp", "localhost:"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	time.AfterFunc(FAKE_DELAY, func() { fc.setAlive(id, true) })
+	srv := &fakeServer{id: id, cluster: fc, ln: ln,
+		done: make(chan struct{})}
+	go srv.serve()
+	return srv, nil
+}
+
+func (fc *fakeCluster) setAlive(id int, alive bool) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if alive {
+		fc.alive[id] = true
+	} else {
+		delete(fc.alive, id)
+	}
+}
+
+// reply returns the reply of a fake server to a master command
+func (fc *fakeCluster) reply(cmd string) (string, bool) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	switch {
+	case cmd == "alive":
+		ids := make([]int, 0, len(fc.alive))
+		for id := range fc.alive {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		return "alive " + formatIds(ids), true
+	case cmd == "hello v1":
+		return cmd, true
+	case cmd == "get":
+		return "messages " + strings.Join(fc.messages, ","), true
+	case strings.HasPrefix(cmd, "broadcast "):
+		fc.messages = append(fc.messages,
+			strings.TrimPrefix(cmd, "broadcast "))
+	}
+	return "", false
+}
+
+// fakeServer is a server of a fakeCluster
+type fakeServer struct {
+	id      int
+	cluster *fakeCluster
+	ln      net.Listener
+	done    chan struct{}
+}
+
+func (fs *fakeServer) serve() {
+	for {
+		conn, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				reply, ok := fs.cluster.reply(scanner.Text())
+				if ok {
+					conn.Write([]byte(reply + "\n"))
+				}
+			}
+		}()
+	}
+}
+
+func (fs *fakeServer) Crash() error {
+	return fs.Stop()
+}
+
+func (fs *fakeServer) Stop() error {
+	select {
+	case <-fs.done:
+		return errors.New("server already stopped")
+	default:
+	}
+	fs.ln.Close()
+	close(fs.done)
+	time.AfterFunc(FAKE_DELAY, func() { fs.cluster.setAlive(fs.id, false) })
+	return nil
+}
+
+func (fs *fakeServer) Done() <-chan struct{} {
+	return fs.done
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sfurman3/chatroom/simnet"
+)
+
+// clock of this server, which times its heartbeats, failure detection,
+// timeouts and retries, and which tests may replace with a
+// simnet.VirtualClock (along with Network)
+var Clock simnet.Clock = simnet.WallClock
+
+// stoppedTimer is a Timer whose call already happened
+type stoppedTimer struct{}
+
+func (stoppedTimer) Stop() bool {
+	return false
+}
+
+// newTimer returns a channel that is closed once d has elapsed according to
+// Clock, and the Timer that closes it
+func newTimer(d time.Duration) (<-chan struct{}, simnet.Timer) {
+	expired := make(chan struct{})
+	if d <= 0 {
+		close(expired)
+		return expired, stoppedTimer{}
+	}
+	return expired, Clock.AfterFunc(d, func() { close(expired) })
+}
+
+// after returns a channel that is closed once d has elapsed according to Clock
+func after(d time.Duration) <-chan struct{} {
+	expired, _ := newTimer(d)
+	return expired
+}
+
+// sleep waits until d has elapsed according to Clock
+func sleep(d time.Duration) {
+	<-after(d)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of the environment variables that override flags (e.g.
+// CHATROOM_HEARTBEAT=100ms sets -heartbeat unless it is given explicitly)
+const ENV_PREFIX = "CHATROOM_"
+
+var (
+	// path of the cluster configuration file (see clusterConfig)
+	CONFIG = ""
+
+	// address ("host:port") of each server's server-facing port, keyed by
+	// id (servers not listed are at localhost:START_PORT+id)
+	MEMBERS = map[int]string{}
+)
+
+// clusterConfig is the format of the JSON cluster configuration file given by
+// the -config flag, which lists the address of every server in the system:
+//
+//	{
+//	    "members": [
+//	        {"id": 0, "addr": "chat0.example.com:20000"},
+//	        {"id": 1, "addr": "chat1.example.com:20000"}
+//	    ]
+//	}
+//
+// Member ids must be {0, ..., n-1}, where n is the number of servers (which
+// need not be given on the command line if a configuration file is used).
+type clusterConfig struct {
+	Members []struct {
+		Id   int    `json:"id"`
+		Addr string `json:"addr"`
+	} `json:"members"`
+}
+
+// registerTimingFlags defines a flag for each tunable timing and size knob
+//
+// Knobs whose defaults are derived from -heartbeat (or -write-timeout) are
+// rederived in deriveTimings unless they are given explicitly
+func registerTimingFlags() {
+	flag.IntVar(&START_PORT, "start-port", START_PORT, "base port of the "+
+		"server-facing ports of servers not listed in -config "+
+		"(server i listens on start-port+i)")
+	flag.DurationVar(&HEARTBEAT_INTERVAL, "heartbeat", HEARTBEAT_INTERVAL,
+		"duration between heartbeats")
+	flag.DurationVar(&ALIVE_INTERVAL, "alive-interval", ALIVE_INTERVAL,
+		"maximum duration since the last message from a server for "+
+			"which it is alive (\""+DETECTOR_FIXED+"\" detector, "+
+			"default 5/4 * heartbeat)")
+	flag.DurationVar(&READ_TIMEOUT, "read-timeout", READ_TIMEOUT,
+		"maximum idle duration of a connection from another server "+
+			"(default 5 * heartbeat)")
+	flag.DurationVar(&DIAL_TIMEOUT, "dial-timeout", DIAL_TIMEOUT,
+		"maximum duration of an attempt to connect to a server")
+	flag.DurationVar(&WRITE_TIMEOUT, "write-timeout", WRITE_TIMEOUT,
+		"maximum duration of a write to a server")
+	flag.DurationVar(&REDIAL_INTERVAL, "redial-interval", REDIAL_INTERVAL,
+		"duration after a failed connection attempt before a server "+
+			"is dialed again (default heartbeat)")
+	flag.DurationVar(&SEND_TIMEOUT, "send-timeout", SEND_TIMEOUT,
+		"maximum duration a send waits for room in a full queue "+
+			"(\""+SEND_POLICY_BLOCK+"\" policy, default "+
+			"write-timeout)")
+	flag.IntVar(&SEND_QUEUE_SIZE, "send-queue-size", SEND_QUEUE_SIZE,
+		"maximum number of messages queued for a server")
+	flag.DurationVar(&REORDER_TIMEOUT, "reorder-timeout", REORDER_TIMEOUT,
+		"maximum duration a message waits for an earlier message from "+
+			"the same server (default 3 * heartbeat)")
+	flag.DurationVar(&SYNC_RETRY_INTERVAL, "sync-retry-interval",
+		SYNC_RETRY_INTERVAL, "duration after which an unanswered "+
+			"request for missed messages is sent again (-sync, "+
+			"default 5 * heartbeat)")
+	flag.DurationVar(&WAL_SYNC_INTERVAL, "wal-sync-interval",
+		WAL_SYNC_INTERVAL, "duration between flushes of the message "+
+			"log (\""+FSYNC_INTERVAL+"\" policy)")
+	flag.DurationVar(&PHI_MIN_STDDEV, "phi-min-stddev", PHI_MIN_STDDEV,
+		"minimum standard deviation of heartbeat inter-arrival "+
+			"times (\""+DETECTOR_PHI+"\" detector, default "+
+			"heartbeat / 4)")
+	flag.DurationVar(&SWIM_PERIOD, "swim-period", SWIM_PERIOD,
+		"duration of a SWIM protocol period, in which one server "+
+			"is probed (\""+DETECTOR_SWIM+"\" detector, default "+
+			"heartbeat)")
+	flag.IntVar(&RETAIN_MESSAGES, "retain-messages", RETAIN_MESSAGES,
+		"maximum number of messages each room keeps in memory (0 for "+
+			"no limit)")
+	flag.DurationVar(&RETAIN_AGE, "retain-age", RETAIN_AGE,
+		"maximum age of the messages each room keeps in memory (0 for "+
+			"no limit)")
+	flag.IntVar(&MAX_FRAME_SIZE, "max-frame-size", MAX_FRAME_SIZE,
+		"maximum length (in bytes) of a message from another server")
+	flag.Float64Var(&PEER_RATE_LIMIT, "peer-rate-limit", PEER_RATE_LIMIT,
+		"maximum number of messages per second read from each remote "+
+			"host (0 for no limit)")
+	flag.DurationVar(&MASTER_WRITE_TIMEOUT, "master-write-timeout",
+		MASTER_WRITE_TIMEOUT, "maximum duration of a write to a "+
+			"master (e.g. a subscriber), after which it is "+
+			"disconnected")
+	flag.DurationVar(&SHUTDOWN_TIMEOUT, "shutdown-timeout",
+		SHUTDOWN_TIMEOUT, "maximum duration a shutdown waits for "+
+			"messages queued for other servers to be written")
+}
+
+// explicitFlags returns the names of the flags given on the command line or
+// through the environment
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// applyEnvironment sets every flag that was not given on the command line to
+// the value of its environment variable (ENV_PREFIX followed by the flag name
+// in upper case with '-' replaced by '_'), if there is one
+//
+// Returns an error if the value of a variable is invalid for its flag
+func applyEnvironment() error {
+	explicit := explicitFlags()
+	var firstErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || firstErr != nil {
+			return
+		}
+		name := ENV_PREFIX +
+			strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, isPresent := os.LookupEnv(name)
+		if !isPresent {
+			return
+		}
+		err := flag.Set(f.Name, value)
+		if err != nil {
+			firstErr = fmt.Errorf("invalid value %q for %s: %v",
+				value, name, err)
+		}
+	})
+	return firstErr
+}
+
+// deriveTimings sets the knobs that default to a multiple of another knob,
+// unless they were given explicitly
+func deriveTimings() {
+	explicit := explicitFlags()
+	derive := func(name string, knob *time.Duration, value time.Duration) {
+		if !explicit[name] {
+			*knob = value
+		}
+	}
+	derive("alive-interval", &ALIVE_INTERVAL, 5*HEARTBEAT_INTERVAL/4)
+	derive("read-timeout", &READ_TIMEOUT, 5*HEARTBEAT_INTERVAL)
+	derive("redial-interval", &REDIAL_INTERVAL, HEARTBEAT_INTERVAL)
+	derive("send-timeout", &SEND_TIMEOUT, WRITE_TIMEOUT)
+	derive("reorder-timeout", &REORDER_TIMEOUT, 3*HEARTBEAT_INTERVAL)
+	derive("sync-retry-interval", &SYNC_RETRY_INTERVAL,
+		5*HEARTBEAT_INTERVAL)
+	derive("phi-min-stddev", &PHI_MIN_STDDEV, HEARTBEAT_INTERVAL/4)
+	derive("swim-period", &SWIM_PERIOD, HEARTBEAT_INTERVAL)
+}
+
+// validateTimings returns an error if any timing or size knob is invalid
+func validateTimings() error {
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"heartbeat", HEARTBEAT_INTERVAL},
+		{"alive-interval", ALIVE_INTERVAL},
+		{"read-timeout", READ_TIMEOUT},
+		{"dial-timeout", DIAL_TIMEOUT},
+		{"write-timeout", WRITE_TIMEOUT},
+		{"redial-interval", REDIAL_INTERVAL},
+		{"send-timeout", SEND_TIMEOUT},
+		{"reorder-timeout", REORDER_TIMEOUT},
+		{"sync-retry-interval", SYNC_RETRY_INTERVAL},
+		{"wal-sync-interval", WAL_SYNC_INTERVAL},
+		{"phi-min-stddev", PHI_MIN_STDDEV},
+		{"swim-period", SWIM_PERIOD},
+		{"master-write-timeout", MASTER_WRITE_TIMEOUT},
+		{"shutdown-timeout", SHUTDOWN_TIMEOUT},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("invalid %s (must be positive): %v",
+				d.name, d.value)
+		}
+	}
+
+	if ALIVE_INTERVAL <= HEARTBEAT_INTERVAL {
+		return fmt.Errorf("alive-interval (%v) must be longer than "+
+			"heartbeat (%v)", ALIVE_INTERVAL, HEARTBEAT_INTERVAL)
+	}
+	if READ_TIMEOUT <= HEARTBEAT_INTERVAL {
+		return fmt.Errorf("read-timeout (%v) must be longer than "+
+			"heartbeat (%v)", READ_TIMEOUT, HEARTBEAT_INTERVAL)
+	}
+	if RETAIN_MESSAGES < 0 {
+		return fmt.Errorf("invalid retain-messages: %v",
+			RETAIN_MESSAGES)
+	}
+	if RETAIN_AGE < 0 {
+		return fmt.Errorf("invalid retain-age: %v", RETAIN_AGE)
+	}
+	if MAX_FRAME_SIZE <= 0 {
+		return fmt.Errorf("invalid max-frame-size: %v", MAX_FRAME_SIZE)
+	}
+	if PEER_RATE_LIMIT < 0 {
+		return fmt.Errorf("invalid peer-rate-limit: %v",
+			PEER_RATE_LIMIT)
+	}
+	if SEND_QUEUE_SIZE <= 0 {
+		return fmt.Errorf("invalid send-queue-size: %v",
+			SEND_QUEUE_SIZE)
+	}
+	if START_PORT <= 0 || START_PORT > 65535 {
+		return fmt.Errorf("invalid start-port: %v", START_PORT)
+	}
+	return nil
+}
+
+// loadConfig reads the cluster configuration file at path into MEMBERS and
+// returns the number of servers it lists
+func loadConfig(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var config clusterConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+
+	members := make(map[int]string)
+	for _, member := range config.Members {
+		if _, isPresent := members[member.Id]; isPresent {
+			return 0, fmt.Errorf("%s: duplicate member id: %d",
+				path, member.Id)
+		}
+		_, _, err := net.SplitHostPort(member.Addr)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid address of member "+
+				"%d: %v", path, member.Id, err)
+		}
+		members[member.Id] = member.Addr
+	}
+	for id := 0; id < len(members); id++ {
+		if _, isPresent := members[id]; !isPresent {
+			return 0, fmt.Errorf("%s: member ids must be {0, ..., "+
+				"%d} (missing %d)", path, len(members)-1, id)
+		}
+	}
+
+	MEMBERS = members
+	return len(members), nil
+}
+
+// peerAddr returns the address of the server-facing port of the server with
+// the given id
+func peerAddr(id int) string {
+	if addr, isPresent := Membership.Addr(id); isPresent {
+		return addr
+	}
+	if addr, isPresent := MEMBERS[id]; isPresent {
+		return addr
+	}
+	return ":" + strconv.Itoa(START_PORT+id)
+}
+
+// listenPort returns the port this server's server-facing port is bound to
+func listenPort() (int, error) {
+	addr, isPresent := MEMBERS[ID]
+	if !isPresent {
+		return START_PORT + ID, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseTimingFlags registers the timing flags on a new command line and parses
+// args, restoring every knob (and the command line) after the test
+func parseTimingFlags(t *testing.T, args ...string) {
+	t.Helper()
+	commandLine := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("server", flag.ContinueOnError)
+	registerTimingFlags()
+	fs := flag.CommandLine
+	t.Cleanup(func() {
+		fs.VisitAll(func(f *flag.Flag) { f.Value.Set(f.DefValue) })
+		flag.CommandLine = commandLine
+	})
+
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	members := MEMBERS
+	defer func() { MEMBERS = members }()
+	dir := t.TempDir()
+	write := func(contents string) string {
+		path := filepath.Join(dir, "cluster.json")
+		err := os.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	n, err := loadConfig(write(`{"members": [
+		{"id": 1, "addr": "chat1.example.com:20000"},
+		{"id": 0, "addr": "10.0.0.1:20001"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || MEMBERS[0] != "10.0.0.1:20001" ||
+		MEMBERS[1] != "chat1.example.com:20000" {
+		t.Fatalf("loaded %d members %v", n, MEMBERS)
+	}
+
+	for contents, want := range map[string]string{
+		`{"members": [{"id": 0, "addr": "a:1"}, ` +
+			`{"id": 0, "addr": "b:1"}]}`: "duplicate",
+		`{"members": [{"id": 1, "addr": "a:1"}]}`: "missing 0",
+		`{"members": [{"id": 0, "addr": "a"}]}`:   "invalid address",
+		`{"members": [`:                           "unexpected end",
+	} {
+		_, err := loadConfig(write(contents))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loading %s: got %v, want an error "+
+				"containing %q", contents, err, want)
+		}
+	}
+	if len(MEMBERS) != 2 {
+		t.Error("an invalid configuration changed the members")
+	}
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	parseTimingFlags(t, "-read-timeout", "2s")
+	t.Setenv(ENV_PREFIX+"HEARTBEAT", "100ms")
+	t.Setenv(ENV_PREFIX+"READ_TIMEOUT", "9s")
+	t.Setenv(ENV_PREFIX+"SEND_QUEUE_SIZE", "7")
+
+	err := applyEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HEARTBEAT_INTERVAL != 100*time.Millisecond || SEND_QUEUE_SIZE != 7 {
+		t.Errorf("heartbeat %v and send-queue-size %d were not set "+
+			"from the environment", HEARTBEAT_INTERVAL,
+			SEND_QUEUE_SIZE)
+	}
+	if READ_TIMEOUT != 2*time.Second {
+		t.Errorf("read-timeout is %v, want the flag (2s) to win over "+
+			"the environment", READ_TIMEOUT)
+	}
+
+	t.Setenv(ENV_PREFIX+"DIAL_TIMEOUT", "soon")
+	err = applyEnvironment()
+	if err == nil || !strings.Contains(err.Error(), "DIAL_TIMEOUT") {
+		t.Errorf("got %v, want an error about %sDIAL_TIMEOUT", err,
+			ENV_PREFIX)
+	}
+}
+
+func TestDeriveTimings(t *testing.T) {
+	parseTimingFlags(t, "-heartbeat", "300ms", "-redial-interval", "1s")
+	deriveTimings()
+
+	for _, knob := range []struct {
+		name        string
+		value, want time.Duration
+	}{
+		{"alive-interval", ALIVE_INTERVAL, 375 * time.Millisecond},
+		{"read-timeout", READ_TIMEOUT, 1500 * time.Millisecond},
+		{"reorder-timeout", REORDER_TIMEOUT, 900 * time.Millisecond},
+		{"redial-interval", REDIAL_INTERVAL, time.Second},
+		{"send-timeout", SEND_TIMEOUT, WRITE_TIMEOUT},
+	} {
+		if knob.value != knob.want {
+			t.Errorf("%s is %v, want %v", knob.name, knob.value,
+				knob.want)
+		}
+	}
+
+	// a slower heartbeat on its own is valid
+	err := validateTimings()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateTimings(t *testing.T) {
+	for _, args := range [][]string{
+		{"-heartbeat", "300ms", "-alive-interval", "250ms"},
+		{"-heartbeat", "300ms", "-read-timeout", "300ms"},
+		{"-dial-timeout", "0s"},
+		{"-send-queue-size", "0"},
+		{"-start-port", "70000"},
+	} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			parseTimingFlags(t, args...)
+			deriveTimings()
+			if validateTimings() == nil {
+				t.Error("invalid timings were accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Policies accepted by the -send-policy flag, which decide what happens to a
+// message sent to a server whose outbound queue is full
+const (
+	// discard the message immediately
+	SEND_POLICY_DROP = "drop"
+
+	// wait up to SEND_TIMEOUT for room in the queue and then discard the
+	// message
+	SEND_POLICY_BLOCK = "block"
+)
+
+// Tunable timings and sizes (see registerTimingFlags)
+var (
+	// Maximum number of messages waiting to be written to a server
+	SEND_QUEUE_SIZE = 256
+
+	// Maximum duration of an attempt to connect to a server
+	DIAL_TIMEOUT = 100 * time.Millisecond
+
+	// Maximum duration of a write to a server
+	WRITE_TIMEOUT = 200 * time.Millisecond
+
+	// Duration after a failed attempt to connect to a server during which
+	// messages to it are discarded without attempting to reconnect
+	// (HEARTBEAT_INTERVAL)
+	REDIAL_INTERVAL = 200 * time.Millisecond
+
+	// Maximum duration a send waits for room in a full queue (only used by
+	// SEND_POLICY_BLOCK) (WRITE_TIMEOUT)
+	SEND_TIMEOUT = 200 * time.Millisecond
+)
+
+// errQueueFull is returned by Send if a message is discarded because the
+// outbound queue of the server is full
+var errQueueFull = errors.New("outbound queue is full")
+
+// peerConn is a long-lived connection to another server, which carries any
+// number of newline-delimited JSON messages
+//
+// Messages are added to a bounded outbound queue and written by a dedicated
+// thread, so sending never waits on the network. The connection is established
+// by the writer when there is something to send and reestablished after it
+// fails (e.g. because the other server crashed). While the server cannot be
+// reached, queued messages are discarded. Messages are written in the order
+// they were queued, so FIFO receipt holds as long as messages are queued in the
+// order they were sent (see broadcast).
+type peerConn struct {
+	id    int         // id of the server on the other end
+	queue chan []byte // messages waiting to be written
+
+	// requests to write out every queued message, each of which is closed
+	// once that is done (see Drain)
+	drains chan chan struct{}
+
+	// closed to stop the writer thread (see tsPeerConns.Retain)
+	stop chan struct{}
+
+	// only accessed by the writer thread (and watch)
+	conn       net.Conn      // nil if not connected
+	writer     *bufio.Writer // buffered writer for conn
+	redialTime time.Time     // earliest time to reconnect after a failure
+	mutex      sync.Mutex    // mutex for accessing conn and writer
+}
+
+// tsPeerConns is a set of connections to other servers (one per server id)
+type tsPeerConns struct {
+	value map[int]*peerConn
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// Get returns the connection for the server with the given id, creating it
+// (and starting its writer thread) if necessary
+func (tsp *tsPeerConns) Get(id int) *peerConn {
+	tsp.mutex.Lock()
+	defer tsp.mutex.Unlock()
+
+	if tsp.value == nil {
+		tsp.value = make(map[int]*peerConn)
+	}
+	pc, isPresent := tsp.value[id]
+	if !isPresent {
+		pc = &peerConn{
+			id:     id,
+			queue:  make(chan []byte, SEND_QUEUE_SIZE),
+			drains: make(chan chan struct{}),
+			stop:   make(chan struct{}),
+		}
+		tsp.value[id] = pc
+		go pc.run()
+	}
+	return pc
+}
+
+// Retain stops the connections to servers whose ids are not in ids (e.g.
+// because they left the membership view), discarding their queued messages
+//
+// NOTE: a later send to such a server creates a new connection (see Get)
+func (tsp *tsPeerConns) Retain(ids []int) {
+	keep := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+
+	tsp.mutex.Lock()
+	defer tsp.mutex.Unlock()
+	for id, pc := range tsp.value {
+		if !keep[id] {
+			close(pc.stop)
+			delete(tsp.value, id)
+		}
+	}
+}
+
+// Drain waits until every message queued for any server so far has been written
+// (or discarded), or until deadline, and returns whether they were
+func (tsp *tsPeerConns) Drain(deadline time.Time) bool {
+	tsp.mutex.Lock()
+	conns := make([]*peerConn, 0, len(tsp.value))
+	for _, pc := range tsp.value {
+		conns = append(conns, pc)
+	}
+	tsp.mutex.Unlock()
+
+	drained := make(chan bool, len(conns))
+	for _, pc := range conns {
+		go func(pc *peerConn) { drained <- pc.Drain(deadline) }(pc)
+	}
+	all := true
+	for range conns {
+		all = <-drained && all
+	}
+	return all
+}
+
+// Send adds msg to the outbound queue of the server
+//
+// If the queue is full, the message is handled according to SEND_POLICY and
+// errQueueFull is returned if it is discarded
+func (pc *peerConn) Send(msg []byte) error {
+	select {
+	case pc.queue <- msg:
+		return nil
+	default:
+	}
+
+	if SEND_POLICY != SEND_POLICY_BLOCK {
+		pc.countFailure()
+		return errQueueFull
+	}
+
+	expired, timer := newTimer(SEND_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case pc.queue <- msg:
+		return nil
+	case <-expired:
+		pc.countFailure()
+		return errQueueFull
+	}
+}
+
+// countFailure counts a message to the server that was discarded (see
+// SendFailures)
+func (pc *peerConn) countFailure() {
+	SendFailures.Add(strconv.Itoa(pc.id))
+}
+
+// Drain waits until every message queued so far has been written to the
+// server (or discarded), or until deadline, and returns whether it was
+func (pc *peerConn) Drain(deadline time.Time) bool {
+	expired, timer := newTimer(deadline.Sub(Clock.Now()))
+	defer timer.Stop()
+
+	done := make(chan struct{})
+	select {
+	case pc.drains <- done:
+	case <-expired:
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+// run writes queued messages to the server until the connection is stopped
+// (or the process exits)
+func (pc *peerConn) run() {
+	for {
+		select {
+		case <-pc.stop:
+			pc.mutex.Lock()
+			pc.close()
+			pc.mutex.Unlock()
+			return
+		case msg := <-pc.queue:
+			err := pc.write(msg)
+			if err != nil {
+				continue
+			}
+			pc.writePending()
+			pc.flush()
+		case done := <-pc.drains:
+			// messages queued before the request are already
+			// in the queue
+			pc.writePending()
+			pc.flush()
+			close(done)
+		}
+	}
+}
+
+// writePending writes out every message that is already queued (without
+// flushing)
+func (pc *peerConn) writePending() {
+	for {
+		select {
+		case msg := <-pc.queue:
+			pc.write(msg)
+		default:
+			return
+		}
+	}
+}
+
+// write adds msg followed by a '\n' to the write buffer of the current
+// connection, (re)connecting if necessary
+//
+// A connection that turns out to be broken is closed and the message is
+// retried once on a new connection. An error is returned if the message was
+// discarded.
+func (pc *peerConn) write(msg []byte) error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	err := pc.writeConn(msg)
+	if err != nil && pc.conn != nil {
+		pc.close()
+		err = pc.writeConn(msg)
+	}
+	if err != nil {
+		pc.close()
+		pc.countFailure()
+	}
+	return err
+}
+
+// flush writes any buffered messages to the current connection
+//
+// NOTE: a failed flush is counted as a single failure, although it may discard
+// several messages
+func (pc *peerConn) flush() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.conn == nil {
+		return
+	}
+	pc.conn.SetWriteDeadline(Clock.Now().Add(WRITE_TIMEOUT))
+	err := pc.writer.Flush()
+	if err != nil {
+		pc.close()
+		pc.countFailure()
+	}
+}
+
+// writeConn adds msg to the write buffer of the current connection, dialing a
+// new one if there is none
+//
+// Assumes pc.mutex is held
+func (pc *peerConn) writeConn(msg []byte) error {
+	if pc.conn == nil {
+		now := Clock.Now()
+		if now.Before(pc.redialTime) {
+			return errors.New("server " + strconv.Itoa(pc.id) +
+				" is unreachable")
+		}
+
+		addr := peerAddr(pc.id)
+		conn, err := dialPeer(addr, pc.id)
+		DialLatency.Observe(strconv.Itoa(pc.id),
+			Clock.Now().Sub(now).Seconds())
+		if err != nil {
+			Logger.Debug("failed to connect", LOG_PEER, pc.id,
+				"addr", addr, LOG_ERROR, err)
+			pc.redialTime = now.Add(REDIAL_INTERVAL)
+			return err
+		}
+		pc.conn = conn
+		pc.writer = bufio.NewWriter(conn)
+		go pc.watch(conn)
+	}
+
+	// a write only reaches the connection if the buffer fills up
+	pc.conn.SetWriteDeadline(Clock.Now().Add(WRITE_TIMEOUT))
+	_, err := pc.writer.Write(msg)
+	if err != nil {
+		return err
+	}
+	return pc.writer.WriteByte('\n')
+}
+
+// watch reads from conn until it fails and then closes it (if it is still the
+// current connection)
+//
+// Servers never write to peer connections, so a read only returns once the
+// other end has closed the connection or crashed. Watching for this means a
+// dead connection is replaced before it swallows a message.
+func (pc *peerConn) watch(conn net.Conn) {
+	io.Copy(io.Discard, conn)
+
+	pc.mutex.Lock()
+	if pc.conn == conn {
+		pc.close()
+	}
+	pc.mutex.Unlock()
+}
+
+// close closes the current connection (if any)
+//
+// Assumes pc.mutex is held
+func (pc *peerConn) close() {
+	if pc.conn != nil {
+		pc.conn.Close()
+	}
+	pc.conn = nil
+	pc.writer = nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sfurman3/chatroom/simnet"
+)
+
+// simulatePeer makes this server reach server id over a simulated network and
+// returns a listener on its server-facing port
+func simulatePeer(t *testing.T, id int) (*simnet.Network, net.Listener) {
+	t.Helper()
+	network := simnet.New(1, nil)
+	Network = network.Host("0")
+	t.Cleanup(func() { Network = tcpTransport{} })
+
+	addr := "localhost:" + strconv.Itoa(27000+id)
+	ln, err := network.Host(strconv.Itoa(id)).Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	Membership = tsMembership{}
+	Membership.Init(0)
+	Membership.Add(id, addr)
+	return network, ln
+}
+
+// readLine accepts a connection from ln (unless conn is given) and reads a
+// line from it
+func readLine(t *testing.T, ln net.Listener, conn net.Conn) (net.Conn,
+	string) {
+
+	t.Helper()
+	if conn == nil {
+		var err error
+		conn, err = ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read %q: %v", line, err)
+	}
+	return conn, line
+}
+
+func TestPeerConnReconnects(t *testing.T) {
+	_, ln := simulatePeer(t, 7)
+	var peers tsPeerConns
+	pc := peers.Get(7)
+
+	pc.Send([]byte("a"))
+	conn, line := readLine(t, ln, nil)
+	if line != "a\n" {
+		t.Fatalf("read %q, want %q", line, "a\n")
+	}
+
+	// the other server restarts, which the writer notices before the
+	// next message
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pc.mutex.Lock()
+		closed := pc.conn == nil
+		pc.mutex.Unlock()
+		if closed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pc.Send([]byte("b"))
+	_, line = readLine(t, ln, nil)
+	if line != "b\n" {
+		t.Fatalf("read %q on a new connection, want %q", line, "b\n")
+	}
+
+	// a server that left the view is no longer written to
+	peers.Retain(nil)
+	select {
+	case <-pc.stop:
+	default:
+		t.Fatal("connection to a removed server was not stopped")
+	}
+	if peers.Get(7) == pc {
+		t.Error("stopped connection is still in use")
+	}
+}
+
+func TestPeerConnQueueFull(t *testing.T) {
+	sendTimeout := SEND_TIMEOUT
+	defer func() {
+		SEND_POLICY, SEND_TIMEOUT = SEND_POLICY_DROP, sendTimeout
+	}()
+
+	// without a writer thread, nothing leaves the queue
+	pc := &peerConn{id: 7, queue: make(chan []byte, 2)}
+	failures := SendFailures.Counts()["7"]
+	for i := 0; i < 2; i++ {
+		if err := pc.Send([]byte("m")); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := pc.Send([]byte("m")); err != errQueueFull {
+		t.Fatalf("send to a full queue returned %v, want %v", err,
+			errQueueFull)
+	}
+
+	SEND_POLICY, SEND_TIMEOUT = SEND_POLICY_BLOCK, 10*time.Millisecond
+	start := time.Now()
+	if err := pc.Send([]byte("m")); err != errQueueFull {
+		t.Fatalf("blocking send to a full queue returned %v, want %v",
+			err, errQueueFull)
+	}
+	if time.Since(start) < SEND_TIMEOUT {
+		t.Error("blocking send did not wait for room in the queue")
+	}
+	if got := SendFailures.Counts()["7"] - failures; got != 2 {
+		t.Errorf("counted %d failures, want 2", got)
+	}
+}
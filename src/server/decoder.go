@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maximum id of a server plus one (messages claiming to be from other ids are
+// rejected before they reach any per-server state)
+const MAX_SERVERS = 1 << 16
+
+// Maximum length of the content of a broadcast, which keeps every sync batch
+// (see SYNC_BATCH_SIZE) well within the default MAX_FRAME_SIZE
+const MAX_CONTENT_SIZE = 16 << 10
+
+// Maximum number of remote hosts whose rate of frames is tracked before the
+// idle ones are forgotten (see tsRateLimiter)
+const RATE_LIMIT_HOSTS = 1024
+
+// Reasons for rejecting a message from another server (see Rejected)
+const (
+	REJECT_OVERSIZED   = "oversized"   // frame longer than MAX_FRAME_SIZE
+	REJECT_MALFORMED   = "malformed"   // not a valid message
+	REJECT_INVALID_ID  = "invalid_id"  // sender id out of range
+	REJECT_IMPOSTOR    = "impostor"    // id differs from the TLS identity
+	REJECT_UNSIGNED    = "unsigned"    // no signature
+	REJECT_UNKNOWN_KEY = "unknown_key" // no public key for the sender
+	REJECT_FORGED      = "forged"      // signature does not match
+)
+
+// Limits on the frames received from other servers (see registerTimingFlags)
+var (
+	// maximum length of a frame (i.e. an encoded message and its '\n')
+	MAX_FRAME_SIZE = 8 << 20
+
+	// maximum rate of frames (per second) from each remote host, beyond
+	// which reading from its connections is delayed (0 for no limit)
+	PEER_RATE_LIMIT = 10000.0
+)
+
+var (
+	// number of messages from other servers that were rejected, keyed by
+	// reason (one of the REJECT_* reasons)
+	Rejected tsCounters
+
+	// rate of frames from each remote host
+	PeerLimiter tsRateLimiter
+
+	errFrameTooLarge = errors.New("frame too large")
+)
+
+// readFrame reads a frame (i.e. the bytes up to and including the next '\n')
+// of at most max bytes from reader
+//
+// Returns errFrameTooLarge as soon as the frame exceeds max bytes, so the
+// reader is not buffered beyond that
+func readFrame(reader *bufio.Reader, max int) ([]byte, error) {
+	var frame []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(frame)+len(chunk) > max {
+			return nil, errFrameTooLarge
+		}
+		frame = append(frame, chunk...)
+		if err != bufio.ErrBufferFull {
+			return frame, err
+		}
+	}
+}
+
+// decodeMessage decodes a frame received from the server with id sender (or
+// -1 if servers are not authenticated) and checks that it is valid (see
+// validateMessage) and signed by its sender (see verifyMessage)
+//
+// Returns the REJECT_* reason and an error if the message is rejected
+func decodeMessage(frame []byte, sender int) (*Message, string, error) {
+	msg := new(Message)
+	err := json.Unmarshal(frame, msg)
+	if err != nil {
+		return nil, REJECT_MALFORMED, err
+	}
+	if !validServerId(msg.Id) {
+		return nil, REJECT_INVALID_ID, errors.New("invalid server id " +
+			strconv.Itoa(msg.Id))
+	}
+	if sender != -1 && msg.Id != sender {
+		return nil, REJECT_IMPOSTOR, errors.New("server " +
+			strconv.Itoa(sender) + " claims to be server " +
+			strconv.Itoa(msg.Id))
+	}
+	err = validateMessage(msg)
+	if err != nil {
+		return nil, REJECT_MALFORMED, err
+	}
+	if reason := verifyMessage(msg); reason != "" {
+		return nil, reason, errors.New("message from server " +
+			strconv.Itoa(msg.Id) + " is " + reason)
+	}
+	return msg, "", nil
+}
+
+// validServerId returns whether id is in {0, ..., MAX_SERVERS-1}
+func validServerId(id int) bool {
+	return id >= 0 && id < MAX_SERVERS
+}
+
+// validateMessage checks that every field of msg that refers to a server, a
+// room or another message is in the range its handler relies on
+//
+// NOTE: the id of msg itself is checked by decodeMessage
+func validateMessage(msg *Message) error {
+	switch msg.Type {
+	case "", MSG_JOIN, MSG_VIEW, MSG_LEAVE, MSG_SYNC, MSG_SYNC_REPLY,
+		MSG_PING, MSG_PING_REQ, MSG_ACK:
+	default:
+		return errors.New("unknown message type " +
+			strconv.Quote(msg.Type))
+	}
+	if msg.Room != "" && !roomName.MatchString(msg.Room) {
+		return errors.New("invalid room name " +
+			strconv.Quote(msg.Room))
+	}
+
+	// the causal orderer indexes the vector by the id of the timestamp
+	if msg.Vts != nil && (msg.Vts.Id != msg.Id+1 ||
+		len(msg.Vts.Vector) <= msg.Id) {
+		return errors.New("invalid vector timestamp")
+	}
+
+	for id := range msg.Digest {
+		if !validServerId(id) {
+			return errors.New("invalid server id in digest")
+		}
+	}
+	for id, m := range msg.View {
+		if !validServerId(id) {
+			return errors.New("invalid server id in view")
+		}
+		for _, room := range m.Rooms {
+			if !roomName.MatchString(room) {
+				return errors.New("invalid room name in view")
+			}
+		}
+	}
+
+	if msg.Probe != nil && (!validServerId(msg.Probe.Target) ||
+		!validServerId(msg.Probe.Origin)) {
+		return errors.New("invalid server id in probe")
+	}
+	for _, update := range msg.Updates {
+		if !validServerId(update.Id) {
+			return errors.New("invalid server id in update")
+		}
+		switch update.State {
+		case SWIM_ALIVE, SWIM_SUSPECT, SWIM_DEAD:
+		default:
+			return errors.New("invalid state in update")
+		}
+	}
+
+	// batches hold chat messages of the same room (see handleSync)
+	for _, batched := range msg.Batch {
+		if batched == nil || !validServerId(batched.Id) ||
+			batched.Type != "" || batched.Content == "" ||
+			batched.Room != msg.Room || len(batched.Batch) != 0 {
+			return errors.New("invalid message in batch")
+		}
+		err := validateMessage(batched)
+		if err != nil {
+			return errors.New("invalid message in batch: " +
+				err.Error())
+		}
+	}
+	return nil
+}
+
+// reject counts a message from another server that was rejected for the given
+// reason and logs it with the given error (if any) and fields (e.g. LOG_PEER)
+func reject(reason string, err error, fields ...interface{}) {
+	Rejected.Add(reason)
+	fields = append([]interface{}{"reason", reason}, fields...)
+	if err != nil {
+		fields = append(fields, LOG_ERROR, err)
+	}
+	Logger.Warn("rejected message", fields...)
+}
+
+// tsRateLimiter limits the rate of events (e.g. frames) from each remote host
+// with a token bucket that holds one second's worth of events
+type tsRateLimiter struct {
+	value   map[string]*tokenBucket
+	delayed uint64     // number of events that had to wait
+	mutex   sync.Mutex // mutex for accessing contents
+}
+
+// tokenBucket is the state of a token bucket
+type tokenBucket struct {
+	tokens float64   // negative while events are waiting for tokens
+	last   time.Time // time at which tokens was last updated
+}
+
+// Reserve takes a token from the bucket of host, which is refilled at rate
+// tokens per second, and returns how long the event has to wait for it (0 if
+// rate is 0)
+func (tsl *tsRateLimiter) Reserve(host string, rate float64,
+	now time.Time) time.Duration {
+
+	if rate <= 0 {
+		return 0
+	}
+
+	tsl.mutex.Lock()
+	defer tsl.mutex.Unlock()
+
+	if tsl.value == nil {
+		tsl.value = make(map[string]*tokenBucket)
+	}
+	bucket, isPresent := tsl.value[host]
+	if !isPresent {
+		if len(tsl.value) >= RATE_LIMIT_HOSTS {
+			tsl.evict(rate, now)
+		}
+		bucket = &tokenBucket{tokens: rate, last: now}
+		tsl.value[host] = bucket
+	}
+
+	bucket.tokens = math.Min(rate,
+		bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	tsl.delayed++
+	return time.Duration(-bucket.tokens / rate * float64(time.Second))
+}
+
+// evict forgets the hosts whose buckets are full again (i.e. that have been
+// idle for long enough that they are not limited)
+//
+// Assumes tsl.mutex is held
+func (tsl *tsRateLimiter) evict(rate float64, now time.Time) {
+	for host, bucket := range tsl.value {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= rate {
+			delete(tsl.value, host)
+		}
+	}
+}
+
+// Delayed returns the number of events that had to wait for a token
+func (tsl *tsRateLimiter) Delayed() uint64 {
+	tsl.mutex.Lock()
+	defer tsl.mutex.Unlock()
+
+	return tsl.delayed
+}
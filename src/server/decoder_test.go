@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFrame(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader(
+		"short\n"+strings.Repeat("x", 40)+"\nrest"), 16)
+
+	frame, err := readFrame(reader, 32)
+	if err != nil || string(frame) != "short\n" {
+		t.Fatalf("readFrame = %q, %v", frame, err)
+	}
+	_, err = readFrame(reader, 32)
+	if err != errFrameTooLarge {
+		t.Fatalf("readFrame of a long frame returned %v", err)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	cases := []struct {
+		frame  string
+		sender int
+		reason string
+	}{
+		{`{"id": 1, "msg": "hi", "room": "ops"}`, -1, ""},
+		{`{"id": 1, "type": "view", ` +
+			`"view": {"2": {"rooms": ["a"]}}}`, 1, ""},
+		{`{"id": 1, "vts": {"id": 2, "v": ["0", "1"]}}`, -1, ""},
+		{`{"id": 1, "type": "sync-reply", ` +
+			`"batch": [{"id": 2, "msg": "a"}]}`, -1, ""},
+		{`[1, 2]`, -1, REJECT_MALFORMED},
+		{`{"id": 65536}`, -1, REJECT_INVALID_ID},
+		{`{"id": 1}`, 2, REJECT_IMPOSTOR},
+		{`{"id": 1, "type": "bogus"}`, -1, REJECT_MALFORMED},
+		{`{"id": 1, "room": "../../etc"}`, -1, REJECT_MALFORMED},
+		{`{"id": 1, "vts": {"id": 0, "v": ["0", "1"]}}`, -1,
+			REJECT_MALFORMED},
+		{`{"id": 1, "vts": {"id": 2, "v": ["0"]}}`, -1,
+			REJECT_MALFORMED},
+		{`{"id": 1, "digest": {"-1": {}}}`, -1, REJECT_MALFORMED},
+		{`{"id": 1, "view": {"-3": {}}}`, -1, REJECT_MALFORMED},
+		{`{"id": 1, "view": {"2": {"rooms": ["#no"]}}}`, -1,
+			REJECT_MALFORMED},
+		{`{"id": 1, "type": "ping", "probe": {"target": -1}}`, -1,
+			REJECT_MALFORMED},
+		{`{"id": 1, "updates": [{"id": 2, "state": "zombie"}]}`, -1,
+			REJECT_MALFORMED},
+		{`{"id": 1, "batch": [null]}`, -1, REJECT_MALFORMED},
+		{`{"id": 1, "batch": [{"id": 2}]}`, -1, REJECT_MALFORMED},
+		{`{"id": 1, "batch": [{"id": 2, "room": "ops"}]}`, -1,
+			REJECT_MALFORMED},
+		{`{"id": 1, "batch": [{"id": 2, "batch": [{"id": 3}]}]}`, -1,
+			REJECT_MALFORMED},
+	}
+	for _, c := range cases {
+		_, reason, err := decodeMessage([]byte(c.frame), c.sender)
+		if reason != c.reason || (err == nil) != (c.reason == "") {
+			t.Errorf("decodeMessage(%s) = %q, %v, want %q", c.frame,
+				reason, err, c.reason)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var limiter tsRateLimiter
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if delay := limiter.Reserve("a", 10, now); delay != 0 {
+			t.Fatalf("event %d within the burst waits %v", i, delay)
+		}
+	}
+	delay := limiter.Reserve("a", 10, now)
+	if delay != 100*time.Millisecond {
+		t.Fatalf("event beyond the burst waits %v, want 100ms", delay)
+	}
+	if delay := limiter.Reserve("b", 10, now); delay != 0 {
+		t.Fatalf("another host waits %v", delay)
+	}
+	if delay := limiter.Reserve("a", 10, now.Add(time.Second)); delay != 0 {
+		t.Fatalf("event after the bucket refilled waits %v", delay)
+	}
+	if limiter.Delayed() != 1 {
+		t.Fatalf("%d events delayed, want 1", limiter.Delayed())
+	}
+}
+
+// FuzzDecodeMessage checks that no frame crashes the decoder, and that every
+// message it accepts is still accepted after it is encoded again
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"id": 1, "rts": "2020-01-02T03:04:05Z", "msg": "hi", ` +
+			`"epoch": 1, "seq": 2, "lts": "5"}`,
+		`{"id": 1, "type": "view", "view": {"2": {"addr": "h:1", ` +
+			`"version": 3, "rooms": ["ops"]}}, "vv": 1, "vh": 2}`,
+		`{"id": 1, "type": "sync", "room": "ops", ` +
+			`"digest": {"1": [{"from": {"epoch": 1, "seq": 1}, ` +
+			`"to": {"epoch": 1, "seq": 2}}]}}`,
+		`{"id": 1, "type": "sync-reply", ` +
+			`"batch": [{"id": 2, "seq": 1, "msg": "a"}]}`,
+		`{"id": 1, "type": "ping-req", ` +
+			`"probe": {"seq": 1, "target": 2, "origin": 1}, ` +
+			`"updates": [{"id": 2, "state": "suspect"}]}`,
+		`{"id": 0, "msg": "x", "vts": {"id": 1, "v": ["1", "0"]}}`,
+		`{"id": 1, "sig": "AAAA"}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		msg, _, err := decodeMessage(frame, -1)
+		if err != nil {
+			return
+		}
+		msgBytes, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("cannot encode accepted message %+v: %v", msg,
+				err)
+		}
+		_, reason, err := decodeMessage(msgBytes, msg.Id)
+		if err != nil {
+			t.Fatalf("accepted %q but not %q (%s: %v)", frame,
+				msgBytes, reason, err)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Failure detectors accepted by the -detector flag
+const (
+	// a server is alive if a message was received from it within
+	// ALIVE_INTERVAL
+	DETECTOR_FIXED = "fixed"
+
+	// a server is alive if its phi value (see phiDetector) is below
+	// PHI_THRESHOLD
+	DETECTOR_PHI = "phi"
+
+	// a server is alive unless the SWIM protocol declared it dead (see
+	// swim), which replaces all-to-all heartbeats
+	DETECTOR_SWIM = "swim"
+)
+
+// Maximum number of inter-arrival times kept for each server by the phi accrual
+// failure detector
+const PHI_WINDOW_SIZE = 100
+
+// Minimum standard deviation of inter-arrival times used by the phi accrual
+// failure detector, which keeps a few late heartbeats from causing suspicion
+// when heartbeats are otherwise very regular (HEARTBEAT_INTERVAL / 4, see
+// registerTimingFlags)
+var PHI_MIN_STDDEV = 50 * time.Millisecond
+
+// FailureDetector decides which servers are alive based on when messages from
+// them were received
+//
+// Every message from a server shows that it is alive, but only its periodic
+// heartbeats (see heartbeat) arrive at regular intervals, so other messages
+// (e.g. bursts of chat messages) are recorded separately.
+//
+// Times are always local receipt times (never timestamps set by the sender),
+// so detectors are not affected by clock skew between hosts. Implementations
+// are not safe for concurrent use (see tsTimestampQueue).
+type FailureDetector interface {
+	// Heartbeat records that a periodic heartbeat from the server with the
+	// given id was received at now
+	Heartbeat(id int, now time.Time)
+
+	// Arrival records that any other message from the server with the
+	// given id was received at now
+	Arrival(id int, now time.Time)
+
+	// Alive returns whether the server with the given id is believed to be
+	// alive at now
+	Alive(id int, now time.Time) bool
+
+	// Phi returns the level of suspicion that the server with the given id
+	// has failed at now (larger values mean failure is more likely, and
+	// +Inf means nothing was ever received from it)
+	Phi(id int, now time.Time) float64
+
+	// Forget records that the server with the given id announced that it
+	// is shutting down, so it is not alive until it is heard from again
+	Forget(id int)
+}
+
+// newFailureDetector returns the failure detector with the given name
+func newFailureDetector(name string) (FailureDetector, error) {
+	switch name {
+	case DETECTOR_FIXED:
+		return &fixedDetector{last: make(map[int]time.Time)}, nil
+	case DETECTOR_PHI:
+		return &phiDetector{
+			history:   make(map[int]*arrivalHistory),
+			threshold: PHI_THRESHOLD,
+		}, nil
+	case DETECTOR_SWIM:
+		return &swimDetector{swim: Swim}, nil
+	}
+	return nil, fmt.Errorf("unknown failure detector: %q", name)
+}
+
+// fixedDetector considers a server alive if a message was received from it
+// within ALIVE_INTERVAL
+//
+// Its phi value is the time since the last message in units of ALIVE_INTERVAL,
+// so servers with a value of 1 or more are not alive
+type fixedDetector struct {
+	// receipt time of the last message of each server
+	last map[int]time.Time
+}
+
+func (fd *fixedDetector) Heartbeat(id int, now time.Time) {
+	fd.last[id] = now
+}
+
+func (fd *fixedDetector) Arrival(id int, now time.Time) {
+	fd.last[id] = now
+}
+
+func (fd *fixedDetector) Alive(id int, now time.Time) bool {
+	return fd.Phi(id, now) < 1
+}
+
+func (fd *fixedDetector) Forget(id int) {
+	delete(fd.last, id)
+}
+
+func (fd *fixedDetector) Phi(id int, now time.Time) float64 {
+	last, isPresent := fd.last[id]
+	if !isPresent {
+		return math.Inf(1)
+	}
+	return float64(now.Sub(last)) / float64(ALIVE_INTERVAL)
+}
+
+// phiDetector is a phi accrual failure detector (Hayashibara et al., 2004)
+//
+// Rather than a binary decision, it computes a suspicion level
+//
+//	phi = -log10(P(no message for at least t))
+//
+// where t is the time since the last message and the probability is estimated
+// from the mean and standard deviation of the most recent inter-arrival times
+// of heartbeats, assuming they are normally distributed. A phi of 1 means a 10%
+// chance the server is still alive, 2 means 1%, 3 means 0.1%, and so on.
+type phiDetector struct {
+	history   map[int]*arrivalHistory // arrival history of each server
+	threshold float64                 // phi at which a server is dead
+}
+
+// arrivalHistory is a sliding window of the inter-arrival times of heartbeats
+// from a single server
+type arrivalHistory struct {
+	last      time.Time // receipt time of the last message
+	heartbeat time.Time // receipt time of the last heartbeat
+	intervals []float64 // most recent inter-arrival times (in seconds)
+	next      int       // index of the oldest interval once full
+	sum       float64   // sum of intervals
+	sumSq     float64   // sum of the squares of intervals
+}
+
+func (pd *phiDetector) Heartbeat(id int, now time.Time) {
+	hist, isPresent := pd.history[id]
+	if !isPresent {
+		pd.history[id] = &arrivalHistory{last: now, heartbeat: now}
+		return
+	}
+
+	if !hist.heartbeat.IsZero() {
+		hist.add(now.Sub(hist.heartbeat).Seconds())
+	}
+	hist.heartbeat = now
+	if now.After(hist.last) {
+		hist.last = now
+	}
+}
+
+// Arrival only moves the time of the last message, since the intervals between
+// other messages say nothing about those between heartbeats
+func (pd *phiDetector) Arrival(id int, now time.Time) {
+	hist, isPresent := pd.history[id]
+	if !isPresent {
+		pd.history[id] = &arrivalHistory{last: now}
+		return
+	}
+	if now.After(hist.last) {
+		hist.last = now
+	}
+}
+
+func (pd *phiDetector) Alive(id int, now time.Time) bool {
+	return pd.Phi(id, now) < pd.threshold
+}
+
+// Forget also drops the arrival history of the server, since the interval until
+// it restarts says nothing about its heartbeats
+func (pd *phiDetector) Forget(id int) {
+	delete(pd.history, id)
+}
+
+func (pd *phiDetector) Phi(id int, now time.Time) float64 {
+	hist, isPresent := pd.history[id]
+	if !isPresent {
+		return math.Inf(1)
+	}
+
+	mean, stddev := hist.stats()
+	elapsed := now.Sub(hist.last).Seconds()
+
+	// P(X > elapsed) for X ~ N(mean, stddev^2)
+	pLater := 0.5 * math.Erfc((elapsed-mean)/(stddev*math.Sqrt2))
+	if pLater <= 0 {
+		return math.Inf(1)
+	}
+	return -math.Log10(pLater)
+}
+
+// add adds an inter-arrival time (in seconds) to the window, replacing the
+// oldest one if the window is full
+func (hist *arrivalHistory) add(interval float64) {
+	if len(hist.intervals) < PHI_WINDOW_SIZE {
+		hist.intervals = append(hist.intervals, interval)
+	} else {
+		old := hist.intervals[hist.next]
+		hist.sum -= old
+		hist.sumSq -= old * old
+		hist.intervals[hist.next] = interval
+		hist.next = (hist.next + 1) % PHI_WINDOW_SIZE
+	}
+	hist.sum += interval
+	hist.sumSq += interval * interval
+}
+
+// stats returns the mean and standard deviation (in seconds) of the
+// inter-arrival times in the window
+//
+// Until at least one interval is known, heartbeats are assumed to arrive every
+// HEARTBEAT_INTERVAL. The standard deviation is never less than
+// PHI_MIN_STDDEV.
+func (hist *arrivalHistory) stats() (float64, float64) {
+	n := float64(len(hist.intervals))
+	mean := HEARTBEAT_INTERVAL.Seconds()
+	variance := 0.0
+	if n > 0 {
+		mean = hist.sum / n
+		variance = hist.sumSq/n - mean*mean
+	}
+
+	stddev := math.Sqrt(math.Max(variance, 0))
+	return mean, math.Max(stddev, PHI_MIN_STDDEV.Seconds())
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFixedDetector(t *testing.T) {
+	fd, _ := newFailureDetector(DETECTOR_FIXED)
+	now := time.Now()
+	if fd.Alive(1, now) {
+		t.Fatal("server without heartbeats should not be alive")
+	}
+
+	fd.Heartbeat(1, now)
+	if !fd.Alive(1, now.Add(ALIVE_INTERVAL-time.Millisecond)) {
+		t.Fatal("server should be alive within ALIVE_INTERVAL")
+	}
+	if fd.Alive(1, now.Add(ALIVE_INTERVAL)) {
+		t.Fatal("server should not be alive after ALIVE_INTERVAL")
+	}
+}
+
+func TestPhiDetector(t *testing.T) {
+	PHI_THRESHOLD = 8
+	pd, _ := newFailureDetector(DETECTOR_PHI)
+	now := time.Now()
+	if !math.IsInf(pd.Phi(1, now), 1) {
+		t.Fatal("phi of a server without heartbeats should be +Inf")
+	}
+
+	for i := 0; i < 20; i++ {
+		pd.Heartbeat(1, now)
+		now = now.Add(HEARTBEAT_INTERVAL)
+	}
+	last := now.Add(-HEARTBEAT_INTERVAL)
+
+	// phi increases with the time since the last heartbeat
+	prev := -1.0
+	for _, elapsed := range []time.Duration{0, HEARTBEAT_INTERVAL / 2,
+		HEARTBEAT_INTERVAL, 2 * HEARTBEAT_INTERVAL} {
+		phi := pd.Phi(1, last.Add(elapsed))
+		if phi <= prev {
+			t.Fatalf("phi did not increase after %v: %v <= %v",
+				elapsed, phi, prev)
+		}
+		prev = phi
+	}
+
+	if !pd.Alive(1, last.Add(HEARTBEAT_INTERVAL)) {
+		t.Fatal("server should be alive after a regular interval")
+	}
+	if pd.Alive(1, last.Add(5*HEARTBEAT_INTERVAL)) {
+		t.Fatal("server should be dead after 5 missed heartbeats")
+	}
+}
+
+func TestPhiDetectorIgnoresBursts(t *testing.T) {
+	ID, PHI_THRESHOLD = 0, 8
+	detector, _ := newFailureDetector(DETECTOR_PHI)
+	tsq := tsTimestampQueue{detector: detector}
+	heartbeat := &Message{Id: 1, Heartbeat: true}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		tsq.UpdateTimestamp(heartbeat, now)
+		now = now.Add(HEARTBEAT_INTERVAL)
+	}
+
+	// a burst of chat messages 1ms apart right after a heartbeat
+	for i := 0; i < PHI_WINDOW_SIZE; i++ {
+		tsq.UpdateTimestamp(&Message{Id: 1, Content: "hi"}, now)
+		now = now.Add(time.Millisecond)
+	}
+	if !tsq.Alive(1, now.Add(3*HEARTBEAT_INTERVAL/2)) {
+		t.Fatalf("server is dead after a burst (phi %v)",
+			detector.Phi(1, now.Add(3*HEARTBEAT_INTERVAL/2)))
+	}
+	if tsq.Alive(1, now.Add(5*HEARTBEAT_INTERVAL)) {
+		t.Fatal("server should be dead after 5 missed heartbeats")
+	}
+}
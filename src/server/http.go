@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum size of the body of a request to the HTTP gateway
+const HTTP_MAX_BODY_SIZE = 1 << 20
+
+var (
+	// address ("host:port") of the HTTP gateway (see serveHTTP), which is
+	// disabled if empty
+	HTTP_ADDR = ""
+
+	// comma-separated origins (e.g. "https://chat.example.com") of the
+	// web pages that may open /stream, besides the gateway's own (see
+	// allowOrigin)
+	HTTP_ORIGINS = ""
+)
+
+// commands a /stream session may run
+var streamCommands = map[string]bool{"subscribe": true, "unsubscribe": true}
+
+// serveHTTP serves the HTTP gateway on HTTP_ADDR, which exposes the master
+// commands to HTTP clients and to the web pages of the origins it allows (see
+// allowOrigin and handleHTTPBroadcast):
+//
+//	POST /broadcast  {"room": "ops", "msg": "hello"}  -> broadcast
+//	GET  /messages?room=ops&since=0&limit=10&from=1&after=...&before=...
+//	                                                  -> get
+//	GET  /alive                                       -> alive
+//	GET  /stream?room=ops&from=0                      -> subscribe
+//
+// Every reply is a masterReply (without an id), with a status code that
+// reflects its error code. /stream upgrades the connection to a WebSocket
+// and is a MASTER_PROTOCOL_V2 session that starts out subscribed to the given
+// room: events and replies are sent as text messages, and the client can send
+// further "subscribe" and "unsubscribe" requests the same way.
+func serveHTTP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/broadcast", handleHTTPBroadcast)
+	mux.HandleFunc("/messages", handleHTTPMessages)
+	mux.HandleFunc("/alive", handleHTTPAlive)
+	mux.HandleFunc("/stream", handleHTTPStream)
+
+	server := &http.Server{
+		Addr:              HTTP_ADDR,
+		Handler:           mux,
+		ReadHeaderTimeout: READ_TIMEOUT,
+		TLSConfig:         MasterTLS,
+	}
+	if !MasterConns.Add(server) {
+		return
+	}
+	var err error
+	if MasterTLS != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		Fatal("failed to serve HTTP", "addr", HTTP_ADDR, LOG_ERROR, err)
+	}
+}
+
+// handleHTTPBroadcast broadcasts the message in the application/json body of r
+// (which a web page on another origin cannot send without a CORS preflight)
+func handleHTTPBroadcast(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		http.Error(w, "expected application/json",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req := &masterRequest{Cmd: "broadcast"}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		HTTP_MAX_BODY_SIZE)).Decode(req)
+	if err != nil {
+		writeHTTPReply(w, nil, newMasterError(ERR_INVALID_REQUEST, err))
+		return
+	}
+	req.Cmd = "broadcast"
+	runHTTPCommand(w, req)
+}
+
+func handleHTTPMessages(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	req, err := parseHTTPQuery(r, "get")
+	if err != nil {
+		writeHTTPReply(w, nil, err)
+		return
+	}
+	runHTTPCommand(w, req)
+}
+
+func handleHTTPAlive(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	runHTTPCommand(w, &masterRequest{Cmd: "alive", Phi: true})
+}
+
+// handleHTTPStream upgrades the connection to a WebSocket and serves a
+// MASTER_PROTOCOL_V2 session on it (see serveHTTP)
+func handleHTTPStream(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) || !allowOrigin(w, r) {
+		return
+	}
+	req, err := parseHTTPQuery(r, "subscribe")
+	if err != nil {
+		writeHTTPReply(w, nil, err)
+		return
+	}
+	subscribe, _ := json.Marshal(req)
+
+	ws, err := wsAccept(w, r)
+	if err != nil {
+		return
+	}
+
+	session := newMasterSession(bufio.NewReadWriter(ws.reader,
+		bufio.NewWriter(ws)))
+	session.conn = ws.conn
+	session.version = MASTER_PROTOCOL_V2
+	session.allowed = streamCommands
+	defer session.Close()
+	defer ws.Close()
+
+	// the connection was hijacked, so closing the server does not close it
+	if !MasterConns.Add(ws) {
+		return
+	}
+	defer MasterConns.Remove(ws)
+
+	line := string(subscribe)
+	for {
+		err = session.handle(line)
+		if err != nil {
+			// connection to client lost
+			return
+		}
+
+		var payload []byte
+		payload, err = ws.ReadMessage()
+		if err != nil {
+			// connection to client lost (or closed)
+			return
+		}
+		line = string(payload)
+	}
+}
+
+// allowMethod returns whether r uses the given method, replying with
+// http.StatusMethodNotAllowed if it does not
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// allowOrigin returns whether r comes from a web page that may use the gateway,
+// replying with http.StatusForbidden if it does not
+//
+// Pages are identified by the Origin header, which browsers send with every
+// WebSocket handshake. Requests without one (i.e. not from a browser) and
+// pages served by the gateway's own host are allowed, as are the origins in
+// HTTP_ORIGINS.
+func allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(HTTP_ORIGINS, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), origin) {
+			return true
+		}
+	}
+	http.Error(w, "origin not allowed", http.StatusForbidden)
+	return false
+}
+
+// parseHTTPQuery returns the request for cmd given by the query parameters of
+// r, i.e. the fields of masterRequest named in the JSON format (e.g. "room",
+// "since" or "from")
+//
+// NOTE: "from" is the sender of a message for "get" (as in MASTER_PROTOCOL_V1)
+// and the position to start at for "subscribe"
+func parseHTTPQuery(r *http.Request, cmd string) (*masterRequest, error) {
+	query := r.URL.Query()
+	req := &masterRequest{Cmd: cmd, Room: query.Get("room")}
+
+	for name, values := range query {
+		value := values[len(values)-1]
+		var err error
+		switch name {
+		case "room":
+			continue
+		case "since", "limit", "from", "sender":
+			var n int
+			n, err = strconv.Atoi(value)
+			if err == nil && n < 0 {
+				err = strconv.ErrRange
+			}
+			switch {
+			case name == "since":
+				req.Since = &n
+			case name == "limit":
+				req.Limit = n
+			case name == "from" && cmd == "subscribe":
+				req.From = &n
+			default:
+				req.Sender = &n
+			}
+		case "after", "before":
+			var t time.Time
+			t, err = time.Parse(time.RFC3339Nano, value)
+			if name == "after" {
+				req.After = &t
+			} else {
+				req.Before = &t
+			}
+		default:
+			return nil, newMasterError(ERR_INVALID_ARGUMENT,
+				"unknown parameter: ", strconv.Quote(name))
+		}
+		if err != nil {
+			return nil, newMasterError(ERR_INVALID_ARGUMENT,
+				"invalid ", name, ": ", strconv.Quote(value))
+		}
+	}
+	if cmd == "subscribe" && req.paged() {
+		return nil, newMasterError(ERR_INVALID_ARGUMENT,
+			"only room and from may be given")
+	}
+	return req, req.checkRoom()
+}
+
+// runHTTPCommand runs the master command of req (outside of any session) and
+// writes its reply
+func runHTTPCommand(w http.ResponseWriter, req *masterRequest) {
+	err := req.checkRoom()
+	if err != nil {
+		writeHTTPReply(w, nil, err)
+		return
+	}
+	result, err := masterCommands[req.Cmd].run(nil, req)
+	if err != nil {
+		Logger.Warn("HTTP command failed", LOG_COMMAND, req.Cmd,
+			LOG_ERROR, err)
+	}
+	writeHTTPReply(w, result, err)
+}
+
+// writeHTTPReply writes the masterReply with the given result (or err if the
+// command failed)
+func writeHTTPReply(w http.ResponseWriter, result interface{}, err error) {
+	reply := masterReply{Status: "ok", Result: result}
+	status := http.StatusOK
+	if err != nil {
+		reply = masterReply{Status: "error", Error: toMasterError(err)}
+		status = httpStatus(reply.Error.Code)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(reply)
+}
+
+// httpStatus returns the HTTP status code of a failed command with the given
+// error code
+func httpStatus(code string) int {
+	switch code {
+	case ERR_NOT_JOINED:
+		return http.StatusNotFound
+	case ERR_UNKNOWN_COMMAND:
+		return http.StatusNotImplemented
+	case ERR_NOT_ALLOWED:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPMessages(t *testing.T) {
+	MessagesFIFO = tsMsgQueue{}
+	for i, content := range []string{"a", "b", "c"} {
+		MessagesFIFO.Enqueue(&Message{Id: 1, Seq: uint64(i + 1),
+			Content: content})
+	}
+
+	cases := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, "abc"},
+		{"?since=1&limit=1", http.StatusOK, "b"},
+		{"?room=ops", http.StatusOK, ""},
+		{"?limit=-1", http.StatusBadRequest, ""},
+		{"?room=no%20such", http.StatusBadRequest, ""},
+		{"?bogus=1", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handleHTTPMessages(w, httptest.NewRequest("GET",
+			"/messages"+c.query, nil))
+		if w.Code != c.status {
+			t.Errorf("GET /messages%s: status %d, want %d", c.query,
+				w.Code, c.status)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+
+		var reply struct {
+			Result getResult `json:"result"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &reply)
+		if err != nil {
+			t.Fatalf("invalid reply %q: %v", w.Body.String(), err)
+		}
+		got := ""
+		for _, view := range reply.Result.Messages {
+			got += view.Content
+		}
+		if got != c.want {
+			t.Errorf("GET /messages%s = %q, want %q", c.query, got,
+				c.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleHTTPMessages(w, httptest.NewRequest("POST", "/messages", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /messages: status %d", w.Code)
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	MessagesFIFO = tsMsgQueue{}
+	MessagesFIFO.Enqueue(&Message{Id: 1, Seq: 1, Content: "a"})
+
+	done := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleHTTPStream(w, r)
+			done <- true
+		}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET /?from=0 HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// example handshake of RFC 6455, section 1.3
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") !=
+			"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake response: %+v", resp)
+	}
+
+	expect := func(want string) {
+		t.Helper()
+		var header [2]byte
+		_, err := io.ReadFull(reader, header[:])
+		if err != nil || header[0] != 0x80|wsOpText {
+			t.Fatalf("unexpected frame header %x (error %v)",
+				header, err)
+		}
+		payload := make([]byte, header[1])
+		io.ReadFull(reader, payload)
+		if !strings.Contains(string(payload), want) {
+			t.Fatalf("got %q, want it to contain %q", payload, want)
+		}
+	}
+
+	expect(`"status":"ok","result":{"from":0`)
+	expect(`"event":"message"`)
+
+	// requests are masked text frames, and only (un)subscribing is allowed
+	send := func(request string) {
+		mask := []byte{1, 2, 3, 4}
+		frame := append([]byte{0x80 | wsOpText,
+			0x80 | byte(len(request))}, mask...)
+		for i := 0; i < len(request); i++ {
+			frame = append(frame, request[i]^mask[i%4])
+		}
+		conn.Write(frame)
+	}
+	send(`{"id": 1, "cmd": "broadcast", "msg": "hi"}`)
+	expect(`{"id":1,"status":"error","error":{"code":"not_allowed"`)
+	send(`{"id": 2, "cmd": "unsubscribe"}`)
+	expect(`{"id":2,"status":"ok"`)
+
+	// the session ends (with its subscriptions) once the client leaves
+	conn.Close()
+	<-done
+}
+
+func TestHTTPStreamOrigin(t *testing.T) {
+	origins := HTTP_ORIGINS
+	defer func() { HTTP_ORIGINS = origins }()
+	HTTP_ORIGINS = "https://chat.example.com"
+
+	cases := []struct {
+		origin string
+		status int
+	}{
+		{"https://evil.example.com", http.StatusForbidden},
+		{"http://gateway:8080", http.StatusBadRequest},
+		{"https://chat.example.com", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		// allowed requests fail the (missing) WebSocket handshake
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://gateway:8080/stream",
+			nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		handleHTTPStream(w, r)
+		if w.Code != c.status {
+			t.Errorf("origin %q: status %d, want %d", c.origin,
+				w.Code, c.status)
+		}
+	}
+}
+
+func TestHTTPBroadcastContentType(t *testing.T) {
+	unsupported := http.StatusUnsupportedMediaType
+	for contentType, status := range map[string]int{
+		"":                                  unsupported,
+		"text/plain":                        unsupported,
+		"application/x-www-form-urlencoded": unsupported,
+		"application/json; charset=utf-8":   http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/broadcast",
+			strings.NewReader("{"))
+		r.Header.Set("Content-Type", contentType)
+		handleHTTPBroadcast(w, r)
+		if w.Code != status {
+			t.Errorf("Content-Type %q: status %d, want %d",
+				contentType, w.Code, status)
+		}
+	}
+}
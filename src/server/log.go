@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Formats accepted by the -log-format flag
+const (
+	LOG_FORMAT_TEXT = "text" // key=value pairs (see slog.TextHandler)
+	LOG_FORMAT_JSON = "json" // one JSON object per line
+)
+
+// Keys of the fields attached to log records
+const (
+	LOG_SERVER  = "server"  // id of this server (attached to every record)
+	LOG_PEER    = "peer"    // id of another server
+	LOG_MESSAGE = "msg_id"  // id of a message (see messageId)
+	LOG_COMMAND = "command" // name of a master command
+	LOG_ERROR   = "err"
+)
+
+var (
+	// minimum level of the records that are logged ("debug", "info", "warn"
+	// or "error"), which the "loglevel" command changes at runtime
+	LOG_LEVEL = "info"
+
+	// format of the log (one of the LOG_FORMAT_* formats)
+	LOG_FORMAT = LOG_FORMAT_TEXT
+
+	// current minimum level of the records that are logged
+	LogLevel slog.LevelVar
+
+	// logger of this server (set by setupLogger)
+	Logger = slog.New(slog.NewTextHandler(os.Stderr,
+		&slog.HandlerOptions{Level: &LogLevel}))
+)
+
+// registerLogFlags defines the flags that configure the log
+func registerLogFlags() {
+	flag.StringVar(&LOG_LEVEL, "log-level", LOG_LEVEL, "minimum level of "+
+		"logged records (debug, info, warn or error)")
+	flag.StringVar(&LOG_FORMAT, "log-format", LOG_FORMAT, "format of the "+
+		"log (text or json)")
+}
+
+// setupLogger sets LogLevel and Logger (which writes to w) according to
+// LOG_LEVEL and LOG_FORMAT, attaching the id of this server to every record
+func setupLogger(w io.Writer) error {
+	level, err := parseLogLevel(LOG_LEVEL)
+	if err != nil {
+		return err
+	}
+	LogLevel.Set(level)
+
+	options := &slog.HandlerOptions{Level: &LogLevel}
+	var handler slog.Handler
+	switch LOG_FORMAT {
+	case LOG_FORMAT_TEXT:
+		handler = slog.NewTextHandler(w, options)
+	case LOG_FORMAT_JSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return errors.New("unknown log format: " + LOG_FORMAT)
+	}
+	Logger = slog.New(handler).With(LOG_SERVER, ID)
+	return nil
+}
+
+// parseLogLevel returns the level with the given name (in any case)
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, errors.New("unknown log level: " + strconv.Quote(name))
+}
+
+// logLevelName returns the name of level as accepted by parseLogLevel
+func logLevelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// messageId returns "<sender>.<epoch>.<seq>", which identifies msg in the log
+func messageId(msg *Message) string {
+	return strconv.Itoa(msg.Id) + "." + strconv.FormatInt(msg.Epoch, 10) +
+		"." + strconv.FormatUint(msg.Seq, 10)
+}
+
+// peerFields returns the fields identifying the server with the given id (none
+// if the id is -1, i.e. unknown)
+func peerFields(id int) []interface{} {
+	if id == -1 {
+		return nil
+	}
+	return []interface{}{LOG_PEER, id}
+}
+
+// Fatal logs msg at the error level with the given key/value pairs (as in
+// slog.Logger.Error) and exits with status 1
+func Fatal(msg string, args ...interface{}) {
+	Logger.Error(msg, args...)
+	os.Exit(1)
+}
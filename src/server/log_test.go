@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// setupTestLogger makes Logger write JSON records of the given level to the
+// returned buffer
+func setupTestLogger(t *testing.T, level string) *bytes.Buffer {
+	t.Helper()
+	logger := Logger
+	LOG_LEVEL, LOG_FORMAT = level, LOG_FORMAT_JSON
+	var out bytes.Buffer
+	err := setupLogger(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Logger = logger
+		LogLevel.Set(slog.LevelInfo)
+		LOG_LEVEL, LOG_FORMAT = "info", LOG_FORMAT_TEXT
+	})
+	return &out
+}
+
+func TestStructuredLog(t *testing.T) {
+	out := setupTestLogger(t, "warn")
+
+	Logger.Info("not logged")
+	msg := &Message{Id: 2, Epoch: 7, Seq: 3}
+	reject(REJECT_FORGED, nil, LOG_PEER, msg.Id,
+		LOG_MESSAGE, messageId(msg))
+
+	var record map[string]interface{}
+	err := json.Unmarshal(out.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("invalid record %q: %v", out.String(), err)
+	}
+	want := map[string]interface{}{"level": "WARN", "server": float64(ID),
+		"peer": float64(2), "msg_id": "2.7.3", "reason": REJECT_FORGED}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v (%s)", key, record[key],
+				value, out.String())
+		}
+	}
+}
+
+func TestLogLevelCommand(t *testing.T) {
+	out := setupTestLogger(t, "info")
+
+	var replies bytes.Buffer
+	session := newMasterSession(bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader("")),
+		bufio.NewWriter(&replies)))
+	for _, line := range []string{"loglevel", "loglevel DEBUG",
+		"loglevel bogus"} {
+		session.handle(line + "\n")
+	}
+
+	want := "loglevel info\nloglevel debug\nerror invalid_argument "
+	if !strings.HasPrefix(replies.String(), want) {
+		t.Fatalf("replies %q, want %q...", replies.String(), want)
+	}
+	if LogLevel.Level() != slog.LevelDebug {
+		t.Fatalf("log level %v, want debug", LogLevel.Level())
+	}
+	if !strings.Contains(out.String(), `"command":"loglevel"`) {
+		t.Errorf("failed command not logged with its name: %s",
+			out.String())
+	}
+}
+
+func TestMasterSessionWriteError(t *testing.T) {
+	session := newMasterSession(bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader("")),
+		bufio.NewWriterSize(failingWriter{}, 16)))
+	err := session.handle("rooms\n")
+	if err == nil {
+		t.Fatal("a reply that could not be written did not end the " +
+			"session")
+	}
+}
+
+// failingWriter is an io.Writer that always fails
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, bytes.ErrTooLarge
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Versions of the master protocol, which are negotiated with the "hello"
+// command (every session starts out with MASTER_PROTOCOL_V1)
+const (
+	// one command per line, with replies in the formats listed in the
+	// package documentation (and "error <code> <message>" on failure)
+	MASTER_PROTOCOL_V1 = "v1"
+
+	// JSON lines: one masterRequest per line, each answered by exactly
+	// one masterReply
+	MASTER_PROTOCOL_V2 = "v2"
+)
+
+// Maximum duration of a write to a master, after which the master is
+// disconnected (see registerTimingFlags)
+var MASTER_WRITE_TIMEOUT = 5 * time.Second
+
+// Error codes of failed master commands (see masterError)
+const (
+	ERR_INVALID_REQUEST  = "invalid_request"
+	ERR_UNKNOWN_COMMAND  = "unknown_command"
+	ERR_INVALID_ARGUMENT = "invalid_argument"
+	ERR_NOT_JOINED       = "not_joined"
+	ERR_NOT_ALLOWED      = "not_allowed"
+)
+
+// masterRequest is a command from a master process
+//
+// In MASTER_PROTOCOL_V2 it is sent as a JSON object, e.g.
+//
+//	{"id": 7, "cmd": "broadcast", "room": "ops", "msg": "hello, world"}
+//
+// In MASTER_PROTOCOL_V1 it is parsed from a line of text (see masterCommand).
+type masterRequest struct {
+	// arbitrary JSON value that is copied into the reply, so that the
+	// master can match replies to requests
+	Id json.RawMessage `json:"id,omitempty"`
+
+	Cmd     string `json:"cmd"`
+	Room    string `json:"room,omitempty"`    // room name ("#" optional)
+	Msg     string `json:"msg,omitempty"`     // content of a broadcast
+	Phi     bool   `json:"phi,omitempty"`     // whether alive includes phi
+	Version string `json:"version,omitempty"` // protocol version of hello
+	Level   string `json:"level,omitempty"`   // log level of loglevel
+	From    *int   `json:"from,omitempty"`    // position to subscribe from
+
+	// filters of get (see msgFilter)
+	Since  *int       `json:"since,omitempty"`
+	Limit  int        `json:"limit,omitempty"`
+	Sender *int       `json:"sender,omitempty"`
+	After  *time.Time `json:"after,omitempty"`
+	Before *time.Time `json:"before,omitempty"`
+}
+
+// paged returns whether req has any filters of get
+func (req *masterRequest) paged() bool {
+	return req.Since != nil || req.Limit != 0 || req.Sender != nil ||
+		req.After != nil || req.Before != nil
+}
+
+// masterReply is the reply to a masterRequest in MASTER_PROTOCOL_V2, e.g.
+//
+//	{"id": 7, "status": "ok", "result": {"room": "ops", "seq": 3}}
+//	{"id": 8, "status": "error", "error": {"code": "unknown_command", ...}}
+type masterReply struct {
+	Id     json.RawMessage `json:"id,omitempty"`
+	Status string          `json:"status"` // "ok" or "error"
+	Result interface{}     `json:"result,omitempty"`
+	Error  *masterError    `json:"error,omitempty"`
+}
+
+// masterError is the reason a master command failed
+type masterError struct {
+	Code    string `json:"code"` // one of the ERR_* codes
+	Message string `json:"message"`
+}
+
+func (err *masterError) Error() string {
+	return err.Code + " " + err.Message
+}
+
+// newMasterError returns a masterError with the given code and a message made
+// of the remaining arguments
+func newMasterError(code string, msg ...interface{}) *masterError {
+	return &masterError{Code: code, Message: fmt.Sprint(msg...)}
+}
+
+// masterCommand is a command accepted on the master-facing port
+type masterCommand struct {
+	usage       string // syntax in MASTER_PROTOCOL_V1
+	description string
+
+	// parse sets the fields of req from the argument of the command in
+	// MASTER_PROTOCOL_V1 (the rest of the line after the command name)
+	parse func(arg string, req *masterRequest) error
+
+	// run executes the command and returns its result
+	run func(session *masterSession, req *masterRequest) (interface{},
+		error)
+
+	// text returns the reply to the command in MASTER_PROTOCOL_V1 given its
+	// result (nil if there is no reply)
+	text func(req *masterRequest, result interface{}) string
+}
+
+// masterCommands are the commands accepted on the master-facing port, keyed by
+// name (set by init, since "help" refers to it)
+var masterCommands map[string]*masterCommand
+
+func init() {
+	masterCommands = map[string]*masterCommand{
+		"get": {
+			usage: "get [#<room>] [since <pos>] [limit <n>] " +
+				"[from <id>] [after <time>] [before <time>]",
+			description: "list the messages delivered to a " +
+				"room (from position <pos> on, at most <n> " +
+				"of them, sent by server <id>, and sent in " +
+				"the given RFC 3339 time range)",
+			parse: parseGetArg,
+			run:   runGet,
+			text:  textGet,
+		},
+		"alive": {
+			usage:       "alive [phi]",
+			description: "list the servers believed to be alive",
+			parse:       parseAliveArg,
+			run:         runAlive,
+			text:        textAlive,
+		},
+		"broadcast": {
+			usage:       "broadcast [#<room>] <m>",
+			description: "send <m> to every server in a room",
+			parse:       parseBroadcastArg,
+			run:         runBroadcast,
+		},
+		"join": {
+			usage:       "join #<room>",
+			description: "join a room",
+			parse:       parseRoomArg(false),
+			run:         runJoin,
+		},
+		"leave": {
+			usage: "leave [#<room>]",
+			description: "leave a room (or the membership " +
+				"view if no room is given)",
+			parse: parseRoomArg(true),
+			run:   runLeave,
+		},
+		"rooms": {
+			usage:       "rooms",
+			description: "list the rooms this server is in",
+			parse:       parseNoArg,
+			run:         runRooms,
+			text:        textRooms,
+		},
+		"rejected": {
+			usage: "rejected",
+			description: "count the messages from other " +
+				"servers that were rejected, by reason",
+			parse: parseNoArg,
+			run:   runRejected,
+			text:  textRejected,
+		},
+		"loglevel": {
+			usage: "loglevel [debug|info|warn|error]",
+			description: "set the minimum level of logged " +
+				"records (or report it if no level is given)",
+			parse: parseLogLevelArg,
+			run:   runLogLevel,
+			text:  textLogLevel,
+		},
+		"help": {
+			usage: "help",
+			description: "list the commands and capabilities " +
+				"of the server",
+			parse: parseNoArg,
+			run:   runHelp,
+			text:  textHelp,
+		},
+		"hello": {
+			usage:       "hello v1|v2",
+			description: "switch to the given protocol version",
+			parse:       parseHelloArg,
+			run:         runHello,
+			text:        textHello,
+		},
+		"subscribe": {
+			usage: "subscribe [#<room>] [<from>]",
+			description: "push the messages of a room from " +
+				"position <from> (default: the next message) " +
+				"as they are delivered",
+			parse: parseSubscribeArg,
+			run:   runSubscribe,
+			text:  textSubscribe,
+		},
+		"unsubscribe": {
+			usage:       "unsubscribe [#<room>]",
+			description: "stop pushing the messages of a room",
+			parse:       parseRoomArg(true),
+			run:         runUnsubscribe,
+		},
+	}
+}
+
+// masterSession is the state of a connection from a master process
+//
+// Commands are executed by a single thread (see handleMaster), but replies and
+// the messages pushed to subscriptions are written by different threads, so
+// every write holds the mutex.
+type masterSession struct {
+	rwr     *bufio.ReadWriter
+	conn    net.Conn // connection under rwr (nil if it has no deadlines)
+	version string   // one of the MASTER_PROTOCOL_* versions
+
+	// commands the session may run (nil for every command)
+	allowed map[string]bool
+
+	// cancels the subscription to each room, keyed by name
+	subscriptions map[string]chan struct{}
+
+	// functions to call once the reply to the current command is written
+	// (e.g. to start pushing messages after the reply to "subscribe")
+	started []func()
+
+	done    chan struct{}  // closed when the session ends
+	streams sync.WaitGroup // threads pushing messages to subscriptions
+	mutex   sync.Mutex     // mutex for writing to rwr and accessing version
+}
+
+// newMasterSession returns a session on rwr using MASTER_PROTOCOL_V1
+func newMasterSession(rwr *bufio.ReadWriter) *masterSession {
+	return &masterSession{
+		rwr:           rwr,
+		version:       MASTER_PROTOCOL_V1,
+		subscriptions: make(map[string]chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// Close ends the session, stopping every subscription, and waits until
+// nothing more is pushed to it
+//
+// NOTE: a push blocks until the connection drains (or MASTER_WRITE_TIMEOUT
+// passes), so the connection should be closed first
+func (session *masterSession) Close() {
+	close(session.done)
+	session.streams.Wait()
+}
+
+// handle executes the command on the given line and writes its reply in the
+// protocol version of the session
+//
+// Returns an error if the reply could not be written (i.e. the session is
+// over), NOT if the command failed
+func (session *masterSession) handle(line string) error {
+	session.mutex.Lock()
+	version := session.version
+	session.mutex.Unlock()
+
+	var req *masterRequest
+	var err error
+	if version == MASTER_PROTOCOL_V2 {
+		req, err = parseJSONRequest(line)
+	} else {
+		req, err = parseTextRequest(line)
+	}
+
+	if err == nil && session.allowed != nil && !session.allowed[req.Cmd] {
+		err = newMasterError(ERR_NOT_ALLOWED, "command not allowed in ",
+			"this session: ", strconv.Quote(req.Cmd))
+	}
+
+	var result interface{}
+	if err == nil {
+		Logger.Debug("running master command", LOG_COMMAND, req.Cmd)
+		result, err = masterCommands[req.Cmd].run(session, req)
+	}
+	if err != nil {
+		if req == nil {
+			req = new(masterRequest)
+		}
+		Logger.Warn("master command failed", LOG_COMMAND, req.Cmd,
+			"line", strings.TrimSpace(line), LOG_ERROR, err)
+	}
+	err = session.reply(req, result, err)
+	if err != nil {
+		return err
+	}
+
+	for _, start := range session.started {
+		start()
+	}
+	session.started = nil
+	return nil
+}
+
+// reply writes the reply to req (with the given result, or err if it failed)
+//
+// NOTE: the reply is written in the protocol version of the session after the
+// command ran, so "hello" is answered in the version it switched to
+func (session *masterSession) reply(req *masterRequest, result interface{},
+	err error) error {
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.setWriteDeadline()
+	if session.version == MASTER_PROTOCOL_V2 {
+		reply := masterReply{Id: req.Id, Status: "ok", Result: result}
+		if err != nil {
+			reply = masterReply{Id: req.Id, Status: "error",
+				Error: toMasterError(err)}
+		}
+		encoder := json.NewEncoder(session.rwr)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(reply)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err != nil {
+			session.rwr.WriteString("error " +
+				toMasterError(err).Error() + "\n")
+		} else if cmd := masterCommands[req.Cmd]; cmd.text != nil {
+			session.rwr.WriteString(cmd.text(req, result) + "\n")
+		} else {
+			return nil
+		}
+	}
+	return session.rwr.Flush()
+}
+
+// setWriteDeadline bounds the writes that follow to MASTER_WRITE_TIMEOUT, so
+// that a master that stops reading cannot block the session forever
+//
+// Assumes session.mutex is held
+func (session *masterSession) setWriteDeadline() {
+	if session.conn != nil {
+		session.conn.SetWriteDeadline(
+			Clock.Now().Add(MASTER_WRITE_TIMEOUT))
+	}
+}
+
+// toMasterError returns err as a masterError
+func toMasterError(err error) *masterError {
+	if merr, isMasterError := err.(*masterError); isMasterError {
+		return merr
+	}
+	return newMasterError(ERR_INVALID_ARGUMENT, err)
+}
+
+// parseJSONRequest decodes a request in MASTER_PROTOCOL_V2
+func parseJSONRequest(line string) (*masterRequest, error) {
+	req := new(masterRequest)
+	err := json.Unmarshal([]byte(line), req)
+	if err != nil {
+		return nil, newMasterError(ERR_INVALID_REQUEST, err)
+	}
+	if _, isPresent := masterCommands[req.Cmd]; !isPresent {
+		return req, newMasterError(ERR_UNKNOWN_COMMAND,
+			"unknown command: ", strconv.Quote(req.Cmd))
+	}
+	return req, req.checkRoom()
+}
+
+// checkRoom strips the optional ROOM_PREFIX from req.Room and validates the
+// name of the room
+func (req *masterRequest) checkRoom() error {
+	req.Room = strings.TrimPrefix(req.Room, ROOM_PREFIX)
+	if req.Room != "" && !roomName.MatchString(req.Room) {
+		return newMasterError(ERR_INVALID_ARGUMENT,
+			"invalid room name: ", strconv.Quote(req.Room))
+	}
+	return nil
+}
+
+// parseTextRequest parses a request in MASTER_PROTOCOL_V1
+func parseTextRequest(line string) (*masterRequest, error) {
+	line = strings.TrimSpace(line)
+	name, arg, _ := strings.Cut(line, " ")
+	cmd, isPresent := masterCommands[name]
+	if !isPresent {
+		return nil, newMasterError(ERR_UNKNOWN_COMMAND,
+			"unknown command: ", strconv.Quote(line))
+	}
+
+	req := &masterRequest{Cmd: name}
+	err := cmd.parse(arg, req)
+	if err != nil {
+		return req, newMasterError(ERR_INVALID_ARGUMENT, "usage: ",
+			cmd.usage, " (", err, ")")
+	}
+	return req, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// parsers (MASTER_PROTOCOL_V1)                                              //
+///////////////////////////////////////////////////////////////////////////////
+
+func parseNoArg(arg string, req *masterRequest) error {
+	if arg != "" {
+		return newMasterError(ERR_INVALID_ARGUMENT,
+			"unexpected argument")
+	}
+	return nil
+}
+
+// parseRoomArg returns a parser of a single room name (which may be omitted if
+// optional is true)
+func parseRoomArg(optional bool) func(string, *masterRequest) error {
+	return func(arg string, req *masterRequest) error {
+		if arg == "" && optional {
+			return nil
+		}
+		room, isRoom := parseRoom(arg)
+		if !isRoom {
+			return newMasterError(ERR_INVALID_ARGUMENT,
+				"invalid room name: ", strconv.Quote(arg))
+		}
+		req.Room = room
+		return nil
+	}
+}
+
+// parseGetArg parses "[#<room>] [since <pos>] [limit <n>] [from <id>]
+// [after <time>] [before <time>]" (with the filters in any order)
+func parseGetArg(arg string, req *masterRequest) error {
+	fields := strings.Fields(arg)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], ROOM_PREFIX) {
+		err := parseRoomArg(false)(fields[0], req)
+		if err != nil {
+			return err
+		}
+		fields = fields[1:]
+	}
+	if len(fields)%2 != 0 {
+		return newMasterError(ERR_INVALID_ARGUMENT,
+			"missing value of ",
+			strconv.Quote(fields[len(fields)-1]))
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		name, value := fields[i], fields[i+1]
+		var err error
+		switch name {
+		case "since", "limit", "from":
+			var n int
+			n, err = strconv.Atoi(value)
+			if err == nil && n < 0 {
+				err = strconv.ErrRange
+			}
+			switch name {
+			case "since":
+				req.Since = &n
+			case "limit":
+				req.Limit = n
+			case "from":
+				req.Sender = &n
+			}
+		case "after", "before":
+			var t time.Time
+			t, err = time.Parse(time.RFC3339Nano, value)
+			if name == "after" {
+				req.After = &t
+			} else {
+				req.Before = &t
+			}
+		default:
+			return newMasterError(ERR_INVALID_ARGUMENT,
+				"unknown filter: ", strconv.Quote(name))
+		}
+		if err != nil {
+			return newMasterError(ERR_INVALID_ARGUMENT, "invalid ",
+				name, ": ", strconv.Quote(value))
+		}
+	}
+	return nil
+}
+
+func parseAliveArg(arg string, req *masterRequest) error {
+	switch arg {
+	case "":
+	case "phi":
+		req.Phi = true
+	default:
+		return newMasterError(ERR_INVALID_ARGUMENT,
+			"unexpected argument")
+	}
+	return nil
+}
+
+// parseBroadcastArg parses "[#<room>] <m>"
+//
+// NOTE: a broadcast to the default room cannot start with a room name (e.g.
+// "broadcast #ops is down" goes to the room "ops"), which MASTER_PROTOCOL_V2
+// does not have a problem with
+func parseBroadcastArg(arg string, req *masterRequest) error {
+	roomArg, content, _ := strings.Cut(arg, " ")
+	if room, isRoom := parseRoom(roomArg); isRoom {
+		req.Room = room
+		arg = content
+	}
+	if arg == "" {
+		return newMasterError(ERR_INVALID_ARGUMENT, "empty message")
+	}
+	req.Msg = arg
+	return nil
+}
+
+func parseHelloArg(arg string, req *masterRequest) error {
+	req.Version = arg
+	return nil
+}
+
+func parseLogLevelArg(arg string, req *masterRequest) error {
+	req.Level = arg
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// commands                                                                  //
+///////////////////////////////////////////////////////////////////////////////
+
+// messageView is a message as listed by "get" (or pushed to subscribers) in
+// MASTER_PROTOCOL_V2
+type messageView struct {
+	Pos     int       `json:"pos"` // position in the log of the room
+	Sender  int       `json:"sender"`
+	Room    string    `json:"room,omitempty"`
+	Content string    `json:"msg"`
+	Rts     time.Time `json:"rts"` // send time according to the sender
+	Epoch   int64     `json:"epoch"`
+	Seq     uint64    `json:"seq"`
+	Lts     string    `json:"lts,omitempty"`
+}
+
+// getResult is the result of "get"
+type getResult struct {
+	Messages []messageView `json:"messages"`
+	Next     int           `json:"next"` // "since" of the next page
+	More     bool          `json:"more"` // whether the log continues
+}
+
+func runGet(session *masterSession, req *masterRequest) (interface{}, error) {
+	if req.Limit < 0 {
+		return nil, newMasterError(ERR_INVALID_ARGUMENT,
+			"invalid limit: ", req.Limit)
+	}
+	msgLog := Rooms.Log(req.Room)
+	if msgLog == nil {
+		return &getResult{Messages: []messageView{}}, nil
+	}
+
+	filter := msgFilter{limit: req.Limit, sender: req.Sender}
+	if req.Since != nil {
+		filter.since = *req.Since
+	}
+	if req.After != nil {
+		filter.after = *req.After
+	}
+	if req.Before != nil {
+		filter.before = *req.Before
+	}
+
+	entries, next, more := msgLog.Query(filter)
+	views := make([]messageView, len(entries))
+	for i, entry := range entries {
+		views[i] = newMessageView(entry.msg, entry.pos)
+	}
+	return &getResult{views, next, more}, nil
+}
+
+// newMessageView returns the view of msg at the given position in its log
+func newMessageView(msg *Message, pos int) messageView {
+	return messageView{
+		Pos:     pos,
+		Sender:  msg.Id,
+		Room:    msg.Room,
+		Content: msg.Content,
+		Rts:     msg.Rts,
+		Epoch:   msg.Epoch,
+		Seq:     msg.Seq,
+		Lts:     msg.Lts,
+	}
+}
+
+// textGet returns "messages <msg1>,<msg2>,..." or, if any filters were given,
+// "page <next> <msg1>,<msg2>,..." (where <next> is the position to continue
+// from)
+func textGet(req *masterRequest, result interface{}) string {
+	page := result.(*getResult)
+	contents := make([]string, len(page.Messages))
+	for i, view := range page.Messages {
+		contents[i] = view.Content
+	}
+	if req.paged() {
+		return "page " + strconv.Itoa(page.Next) + " " +
+			strings.Join(contents, ",")
+	}
+	return "messages " + strings.Join(contents, ",")
+}
+
+func runAlive(session *masterSession, req *masterRequest) (interface{}, error) {
+	return map[string][]aliveServer{
+		"alive": LastTimestamp.AliveServers(Clock.Now()),
+	}, nil
+}
+
+func textAlive(req *masterRequest, result interface{}) string {
+	servers := result.(map[string][]aliveServer)["alive"]
+	entries := make([]string, len(servers))
+	for i, server := range servers {
+		entries[i] = strconv.Itoa(server.Id)
+		if req.Phi {
+			entries[i] += ":" +
+				strconv.FormatFloat(server.Phi, 'f', 2, 64)
+		}
+	}
+	return "alive " + strings.Join(entries, ",")
+}
+
+func runBroadcast(session *masterSession,
+	req *masterRequest) (interface{}, error) {
+
+	if req.Msg == "" {
+		return nil, newMasterError(ERR_INVALID_ARGUMENT,
+			"empty message")
+	}
+	if len(req.Msg) > MAX_CONTENT_SIZE {
+		return nil, newMasterError(ERR_INVALID_ARGUMENT, "message ",
+			"exceeds ", MAX_CONTENT_SIZE, " bytes")
+	}
+	if Rooms.Log(req.Room) == nil {
+		return nil, newMasterError(ERR_NOT_JOINED, "not in room ",
+			req.Room)
+	}
+
+	msg := newMessage(req.Msg)
+	msg.Room = req.Room
+	broadcast(msg)
+	return map[string]interface{}{"room": msg.Room, "seq": msg.Seq}, nil
+}
+
+func runJoin(session *masterSession, req *masterRequest) (interface{}, error) {
+	if req.Room == "" {
+		return nil, newMasterError(ERR_INVALID_ARGUMENT, "missing room")
+	}
+	joined, err := Rooms.Join(req.Room)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]bool{"changed": joined}, nil
+}
+
+func runLeave(session *masterSession, req *masterRequest) (interface{}, error) {
+	if req.Room == "" {
+		leaveCluster()
+		return nil, nil
+	}
+	return map[string]bool{"changed": Rooms.Leave(req.Room)}, nil
+}
+
+func runRooms(session *masterSession, req *masterRequest) (interface{}, error) {
+	names := Rooms.Names()
+	if names == nil {
+		names = []string{}
+	}
+	return map[string][]string{"rooms": names}, nil
+}
+
+func textRooms(req *masterRequest, result interface{}) string {
+	names := result.(map[string][]string)["rooms"]
+	rooms := make([]string, len(names))
+	for i, name := range names {
+		rooms[i] = ROOM_PREFIX + name
+	}
+	return "rooms " + strings.Join(rooms, ",")
+}
+
+func runRejected(session *masterSession,
+	req *masterRequest) (interface{}, error) {
+
+	return map[string]map[string]uint64{"rejected": Rejected.Counts()}, nil
+}
+
+// textRejected returns "rejected <reason1>:<n1>,<reason2>:<n2>,..." (in
+// increasing order of reason)
+func textRejected(req *masterRequest, result interface{}) string {
+	counts := result.(map[string]map[string]uint64)["rejected"]
+	entries := make([]string, 0, len(counts))
+	for reason, count := range counts {
+		entries = append(entries,
+			reason+":"+strconv.FormatUint(count, 10))
+	}
+	sort.Strings(entries)
+	return "rejected " + strings.Join(entries, ",")
+}
+
+// runLogLevel sets LogLevel to req.Level (unless it is empty) and returns the
+// current level
+//
+// NOTE: the level is shared by every master, so it stays changed after the
+// session ends
+func runLogLevel(session *masterSession,
+	req *masterRequest) (interface{}, error) {
+
+	if req.Level != "" {
+		level, err := parseLogLevel(req.Level)
+		if err != nil {
+			return nil, newMasterError(ERR_INVALID_ARGUMENT, err)
+		}
+		LogLevel.Set(level)
+		Logger.Info("changed log level", "log_level",
+			logLevelName(level))
+	}
+	return map[string]string{"level": logLevelName(LogLevel.Level())}, nil
+}
+
+func textLogLevel(req *masterRequest, result interface{}) string {
+	return "loglevel " + result.(map[string]string)["level"]
+}
+
+// commandView is a command as listed by "help" in MASTER_PROTOCOL_V2
+type commandView struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+}
+
+func runHelp(session *masterSession, req *masterRequest) (interface{}, error) {
+	names := make([]string, 0, len(masterCommands))
+	for name := range masterCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	commands := make([]commandView, len(names))
+	for i, name := range names {
+		cmd := masterCommands[name]
+		commands[i] = commandView{name, cmd.usage, cmd.description}
+	}
+	return map[string]interface{}{
+		"versions": []string{MASTER_PROTOCOL_V1, MASTER_PROTOCOL_V2},
+		"commands": commands,
+		"order":    ORDER,
+		"detector": DETECTOR,
+		"id":       ID,
+	}, nil
+}
+
+func textHelp(req *masterRequest, result interface{}) string {
+	commands := result.(map[string]interface{})["commands"].([]commandView)
+	usages := make([]string, len(commands))
+	for i, cmd := range commands {
+		usages[i] = cmd.Usage
+	}
+	return "help " + strings.Join(usages, ",")
+}
+
+func runHello(session *masterSession, req *masterRequest) (interface{}, error) {
+	switch req.Version {
+	case MASTER_PROTOCOL_V1, MASTER_PROTOCOL_V2:
+	default:
+		return nil, newMasterError(ERR_INVALID_ARGUMENT,
+			"unsupported protocol version: ",
+			strconv.Quote(req.Version))
+	}
+	session.mutex.Lock()
+	session.version = req.Version
+	session.mutex.Unlock()
+	return map[string]string{"version": req.Version}, nil
+}
+
+func textHello(req *masterRequest, result interface{}) string {
+	return "hello " + req.Version
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTextRequest(t *testing.T) {
+	cases := []struct {
+		line string
+		want masterRequest
+	}{
+		{"get\n", masterRequest{Cmd: "get"}},
+		{"get #ops", masterRequest{Cmd: "get", Room: "ops"}},
+		{"alive phi", masterRequest{Cmd: "alive", Phi: true}},
+		{"broadcast a, b", masterRequest{Cmd: "broadcast",
+			Msg: "a, b"}},
+		{"broadcast #ops a b", masterRequest{Cmd: "broadcast",
+			Room: "ops", Msg: "a b"}},
+		{"leave", masterRequest{Cmd: "leave"}},
+	}
+	for _, c := range cases {
+		req, err := parseTextRequest(c.line)
+		if err != nil {
+			t.Errorf("parseTextRequest(%q): %v", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(*req, c.want) {
+			t.Errorf("parseTextRequest(%q) = %+v, want %+v", c.line,
+				*req, c.want)
+		}
+	}
+
+	for _, line := range []string{"bogus", "alive now", "join ops",
+		"broadcast", "broadcast #ops", "rooms #ops"} {
+		_, err := parseTextRequest(line)
+		if err == nil {
+			t.Errorf("parseTextRequest(%q) should fail", line)
+		}
+	}
+}
+
+func TestMasterSessionV2(t *testing.T) {
+	var out bytes.Buffer
+	session := newMasterSession(bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader("")), bufio.NewWriter(&out)))
+
+	session.handle("hello v2\n")
+	session.handle(`{"id": "a", "cmd": "rooms"}` + "\n")
+	session.handle(`{"id": 2, "cmd": "nope"}` + "\n")
+
+	var replies []masterReply
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for _, line := range lines {
+		var reply masterReply
+		err := json.Unmarshal([]byte(line), &reply)
+		if err != nil {
+			t.Fatalf("invalid reply %q: %v", line, err)
+		}
+		replies = append(replies, reply)
+	}
+
+	if len(replies) != 3 {
+		t.Fatalf("got %d replies, want 3", len(replies))
+	}
+	if replies[0].Status != "ok" {
+		t.Errorf("hello failed: %+v", replies[0])
+	}
+	if string(replies[1].Id) != `"a"` || replies[1].Status != "ok" {
+		t.Errorf("unexpected reply to rooms: %+v", replies[1])
+	}
+	if string(replies[2].Id) != "2" || replies[2].Status != "error" ||
+		replies[2].Error.Code != ERR_UNKNOWN_COMMAND {
+		t.Errorf("unexpected reply to unknown command: %+v", replies[2])
+	}
+}
+
+func TestHandleMasterConcurrentClients(t *testing.T) {
+	done := make(chan bool)
+	var conns []net.Conn
+	var clients []*bufio.ReadWriter
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		conns = append(conns, client)
+		go func() {
+			handleMaster(server)
+			done <- true
+		}()
+		clients = append(clients, bufio.NewReadWriter(
+			bufio.NewReader(client), bufio.NewWriter(client)))
+		defer client.Close()
+	}
+
+	// both clients are served at the same time
+	for _, client := range clients {
+		client.WriteString("rooms\n")
+		client.Flush()
+	}
+	for i, client := range clients {
+		reply, err := client.ReadString('\n')
+		if err != nil || reply != "rooms \n" {
+			t.Fatalf("client %d: reply %q, error %v", i, reply, err)
+		}
+	}
+
+	// a client that disconnects only ends its own session
+	conns[0].Close()
+	<-done
+
+	clients[1].WriteString("rooms\n")
+	clients[1].Flush()
+	reply, err := clients[1].ReadString('\n')
+	if err != nil || reply != "rooms \n" {
+		t.Fatalf("reply %q, error %v after other client left", reply,
+			err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types of the control messages used to maintain the membership view
+const (
+	// request from a new server to be added to the view (the Addr field
+	// holds the address of its server-facing port)
+	MSG_JOIN = "join"
+
+	// the sender's current view (the View field), which the recipient
+	// merges into its own
+	MSG_VIEW = "view"
+
+	// announcement that the sender is shutting down, after which the
+	// recipient no longer considers it alive (see announceLeave)
+	MSG_LEAVE = "leave"
+)
+
+// member is the state of a single server in a membership view
+//
+// Every change to a member increments its Version, and servers that left are
+// kept (with Left set) so that the removal is not undone by a server with an
+// older view.
+type member struct {
+	Addr    string   `json:"addr"` // "" if at localhost:START_PORT+id
+	Version uint64   `json:"version"`
+	Left    bool     `json:"left,omitempty"`
+	Rooms   []string `json:"rooms,omitempty"` // rooms joined (see tsRooms)
+}
+
+// view is the set of servers in the system, keyed by id
+//
+// Views are merged member by member, keeping the state with the larger
+// Version, so servers converge on the same view no matter the order in which
+// they learn about changes.
+type view map[int]member
+
+// tsMembership is the membership view of this server
+//
+// Servers gossip a digest of their view with every heartbeat. A server that
+// receives a digest that differs from its own, from a server whose view is not
+// newer, replies with its whole view (see MSG_VIEW).
+type tsMembership struct {
+	value view
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// Init sets the view to the servers {0, ..., n-1} (with addresses from
+// MEMBERS), or to just this server if n is 0
+func (tsm *tsMembership) Init(n int) {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	tsm.value = make(view)
+	for id := 0; id < n; id++ {
+		tsm.value[id] = member{Addr: MEMBERS[id], Version: 1}
+	}
+	if n == 0 {
+		tsm.value[ID] = member{Addr: ADVERTISE_ADDR, Version: 1}
+	}
+}
+
+// Ids returns the ids of the servers in the view (in increasing order)
+func (tsm *tsMembership) Ids() []int {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	var ids []int
+	for id, m := range tsm.value {
+		if !m.Left {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Peers returns the ids of the other servers in the view (in increasing order)
+//
+// Returns an empty slice if this server is not in the view (e.g. it left)
+func (tsm *tsMembership) Peers() []int {
+	if !tsm.Contains(ID) {
+		return nil
+	}
+
+	var peers []int
+	for _, id := range tsm.Ids() {
+		if id != ID {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// Contains returns whether the server with the given id is in the view
+func (tsm *tsMembership) Contains(id int) bool {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	m, isPresent := tsm.value[id]
+	return isPresent && !m.Left
+}
+
+// Addr returns the address of the server with the given id, if it is known
+func (tsm *tsMembership) Addr(id int) (string, bool) {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	m, isPresent := tsm.value[id]
+	if !isPresent || m.Addr == "" {
+		return "", false
+	}
+	return m.Addr, true
+}
+
+// Add adds the server with the given id and address to the view (or updates
+// its address) and returns whether the view changed
+func (tsm *tsMembership) Add(id int, addr string) bool {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	m, isPresent := tsm.value[id]
+	if isPresent && !m.Left && m.Addr == addr {
+		return false
+	}
+	tsm.value[id] = member{Addr: addr, Version: m.Version + 1,
+		Rooms: m.Rooms}
+	return true
+}
+
+// SetRooms sets the rooms of this server to the given (sorted) room names
+func (tsm *tsMembership) SetRooms(rooms []string) {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	m := tsm.value[ID]
+	m.Rooms = rooms
+	m.Version++
+	tsm.value[ID] = m
+}
+
+// Subscribers returns the ids of the other servers in the view that joined the
+// given room (in increasing order), or Peers() for the default room
+func (tsm *tsMembership) Subscribers(room string) []int {
+	peers := tsm.Peers()
+	if room == "" {
+		return peers
+	}
+
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	var subscribers []int
+	for _, id := range peers {
+		rooms := tsm.value[id].Rooms
+		i := sort.SearchStrings(rooms, room)
+		if i < len(rooms) && rooms[i] == room {
+			subscribers = append(subscribers, id)
+		}
+	}
+	return subscribers
+}
+
+// Remove marks the server with the given id as having left the view and
+// returns whether the view changed
+func (tsm *tsMembership) Remove(id int) bool {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	m, isPresent := tsm.value[id]
+	if !isPresent || m.Left {
+		return false
+	}
+	m.Left = true
+	m.Version++
+	tsm.value[id] = m
+	return true
+}
+
+// Merge merges other into the view (keeping the newer state of each member)
+// and returns whether the view changed
+//
+// This server's own state always wins, since other servers may have a newer
+// but stale state for it (e.g. that it left, from before it restarted). Its
+// version is raised above theirs so that the others adopt it. The exception is
+// a server that is shutting down, which accepts that it left.
+func (tsm *tsMembership) Merge(other view) bool {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	changed := false
+	for id, m := range other {
+		current := tsm.value[id]
+		if m.Version <= current.Version {
+			continue
+		}
+		if id == ID && !(m.Left && stopping()) {
+			current.Version = m.Version + 1
+			m = current
+		}
+		tsm.value[id] = m
+		changed = true
+	}
+	return changed
+}
+
+// View returns a copy of the view
+func (tsm *tsMembership) View() view {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	v := make(view, len(tsm.value))
+	for id, m := range tsm.value {
+		v[id] = m
+	}
+	return v
+}
+
+// Digest returns the version of the view (the sum of the versions of its
+// members, which only increases) and a hash of its contents
+func (tsm *tsMembership) Digest() (uint64, uint64) {
+	tsm.mutex.Lock()
+	defer tsm.mutex.Unlock()
+
+	ids := make([]int, 0, len(tsm.value))
+	for id := range tsm.value {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var version uint64
+	hash := fnv.New64a()
+	for _, id := range ids {
+		m := tsm.value[id]
+		version += m.Version
+		hash.Write([]byte(strconv.Itoa(id) + "|" + m.Addr + "|" +
+			strconv.FormatUint(m.Version, 10) + "|" +
+			strconv.FormatBool(m.Left) + "|" +
+			strings.Join(m.Rooms, ",") + ";"))
+	}
+	return version, hash.Sum64()
+}
+
+// handleViewDigest replies with the view of this server if the digest
+// gossiped in msg differs from that of this server and the sender's view is
+// not newer (otherwise the sender replies to this server's next heartbeat)
+func handleViewDigest(msg *Message) {
+	if msg.ViewHash == 0 {
+		return
+	}
+	version, hash := Membership.Digest()
+	if hash != msg.ViewHash && msg.ViewVersion <= version {
+		sendView(msg.Id)
+	}
+}
+
+// sendView sends the view of this server to the server with the given id
+func sendView(id int) {
+	msg := emptyMessage()
+	msg.Type = MSG_VIEW
+	msg.View = Membership.View()
+	msgBytes, err := encodeMessage(msg)
+	if err != nil {
+		Logger.Error("failed to encode view", LOG_PEER, id, LOG_ERROR,
+			err)
+		return
+	}
+	send(msgBytes, id)
+}
+
+// handleView merges the view in a MSG_VIEW into the view of this server, and
+// stops the connections to servers that left
+func handleView(msg *Message) {
+	if Membership.Merge(msg.View) {
+		Peers.Retain(Membership.Ids())
+	}
+}
+
+// handleJoin adds the sender of a MSG_JOIN to the view and sends it the new
+// view (the other servers learn about it through gossip)
+func handleJoin(msg *Message) {
+	if ORDER == ORDER_CAUSAL && msg.Id >= NUM_PROCS {
+		Logger.Warn("rejecting join (no room in vector clocks)",
+			LOG_PEER, msg.Id, "length", NUM_PROCS)
+		return
+	}
+	if msg.Id < 0 {
+		Logger.Warn("rejecting join of server with invalid id",
+			LOG_PEER, msg.Id)
+		return
+	}
+	if Membership.Add(msg.Id, msg.Addr) {
+		Logger.Info("server joined", LOG_PEER, msg.Id, "addr", msg.Addr)
+	}
+	sendView(msg.Id)
+}
+
+// joinCluster asks the server at JOIN_ADDR to add this server to the view,
+// retrying every HEARTBEAT_INTERVAL until this server has learned about at
+// least one other server
+//
+// If ADVERTISE_ADDR is empty, the address other servers use to reach this
+// server is the local address of the connection to JOIN_ADDR (with PORT).
+func joinCluster() {
+	for len(Membership.Peers()) == 0 {
+		err := requestJoin()
+		if err != nil {
+			Logger.Warn("failed to join", "addr", JOIN_ADDR,
+				LOG_ERROR, err)
+		}
+		sleep(HEARTBEAT_INTERVAL)
+	}
+}
+
+// requestJoin sends a MSG_JOIN to the server at JOIN_ADDR over a new
+// connection
+func requestJoin() error {
+	conn, err := dialPeer(JOIN_ADDR, -1)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	addr := ADVERTISE_ADDR
+	if addr == "" {
+		host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+		if err != nil {
+			return err
+		}
+		addr = net.JoinHostPort(host, strconv.Itoa(PORT))
+		Membership.Add(ID, addr)
+	}
+
+	msg := emptyMessage()
+	msg.Type = MSG_JOIN
+	msg.Addr = addr
+	msgBytes, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(Clock.Now().Add(WRITE_TIMEOUT))
+	_, err = conn.Write(append(msgBytes, '\n'))
+	return err
+}
+
+// leaveCluster removes this server from the view and sends the new view to
+// every other server
+//
+// Afterwards this server no longer sends heartbeats or broadcasts to other
+// servers (see tsMembership.Peers). It can rejoin by restarting with -join.
+func leaveCluster() {
+	peers := Membership.Peers()
+	if !Membership.Remove(ID) {
+		return
+	}
+	for _, id := range peers {
+		sendView(id)
+	}
+}
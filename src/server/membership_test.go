@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMembershipMerge(t *testing.T) {
+	ID = 0
+	var tsm tsMembership
+	tsm.Init(3)
+
+	// newer states are adopted and older ones are ignored, whichever order
+	// they arrive in
+	if !tsm.Merge(view{1: {Addr: "b:1", Version: 3}}) {
+		t.Fatal("a newer state did not change the view")
+	}
+	if tsm.Merge(view{1: {Addr: "a:1", Version: 2}}) {
+		t.Fatal("an older state changed the view")
+	}
+	if !tsm.Merge(view{2: {Version: 2, Left: true},
+		3: {Addr: "d:1", Version: 1}}) {
+		t.Fatal("a leave and a join did not change the view")
+	}
+	if addr, _ := tsm.Addr(1); addr != "b:1" {
+		t.Errorf("server 1 is at %q, want b:1", addr)
+	}
+	if got := tsm.Ids(); !reflect.DeepEqual(got, []int{0, 1, 3}) {
+		t.Errorf("ids %v, want [0 1 3]", got)
+	}
+
+	// a server that left stays in the view, so an older view does not
+	// bring it back
+	if tsm.Merge(view{2: {Version: 1}}) || tsm.Contains(2) {
+		t.Error("an older view undid a leave")
+	}
+}
+
+func TestMembershipMergeRestarted(t *testing.T) {
+	ID = 0
+	var tsm tsMembership
+	tsm.Init(2)
+
+	// the others remember that this server left before it restarted, but
+	// it does not adopt that
+	if !tsm.Merge(view{0: {Version: 4, Left: true}}) {
+		t.Fatal("the view did not change")
+	}
+	self := tsm.View()[0]
+	if self.Left || self.Version != 5 || !tsm.Contains(0) {
+		t.Fatalf("a stale leave of this server was adopted: %+v", self)
+	}
+	if got := tsm.Peers(); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("peers %v, want [1]", got)
+	}
+
+	// unless it is shutting down
+	stopping := Stopping
+	defer func() { Stopping = stopping }()
+	Stopping = make(chan struct{})
+	close(Stopping)
+	tsm.Merge(view{0: {Version: 6, Left: true}})
+	if tsm.Contains(0) || tsm.Peers() != nil {
+		t.Fatal("a server that is shutting down did not leave")
+	}
+}
+
+func TestMembershipAddRemove(t *testing.T) {
+	ID = 0
+	var tsm tsMembership
+	tsm.Init(1)
+
+	if !tsm.Add(1, "b:1") || tsm.Add(1, "b:1") {
+		t.Fatal("only the first join should change the view")
+	}
+	if !tsm.Remove(1) || tsm.Remove(1) || tsm.Contains(1) {
+		t.Fatal("only the first leave should change the view")
+	}
+
+	// a server that left can rejoin
+	if !tsm.Add(1, "b:2") || !tsm.Contains(1) {
+		t.Fatal("server 1 did not rejoin")
+	}
+	if m := tsm.View()[1]; m.Version != 3 || m.Addr != "b:2" {
+		t.Fatalf("server 1 rejoined as %+v", m)
+	}
+}
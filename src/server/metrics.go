@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upper bounds (in seconds) of the buckets of DialLatency
+var DIAL_LATENCY_BUCKETS = []float64{.0005, .001, .0025, .005, .01, .025,
+	.05, .1, .25, .5, 1}
+
+var (
+	// address ("host:port") of the metrics endpoint (see serveMetrics),
+	// which is disabled if empty
+	METRICS_ADDR = ""
+
+	// number of non-empty messages broadcast by this server, keyed by room
+	Broadcasts tsCounters
+
+	// number of messages delivered to the log of each room, keyed by room
+	Deliveries tsCounters
+
+	// number of heartbeats (i.e. empty messages), keyed by direction
+	// ("sent" or "received")
+	Heartbeats tsCounters
+
+	// number of messages to each server that were discarded (or whose
+	// connection failed), keyed by id
+	SendFailures tsCounters
+
+	// duration of the attempts to connect to each server, keyed by id
+	DialLatency = tsHistograms{bounds: DIAL_LATENCY_BUCKETS}
+
+	// every metric exposed on the metrics endpoint (set by init)
+	Metrics []*metric
+)
+
+// metric is a set of time series exposed on the metrics endpoint in the
+// Prometheus text format, e.g.
+//
+//	# HELP chatroom_deliveries_total Messages delivered to a room.
+//	# TYPE chatroom_deliveries_total counter
+//	chatroom_deliveries_total{room=""} 12
+//	chatroom_deliveries_total{room="ops"} 3
+type metric struct {
+	name string
+	help string
+	kind string // "counter", "gauge" or "histogram"
+
+	// name of the label that tells the series of the metric apart ("" if
+	// there is only one series)
+	label string
+
+	// collect returns the value of each series, keyed by the value of label
+	// (nil for histograms)
+	collect func() map[string]float64
+
+	// the series of a histogram
+	histograms *tsHistograms
+}
+
+func init() {
+	Metrics = []*metric{
+		counterMetric("chatroom_broadcasts_total",
+			"Messages broadcast by this server to a room.", "room",
+			&Broadcasts),
+		counterMetric("chatroom_deliveries_total",
+			"Messages delivered to a room.", "room",
+			&Deliveries),
+		counterMetric("chatroom_heartbeats_total",
+			"Heartbeats sent to or received from other servers.",
+			"direction", &Heartbeats),
+		counterMetric("chatroom_send_failures_total",
+			"Messages to a server that were discarded.", "peer",
+			&SendFailures),
+		counterMetric("chatroom_rejected_messages_total",
+			"Messages from other servers that were rejected.",
+			"reason", &Rejected),
+		{
+			name: "chatroom_throttled_frames_total",
+			help: "Frames from other servers delayed by the rate " +
+				"limit.",
+			kind: "counter",
+			collect: func() map[string]float64 {
+				return map[string]float64{
+					"": float64(PeerLimiter.Delayed())}
+			},
+		},
+		{
+			name: "chatroom_dial_duration_seconds",
+			help: "Duration of attempts to connect to a server.",
+			kind: "histogram", label: "peer",
+			histograms: &DialLatency,
+		},
+		{
+			name: "chatroom_queue_length",
+			help: "Messages of a room kept in memory.",
+			kind: "gauge", label: "room",
+			collect: collectQueueLengths,
+		},
+		{
+			name: "chatroom_alive_servers",
+			help: "Servers believed to be alive (including " +
+				"this one).",
+			kind: "gauge",
+			collect: func() map[string]float64 {
+				alive := LastTimestamp.AliveServers(Clock.Now())
+				n := float64(len(alive))
+				return map[string]float64{"": n}
+			},
+		},
+	}
+}
+
+// counterMetric returns a counter metric whose series are the given counters
+func counterMetric(name string, help string, label string,
+	counters *tsCounters) *metric {
+
+	return &metric{name: name, help: help, kind: "counter", label: label,
+		collect: func() map[string]float64 {
+			values := make(map[string]float64)
+			for key, count := range counters.Counts() {
+				values[key] = float64(count)
+			}
+			return values
+		}}
+}
+
+// collectQueueLengths returns the number of messages that MessagesFIFO and
+// the log of every other room keep in memory, keyed by room
+func collectQueueLengths() map[string]float64 {
+	lengths := make(map[string]float64)
+	for _, room := range append([]string{""}, Rooms.Names()...) {
+		if msgLog := Rooms.Log(room); msgLog != nil {
+			first, next := msgLog.Bounds()
+			lengths[room] = float64(next - first)
+		}
+	}
+	return lengths
+}
+
+// writeMetrics writes every metric in the Prometheus text format
+func writeMetrics(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	for _, m := range Metrics {
+		writer.WriteString("# HELP " + m.name + " " + m.help + "\n")
+		writer.WriteString("# TYPE " + m.name + " " + m.kind + "\n")
+		if m.histograms != nil {
+			m.histograms.write(writer, m.name, m.label)
+			continue
+		}
+		values := m.collect()
+		for _, key := range sortedKeys(values) {
+			writer.WriteString(m.name + labels(m.label, key) + " " +
+				formatValue(values[key]) + "\n")
+		}
+	}
+	return writer.Flush()
+}
+
+// labels returns the label set {name="value"} (or "" if name is empty),
+// followed by the given extra labels (e.g. `le="0.5"`)
+func labels(name string, value string, extra ...string) string {
+	var pairs []string
+	if name != "" {
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value as in the Prometheus text format
+func formatValue(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of values in increasing order
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tsHistograms is a set of histograms with the same buckets, keyed by the
+// value of a label
+type tsHistograms struct {
+	bounds []float64 // upper bound of each bucket (in increasing order)
+	value  map[string]*histogram
+	mutex  sync.Mutex // mutex for accessing contents
+}
+
+// histogram counts observations in buckets
+type histogram struct {
+	counts []uint64 // observations in each bucket (not cumulative)
+	count  uint64   // observations in total (including beyond the buckets)
+	sum    float64
+}
+
+// Observe records an observation of value in the histogram of key
+func (tsh *tsHistograms) Observe(key string, value float64) {
+	tsh.mutex.Lock()
+	defer tsh.mutex.Unlock()
+
+	if tsh.value == nil {
+		tsh.value = make(map[string]*histogram)
+	}
+	h, isPresent := tsh.value[key]
+	if !isPresent {
+		h = &histogram{counts: make([]uint64, len(tsh.bounds))}
+		tsh.value[key] = h
+	}
+	if i := sort.SearchFloat64s(tsh.bounds, value); i < len(tsh.bounds) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// write writes the series of every histogram (named name, with the key as
+// the value of label) in the Prometheus text format
+func (tsh *tsHistograms) write(writer *bufio.Writer, name string,
+	label string) {
+
+	tsh.mutex.Lock()
+	defer tsh.mutex.Unlock()
+
+	keys := make([]string, 0, len(tsh.value))
+	for key := range tsh.value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := tsh.value[key]
+		cumulative := uint64(0)
+		for i, bound := range tsh.bounds {
+			cumulative += h.counts[i]
+			writer.WriteString(name + "_bucket" + labels(label, key,
+				`le="`+formatValue(bound)+`"`) + " " +
+				strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		writer.WriteString(name + "_bucket" + labels(label, key,
+			`le="+Inf"`) + " " + strconv.FormatUint(h.count, 10) +
+			"\n")
+		writer.WriteString(name + "_sum" + labels(label, key) + " " +
+			formatValue(h.sum) + "\n")
+		writer.WriteString(name + "_count" + labels(label, key) + " " +
+			strconv.FormatUint(h.count, 10) + "\n")
+	}
+}
+
+// serveMetrics serves the metrics endpoint on METRICS_ADDR:
+//
+//	GET /metrics  -> every metric in the Prometheus text format
+//	GET /healthz  -> 200 if this server is in its membership view, 503 if it
+//	                 left or is shutting down (with {"status": ...,
+//	                 "id": ..., "alive": ...})
+//
+// NOTE: the endpoint does not use TLS, since it exposes no messages
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+
+	server := &http.Server{
+		Addr:              METRICS_ADDR,
+		Handler:           mux,
+		ReadHeaderTimeout: READ_TIMEOUT,
+	}
+	err := server.ListenAndServe()
+	if err != nil {
+		Fatal("failed to serve metrics", "addr", METRICS_ADDR,
+			LOG_ERROR, err)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	status := "ok"
+	code := http.StatusOK
+	if stopping() {
+		status = "stopping"
+		code = http.StatusServiceUnavailable
+	} else if !Membership.Contains(ID) {
+		status = "left"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"id":     ID,
+		"alive":  len(LastTimestamp.AliveServers(Clock.Now())),
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	detector, _ := newFailureDetector(DETECTOR_FIXED)
+	LastTimestamp = tsTimestampQueue{detector: detector}
+	MessagesFIFO = tsMsgQueue{}
+	Broadcasts, Deliveries = tsCounters{}, tsCounters{}
+	DialLatency = tsHistograms{bounds: []float64{.01, .1}}
+
+	msg := &Message{Id: 1, Seq: 1, Content: "a"}
+	Rooms.Deliver(msg)
+	Rooms.Deliver(msg)
+	Broadcasts.Add("ops")
+	DialLatency.Observe("2", .005)
+	DialLatency.Observe("2", .05)
+	DialLatency.Observe("2", 3)
+
+	var out strings.Builder
+	err := writeMetrics(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE chatroom_deliveries_total counter",
+		`chatroom_deliveries_total{room=""} 1`,
+		`chatroom_broadcasts_total{room="ops"} 1`,
+		`chatroom_queue_length{room=""} 1`,
+		"chatroom_alive_servers 1",
+		"# TYPE chatroom_dial_duration_seconds histogram",
+		`chatroom_dial_duration_seconds_bucket{peer="2",le="0.01"} 1`,
+		`chatroom_dial_duration_seconds_bucket{peer="2",le="0.1"} 2`,
+		`chatroom_dial_duration_seconds_bucket{peer="2",le="+Inf"} 3`,
+		`chatroom_dial_duration_seconds_sum{peer="2"} 3.055`,
+		`chatroom_dial_duration_seconds_count{peer="2"} 3`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	detector, _ := newFailureDetector(DETECTOR_FIXED)
+	LastTimestamp = tsTimestampQueue{detector: detector}
+
+	for _, inView := range []bool{true, false} {
+		Membership = tsMembership{}
+		if inView {
+			Membership.Init(0)
+		}
+
+		w := httptest.NewRecorder()
+		handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		want := http.StatusOK
+		if !inView {
+			want = http.StatusServiceUnavailable
+		}
+		if w.Code != want {
+			t.Errorf("GET /healthz (in view: %v): status %d, "+
+				"want %d", inView, w.Code, want)
+		}
+
+		var reply struct {
+			Status string `json:"status"`
+			Alive  int    `json:"alive"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &reply)
+		if err != nil || reply.Alive != 1 {
+			t.Errorf("invalid reply %q: %v", w.Body.String(), err)
+		}
+	}
+}
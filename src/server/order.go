@@ -0,0 +1,340 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+
+	"github.com/sfurman3/chatroom/logical"
+	"github.com/sfurman3/chatroom/vector"
+)
+
+// Delivery orders accepted by the -order flag
+const (
+	// deliver messages from each server in the order they were received
+	ORDER_FIFO = "fifo"
+
+	// deliver messages in an order that respects causal precedence (i.e. a
+	// message is never delivered before a message its sender had already
+	// delivered when it was sent)
+	ORDER_CAUSAL = "causal"
+
+	// deliver messages in the same order at every server (messages are
+	// ordered by the Lamport timestamp of their send event, with ties
+	// broken by sender ID), as long as no server is suspected of having
+	// failed (see totalOrderer)
+	ORDER_TOTAL = "total"
+)
+
+// orderer attaches ordering metadata to outgoing messages and decides when
+// received messages are delivered to the log of their room (see tsRooms)
+type orderer interface {
+	// Stamp is called once for every message broadcast by this server
+	// (including heartbeats), before it is sent to any other server
+	//
+	// NOTE: Stamp must be called in the order messages are sent (see
+	// broadcast)
+	Stamp(msg *Message)
+
+	// Receive is called for every message received from another server
+	// (including heartbeats) and every non-empty message sent by this
+	// server. Non-empty messages are delivered to their room, along with
+	// any messages that were waiting on them, once the delivery order
+	// allows it.
+	Receive(msg *Message)
+}
+
+// newOrderer returns the orderer for the given delivery order
+func newOrderer(order string) (orderer, error) {
+	switch order {
+	case ORDER_FIFO:
+		return new(fifoOrderer), nil
+	case ORDER_CAUSAL:
+		return newCausalOrderer(ID, NUM_PROCS)
+	case ORDER_TOTAL:
+		return newTotalOrderer(), nil
+	}
+	return nil, fmt.Errorf("unknown delivery order: %q", order)
+}
+
+// fifoOrderer delivers messages as soon as they are received
+//
+// FIFO delivery relies on messages from each server being received in the
+// order they were sent (see handleMessage)
+type fifoOrderer struct{}
+
+func (*fifoOrderer) Stamp(msg *Message) {}
+
+func (*fifoOrderer) Receive(msg *Message) {
+	if len(msg.Content) == 0 {
+		return
+	}
+	Rooms.Deliver(msg)
+}
+
+// causalOrderer delivers messages in causal order using a vector clock (in
+// which server i has clock ID i+1) and a vector.MessageReceptacle
+//
+// Only the sends of non-empty messages are counted as events (heartbeats are
+// neither stamped nor delivered), and the clock of this server is merged with
+// the timestamp of a message when it is delivered (NOT when it is received).
+// Clocks are not persisted, so the messages of a server that restarts are
+// discarded until its clock passes the timestamps that were already delivered.
+type causalOrderer struct {
+	clock      *vector.Clock
+	receptacle *vector.MessageReceptacle
+
+	// received but undelivered messages (keyed by the message stored in
+	// the receptacle)
+	pending map[*vector.Message]*Message
+
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// newCausalOrderer returns a causalOrderer for server id in a system of n
+// servers
+func newCausalOrderer(id, n int) (*causalOrderer, error) {
+	clk, err := vector.NewClockBuilder().Id(id + 1).Length(n).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &causalOrderer{
+		clock:      clk,
+		receptacle: vector.NewMessageReceptacle(n),
+		pending:    make(map[*vector.Message]*Message),
+	}, nil
+}
+
+// Stamp increments the local component of the clock (a send is an event) and
+// attaches the new timestamp to msg
+func (co *causalOrderer) Stamp(msg *Message) {
+	if len(msg.Content) == 0 {
+		return
+	}
+
+	co.mutex.Lock()
+	co.clock.TickLocal()
+	ts := co.clock.Timestamp(logical.MaxBase)
+	msg.Vts = &ts
+	co.mutex.Unlock()
+}
+
+// Receive adds msg to the receptacle (unless a message with the same timestamp
+// was already delivered) and delivers every message that has become deliverable
+func (co *causalOrderer) Receive(msg *Message) {
+	if len(msg.Content) == 0 {
+		return
+	}
+	if msg.Vts == nil {
+		Logger.Warn("discarding message without a vector timestamp",
+			LOG_PEER, msg.Id, LOG_MESSAGE, messageId(msg))
+		return
+	}
+
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	rmsg := &vector.Message{Content: msg.Content, Timestamp: *msg.Vts}
+	delivered, err := co.receptacle.Delivered(rmsg)
+	if err == nil && delivered {
+		Logger.Warn("discarding message that was already delivered",
+			LOG_PEER, msg.Id, LOG_MESSAGE, messageId(msg))
+		return
+	}
+	err = co.receptacle.Receive(rmsg)
+	if err != nil {
+		Logger.Warn("discarding message", LOG_PEER, msg.Id,
+			LOG_MESSAGE, messageId(msg), LOG_ERROR, err)
+		return
+	}
+	co.pending[rmsg] = msg
+
+	// Deliverables only makes a single pass over the receptacle, so keep
+	// asking until nothing else can be delivered
+	for {
+		delivery, err, offender := co.receptacle.Deliverables()
+		for _, rmsg := range delivery {
+			co.deliver(rmsg)
+		}
+		if err != nil {
+			msg := co.pending[offender]
+			Logger.Warn("discarding message", LOG_PEER, msg.Id,
+				LOG_MESSAGE, messageId(msg), LOG_ERROR, err)
+			delete(co.pending, offender)
+		}
+		if len(delivery) == 0 && err == nil {
+			return
+		}
+	}
+}
+
+// deliver merges the timestamp of rmsg into the clock and adds the
+// corresponding message to its room
+//
+// Assumes co.mutex is held
+func (co *causalOrderer) deliver(rmsg *vector.Message) {
+	msg := co.pending[rmsg]
+	delete(co.pending, rmsg)
+
+	if msg.Id != ID {
+		clk, err := rmsg.Timestamp.Clock()
+		if err == nil {
+			err = co.clock.TickReceive(clk)
+		}
+		if err != nil {
+			Logger.Error("failed to merge timestamp of message",
+				LOG_PEER, msg.Id, LOG_MESSAGE, messageId(msg),
+				LOG_ERROR, err)
+		}
+	}
+
+	Rooms.Deliver(msg)
+}
+
+// totalOrderer delivers messages in (Lamport timestamp, sender ID) order,
+// which is the same at every server while no server is suspected of having
+// failed
+//
+// A message is held back until it is "stable" (see the vector package
+// documentation), i.e. until a message with a larger timestamp has been
+// received (in FIFO order) from every other server that is alive. Every server
+// acknowledges non-empty messages by broadcasting an empty message (which
+// carries a timestamp) as soon as possible, so messages become stable within
+// about one round trip.
+// Acknowledgements are coalesced: a message received while an acknowledgement
+// (or any other broadcast) is waiting to be stamped is covered by it, so at
+// most one acknowledgement is pending at a time.
+//
+// Servers that are not alive (according to LastTimestamp) are ignored when
+// deciding stability, rather than waiting for every server to agree on a new
+// membership, so servers that suspect a slow server at different times can
+// deliver messages in different orders.
+type totalOrderer struct {
+	clock     logical.Clock          // Lamport clock of this server
+	lastClock map[int]*logical.Clock // largest timestamp from each server
+	holdback  holdbackQueue          // received but undelivered messages
+
+	// whether an acknowledgement has been requested but no message has
+	// been stamped since
+	ackPending bool
+
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// newTotalOrderer returns a totalOrderer
+func newTotalOrderer() *totalOrderer {
+	return &totalOrderer{lastClock: make(map[int]*logical.Clock)}
+}
+
+// Stamp ticks the clock (a send is an event) and attaches the new timestamp to
+// msg, which acknowledges every message received so far. Stamp is called for
+// every heartbeat, so it also delivers any messages that became stable because
+// a server is no longer alive.
+func (to *totalOrderer) Stamp(msg *Message) {
+	to.mutex.Lock()
+	to.clock.Tick()
+	msg.Lts = to.clock.Text(logical.MaxBase)
+	to.ackPending = false
+	to.deliverStable()
+	to.mutex.Unlock()
+}
+
+// Receive updates the clock with the timestamp of msg, adds msg to the
+// holdback queue (if it is non-empty), and delivers every stable message
+func (to *totalOrderer) Receive(msg *Message) {
+	ts, succ := new(logical.Clock).SetString(msg.Lts, logical.MaxBase)
+	if !succ {
+		Logger.Warn("discarding message with an invalid Lamport "+
+			"timestamp", LOG_PEER, msg.Id,
+			LOG_MESSAGE, messageId(msg), "lts", msg.Lts)
+		return
+	}
+
+	to.mutex.Lock()
+	defer to.mutex.Unlock()
+
+	if msg.Id != ID {
+		to.clock.TickReceive(ts)
+		last, isPresent := to.lastClock[msg.Id]
+		if !isPresent {
+			last = new(logical.Clock)
+			to.lastClock[msg.Id] = last
+		}
+		last.Max(ts)
+	}
+
+	if len(msg.Content) != 0 {
+		heap.Push(&to.holdback, &heldMessage{msg: msg, ts: ts})
+		if msg.Id != ID && !to.ackPending {
+			// acknowledge the message so that it becomes stable
+			// without waiting for the next heartbeat
+			to.ackPending = true
+			go broadcast(emptyMessage())
+		}
+	}
+
+	to.deliverStable()
+}
+
+// deliverStable delivers stable messages from the front of the holdback queue
+// to their rooms
+//
+// Assumes to.mutex is held
+func (to *totalOrderer) deliverStable() {
+	now := Clock.Now()
+	for to.holdback.Len() > 0 {
+		next := to.holdback[0]
+		for _, id := range Membership.Ids() {
+			if id == ID || id == next.msg.Id {
+				// this server's future messages have larger
+				// timestamps, as do the sender's (FIFO)
+				continue
+			}
+			if !LastTimestamp.Alive(id, now) {
+				continue
+			}
+			last, isPresent := to.lastClock[id]
+			if !isPresent || last.Cmp(next.ts) <= 0 {
+				return
+			}
+		}
+
+		heap.Pop(&to.holdback)
+		Rooms.Deliver(next.msg)
+	}
+}
+
+// heldMessage is a message in a holdback queue together with its parsed
+// Lamport timestamp
+type heldMessage struct {
+	msg *Message
+	ts  *logical.Clock
+}
+
+// holdbackQueue is a priority queue of messages ordered by (timestamp, sender
+// ID) that implements heap.Interface
+type holdbackQueue []*heldMessage
+
+func (hq holdbackQueue) Len() int { return len(hq) }
+
+func (hq holdbackQueue) Less(i, j int) bool {
+	cmp := hq[i].ts.Cmp(hq[j].ts)
+	if cmp == 0 {
+		return hq[i].msg.Id < hq[j].msg.Id
+	}
+	return cmp < 0
+}
+
+func (hq holdbackQueue) Swap(i, j int) { hq[i], hq[j] = hq[j], hq[i] }
+
+func (hq *holdbackQueue) Push(x interface{}) {
+	*hq = append(*hq, x.(*heldMessage))
+}
+
+func (hq *holdbackQueue) Pop() interface{} {
+	old := *hq
+	last := old[len(old)-1]
+	*hq = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sfurman3/chatroom/logical"
+	"github.com/sfurman3/chatroom/simnet"
+)
+
+// resetLog makes this server 0 of n with an empty default room
+func resetLog(n int) {
+	ID, NUM_PROCS = 0, n
+	MessagesFIFO = tsMsgQueue{}
+}
+
+// logContents returns the contents of the messages in tsq, separated by commas
+func logContents(tsq *tsMsgQueue) string {
+	msgs, _, _ := tsq.Since(0, 1<<30)
+	contents := make([]string, len(msgs))
+	for i, msg := range msgs {
+		contents[i] = msg.Content
+	}
+	return strings.Join(contents, ",")
+}
+
+func TestFifoOrder(t *testing.T) {
+	resetLog(3)
+	rb := newReorderBuffer(new(fifoOrderer).Receive, nil)
+	now := time.Now()
+
+	// a heartbeat is not delivered, and messages from server 1 arrive in
+	// the order 2, 3, 1 (interleaved with those of server 2)
+	rb.Receive(seqMessage(1, 1, 2, "b"), now)
+	rb.Receive(seqMessage(2, 1, 1, "x"), now)
+	rb.Receive(seqMessage(1, 1, 3, "c"), now)
+	rb.Receive(seqMessage(2, 1, 1, ""), now)
+	rb.Receive(seqMessage(1, 1, 1, "a"), now)
+
+	if got := logContents(&MessagesFIFO); got != "x,a,b,c" {
+		t.Fatalf("delivered %s, want x,a,b,c", got)
+	}
+}
+
+func TestCausalOrder(t *testing.T) {
+	resetLog(3)
+	co, _ := newCausalOrderer(0, 3)
+	co1, _ := newCausalOrderer(1, 3)
+	co2, _ := newCausalOrderer(2, 3)
+
+	// server 1 sends a1 and a2, server 2 delivers a1 and then sends b
+	// (which causally follows a1)
+	a1, a2 := seqMessage(1, 1, 1, "a1"), seqMessage(1, 1, 2, "a2")
+	co1.Stamp(a1)
+	co1.Stamp(a2)
+	clk, err := a1.Vts.Clock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	co2.clock.TickReceive(clk)
+	b := seqMessage(2, 1, 1, "b")
+	co2.Stamp(b)
+
+	// server 0 receives them in the reverse order
+	for _, msg := range []*Message{b, a2} {
+		co.Receive(msg)
+		if got := logContents(&MessagesFIFO); got != "" {
+			t.Fatalf("delivered %s before a1", got)
+		}
+	}
+	co.Receive(a1)
+
+	got := logContents(&MessagesFIFO)
+	if got != "a1,a2,b" && got != "a1,b,a2" {
+		t.Fatalf("delivered %s, want a1 before a2 and b", got)
+	}
+	if co.receptacle.Size() != 0 || len(co.pending) != 0 {
+		t.Errorf("%d messages still pending", len(co.pending))
+	}
+}
+
+func TestCausalOrderRestart(t *testing.T) {
+	resetLog(2)
+	co, _ := newCausalOrderer(0, 2)
+	co1, _ := newCausalOrderer(1, 2)
+
+	send := func(co1 *causalOrderer, msg *Message) {
+		co1.Stamp(msg)
+		co.Receive(msg)
+	}
+	send(co1, seqMessage(1, 1, 1, "a1"))
+	send(co1, seqMessage(1, 1, 2, "a2"))
+
+	// server 1 restarts with a new clock, so its first two timestamps were
+	// already delivered
+	co1, _ = newCausalOrderer(1, 2)
+	for i, content := range []string{"b1", "b2", "b3"} {
+		send(co1, seqMessage(1, 2, uint64(i+1), content))
+	}
+
+	if got := logContents(&MessagesFIFO); got != "a1,a2,b3" {
+		t.Fatalf("delivered %s, want a1,a2,b3", got)
+	}
+	if co.receptacle.Size() != 0 || len(co.pending) != 0 {
+		t.Errorf("%d messages still pending", len(co.pending))
+	}
+}
+
+// newTestMessage returns a chat message from server id
+func newTestMessage(id int, content string) *Message {
+	return &Message{Id: id, Content: content, Epoch: 1}
+}
+
+func TestTotalOrder(t *testing.T) {
+	resetLog(3)
+	Membership = tsMembership{}
+	Membership.Init(3)
+	detector, _ := newFailureDetector(DETECTOR_FIXED)
+	LastTimestamp = tsTimestampQueue{detector: detector}
+	Network = simnet.New(1, nil).Host("0") // nobody to send to
+	defer func() { Network = tcpTransport{} }()
+	defer Peers.Retain(nil)
+	to := newTotalOrderer()
+	Orderer = to
+
+	lamport := func(id int, lts uint64, content string) *Message {
+		msg := newTestMessage(id, content)
+		ts, _ := new(logical.Clock).SetString(
+			strconv.FormatUint(lts, 10), 10)
+		msg.Lts = ts.Text(logical.MaxBase)
+		LastTimestamp.UpdateTimestamp(msg, time.Now())
+		return msg
+	}
+
+	// both servers are alive, but neither has sent a timestamp yet
+	for _, id := range []int{1, 2} {
+		LastTimestamp.UpdateTimestamp(&Message{Id: id, Heartbeat: true},
+			time.Now())
+	}
+
+	// acknowledgements of messages received while one is pending are
+	// coalesced into it
+	sent := Heartbeats.Counts()["sent"]
+	broadcastMutex.Lock()
+	to.Receive(lamport(1, 5, "b"))
+	to.Receive(lamport(2, 3, "a"))
+	for i := 0; i < 20; i++ {
+		to.Receive(lamport(1, uint64(6+i), ""))
+	}
+	broadcastMutex.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for Heartbeats.Counts()["sent"] == sent && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	Peers.Drain(deadline)
+	if acks := Heartbeats.Counts()["sent"] - sent; acks != 2 {
+		t.Errorf("sent %d acknowledgements to 2 servers, want 2", acks)
+	}
+
+	// a (timestamp 3) is stable once server 1 sent a larger timestamp, but
+	// b (timestamp 5) waits for server 2
+	if got := logContents(&MessagesFIFO); got != "a" {
+		t.Fatalf("delivered %q, want a", got)
+	}
+	to.Receive(lamport(2, 30, ""))
+	if got := logContents(&MessagesFIFO); got != "a,b" {
+		t.Fatalf("delivered %q, want a,b", got)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum duration a message is held back waiting for an earlier message from
+// the same server before the missing messages are skipped (3 *
+// HEARTBEAT_INTERVAL, see registerTimingFlags)
+var REORDER_TIMEOUT = 600 * time.Millisecond
+
+// reorderBuffer restores the send order of the messages from each server to
+// each room (using their Epoch and Seq fields) before passing them on, waiting
+// up to REORDER_TIMEOUT for missing messages and discarding those that arrive
+// after they were skipped
+//
+// Messages arrive out of order when a newer connection from a server is handled
+// before an older one (e.g. after a reconnect), or when they are recovered from
+// other servers (see handleSyncReply). Missing messages are usually ones the
+// sender discarded because its outbound queue was full. Messages that were
+// already delivered (e.g. before this server restarted) are not waited on.
+//
+// Heartbeats are not numbered, but carry the sequence number of the last
+// message sent before them, so a heartbeat is held back until that message is
+// delivered (and only the latest held back heartbeat of each server is kept).
+type reorderBuffer struct {
+	deliver func(*Message)             // called for each message in order
+	senders map[senderKey]*senderState // state of each server and room
+	mutex   sync.Mutex                 // mutex for accessing contents
+
+	// whether the message with the given key was already delivered to the
+	// given room (nil if unknown)
+	delivered func(room string, key msgKey) bool
+}
+
+// senderKey identifies the messages of a server to a room, which are numbered
+// separately (see broadcast)
+type senderKey struct {
+	id   int
+	room string
+}
+
+// senderState is the reordering state of a single server and room
+type senderState struct {
+	key       senderKey
+	epoch     int64               // epoch of the server's current process
+	next      uint64              // sequence number of the next message
+	pending   map[uint64]*Message // messages that arrived early
+	heartbeat *Message            // heartbeat that arrived early (if any)
+	gapSince  time.Time           // when the first early message arrived
+}
+
+// newReorderBuffer returns a reorderBuffer that passes messages to deliver in
+// the order they were sent, without waiting for messages that delivered
+// reports were delivered already (delivered may be nil)
+func newReorderBuffer(deliver func(*Message),
+	delivered func(room string, key msgKey) bool) *reorderBuffer {
+
+	return &reorderBuffer{
+		deliver:   deliver,
+		delivered: delivered,
+		senders:   make(map[senderKey]*senderState),
+	}
+}
+
+// Receive delivers msg, along with any messages that were waiting on it, if
+// every earlier message from its sender has been delivered (or skipped).
+// Otherwise msg is held back.
+//
+// The sequence of every process (i.e. every epoch) starts at 1, so messages
+// received before an earlier message of a new epoch are held back as well.
+// Messages from an older epoch are delivered immediately.
+func (rb *reorderBuffer) Receive(msg *Message, now time.Time) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	key := senderKey{msg.Id, msg.Room}
+	ss, isPresent := rb.senders[key]
+	switch {
+	case !isPresent || ss.epoch < msg.Epoch:
+		if isPresent {
+			// the sender restarted, so nothing else is coming
+			// from its previous process
+			rb.flush(ss)
+		}
+		ss = &senderState{
+			key:     key,
+			epoch:   msg.Epoch,
+			next:    1,
+			pending: make(map[uint64]*Message),
+		}
+		rb.senders[key] = ss
+	case msg.Epoch < ss.epoch:
+		rb.deliver(msg)
+		return
+	}
+
+	if len(msg.Content) == 0 {
+		// a heartbeat follows the message numbered msg.Seq
+		if msg.Seq < ss.next {
+			rb.deliver(msg)
+			return
+		}
+	} else if msg.Seq < ss.next {
+		Logger.Warn("discarding late message", LOG_PEER, msg.Id,
+			LOG_MESSAGE, messageId(msg))
+		return
+	}
+	if len(ss.pending) == 0 && ss.heartbeat == nil {
+		ss.gapSince = now
+	}
+	if len(msg.Content) == 0 {
+		ss.heartbeat = msg
+	} else {
+		ss.pending[msg.Seq] = msg
+	}
+	rb.deliverReady(ss, now)
+}
+
+// Expire skips the missing messages of every server whose earliest held back
+// message has waited longer than REORDER_TIMEOUT and delivers any messages
+// that were waiting on them
+func (rb *reorderBuffer) Expire(now time.Time) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	for _, ss := range rb.senders {
+		rb.deliverReady(ss, now)
+	}
+}
+
+// deliverReady delivers held back messages of ss that are next in sequence,
+// first skipping missing messages if they were already delivered or have been
+// waited on for longer than REORDER_TIMEOUT
+//
+// Assumes rb.mutex is held
+func (rb *reorderBuffer) deliverReady(ss *senderState, now time.Time) {
+	for {
+		if hb := ss.heartbeat; hb != nil && hb.Seq < ss.next {
+			ss.heartbeat = nil
+			rb.deliver(hb)
+		}
+		if len(ss.pending) == 0 && ss.heartbeat == nil {
+			return
+		}
+
+		msg, isPresent := ss.pending[ss.next]
+		if isPresent {
+			delete(ss.pending, ss.next)
+			ss.next++
+			ss.gapSince = now
+			rb.deliver(msg)
+			continue
+		}
+		if rb.delivered != nil && rb.delivered(ss.key.room,
+			msgKey{ss.key.id, ss.epoch, ss.next}) {
+			ss.next++
+			continue
+		}
+		if now.Sub(ss.gapSince) < REORDER_TIMEOUT {
+			return
+		}
+		if len(ss.pending) > 0 {
+			ss.next = minSeq(ss.pending)
+		} else {
+			ss.next = ss.heartbeat.Seq + 1
+		}
+	}
+}
+
+// flush delivers every held back message of ss in sequence order
+//
+// Assumes rb.mutex is held
+func (rb *reorderBuffer) flush(ss *senderState) {
+	seqs := make([]uint64, 0, len(ss.pending))
+	for seq := range ss.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		rb.deliver(ss.pending[seq])
+	}
+	if ss.heartbeat != nil {
+		rb.deliver(ss.heartbeat)
+	}
+	ss.pending, ss.heartbeat = nil, nil
+}
+
+// minSeq returns the smallest sequence number in pending
+func minSeq(pending map[uint64]*Message) uint64 {
+	first := true
+	var min uint64
+	for seq := range pending {
+		if first || seq < min {
+			min = seq
+			first = false
+		}
+	}
+	return min
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestReorderBuffer returns a reorderBuffer that appends delivered message
+// contents to delivered
+func newTestReorderBuffer(delivered *[]string) *reorderBuffer {
+	return newReorderBuffer(func(msg *Message) {
+		*delivered = append(*delivered, msg.Content)
+	}, nil)
+}
+
+func seqMessage(id int, epoch int64, seq uint64, content string) *Message {
+	return &Message{Id: id, Epoch: epoch, Seq: seq, Content: content}
+}
+
+func TestReorderBuffer_InOrder(t *testing.T) {
+	var delivered []string
+	rb := newTestReorderBuffer(&delivered)
+	now := time.Now()
+
+	rb.Receive(seqMessage(1, 1, 1, "a"), now)
+	rb.Receive(seqMessage(1, 1, 2, "b"), now)
+	rb.Receive(seqMessage(2, 1, 1, "c"), now)
+
+	if len(delivered) != 3 {
+		t.Fatalf("expected 3 deliveries, got: %v", delivered)
+	}
+}
+
+func TestReorderBuffer_FirstMessageOfEpochLate(t *testing.T) {
+	var delivered []string
+	rb := newTestReorderBuffer(&delivered)
+	now := time.Now()
+
+	// the first message of the epoch arrives after the second one
+	rb.Receive(seqMessage(1, 1, 2, "b"), now)
+	if len(delivered) != 0 {
+		t.Fatalf("expected b to be held back, got: %v", delivered)
+	}
+	rb.Receive(seqMessage(1, 1, 1, "a"), now)
+	if len(delivered) != 2 || delivered[0] != "a" || delivered[1] != "b" {
+		t.Fatalf("expected [a b], got: %v", delivered)
+	}
+}
+
+func TestReorderBuffer_JoinMidSequence(t *testing.T) {
+	var delivered []string
+	rb := newTestReorderBuffer(&delivered)
+	now := time.Now()
+
+	// the messages sent before this server started are never coming
+	rb.Receive(seqMessage(1, 1, 5, "e"), now)
+	rb.Receive(seqMessage(1, 1, 6, "f"), now)
+	if len(delivered) != 0 {
+		t.Fatalf("expected e and f to be held back, got: %v", delivered)
+	}
+	rb.Expire(now.Add(REORDER_TIMEOUT))
+	if len(delivered) != 2 || delivered[0] != "e" || delivered[1] != "f" {
+		t.Fatalf("expected [e f], got: %v", delivered)
+	}
+}
+
+func TestReorderBuffer_HoldsBackEarlyMessages(t *testing.T) {
+	var delivered []string
+	rb := newTestReorderBuffer(&delivered)
+	now := time.Now()
+
+	rb.Receive(seqMessage(1, 1, 1, "a"), now)
+	rb.Receive(seqMessage(1, 1, 3, "c"), now)
+	rb.Receive(seqMessage(1, 1, 4, "d"), now)
+	if len(delivered) != 1 {
+		t.Fatalf("expected c and d to be held back, got: %v", delivered)
+	}
+
+	rb.Receive(seqMessage(1, 1, 2, "b"), now)
+	expected := "abcd"
+	got := ""
+	for _, content := range delivered {
+		got += content
+	}
+	if got != expected {
+		t.Fatalf("expected: %s, got: %s", expected, got)
+	}
+}
+
+func TestReorderBuffer_ExpireSkipsGap(t *testing.T) {
+	var delivered []string
+	rb := newTestReorderBuffer(&delivered)
+	now := time.Now()
+
+	rb.Receive(seqMessage(1, 1, 1, "a"), now)
+	rb.Receive(seqMessage(1, 1, 3, "c"), now)
+
+	rb.Expire(now.Add(REORDER_TIMEOUT / 2))
+	if len(delivered) != 1 {
+		t.Fatalf("expected c to be held back, got: %v", delivered)
+	}
+
+	rb.Expire(now.Add(REORDER_TIMEOUT))
+	if len(delivered) != 2 || delivered[1] != "c" {
+		t.Fatalf("expected c to be delivered, got: %v", delivered)
+	}
+
+	// the skipped message is discarded if it arrives late
+	rb.Receive(seqMessage(1, 1, 2, "b"), now.Add(REORDER_TIMEOUT))
+	if len(delivered) != 2 {
+		t.Fatalf("expected b to be discarded, got: %v", delivered)
+	}
+}
+
+func TestReorderBuffer_NewEpoch(t *testing.T) {
+	var delivered []string
+	rb := newTestReorderBuffer(&delivered)
+	now := time.Now()
+
+	rb.Receive(seqMessage(1, 1, 1, "a"), now)
+	rb.Receive(seqMessage(1, 1, 3, "c"), now)
+
+	// the sender restarted, so its held back messages are flushed and its
+	// sequence starts over
+	rb.Receive(seqMessage(1, 2, 1, "x"), now)
+	if len(delivered) != 3 || delivered[1] != "c" || delivered[2] != "x" {
+		t.Fatalf("expected [a c x], got: %v", delivered)
+	}
+
+	// messages from the previous process are delivered immediately
+	rb.Receive(seqMessage(1, 1, 2, "b"), now)
+	if len(delivered) != 4 || delivered[3] != "b" {
+		t.Fatalf("expected b to be delivered, got: %v", delivered)
+	}
+}
+
+func TestReorderBuffer_Heartbeat(t *testing.T) {
+	var delivered []string
+	rb := newTestReorderBuffer(&delivered)
+	now := time.Now()
+
+	// a heartbeat follows the last message sent before it
+	rb.Receive(seqMessage(1, 1, 0, ""), now)
+	rb.Receive(seqMessage(1, 1, 1, "a"), now)
+	rb.Receive(seqMessage(1, 1, 2, ""), now)
+	rb.Receive(seqMessage(1, 1, 3, "c"), now)
+	if len(delivered) != 2 || delivered[0] != "" || delivered[1] != "a" {
+		t.Fatalf("expected [\"\" a], got: %q", delivered)
+	}
+	rb.Receive(seqMessage(1, 1, 2, "b"), now)
+	if len(delivered) != 5 || delivered[2] != "b" || delivered[3] != "" ||
+		delivered[4] != "c" {
+		t.Fatalf("expected the heartbeat between b and c, got: %q",
+			delivered)
+	}
+
+	// a heartbeat waiting on a message that never arrives is delivered
+	// once it is skipped
+	rb.Receive(seqMessage(1, 1, 4, ""), now)
+	rb.Expire(now.Add(REORDER_TIMEOUT))
+	if len(delivered) != 6 || delivered[5] != "" {
+		t.Fatalf("expected the heartbeat to be delivered, got: %q",
+			delivered)
+	}
+}
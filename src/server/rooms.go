@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prefix that distinguishes a room name from the content of a message in
+// master commands (e.g. "broadcast #ops hello")
+const ROOM_PREFIX = "#"
+
+// Valid room names (without ROOM_PREFIX), which are also used in file names
+var roomName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// tsRooms is the set of rooms this server has joined, each with its own log of
+// delivered messages, which is only sent messages to a room if it joined it
+// (see member), unless ORDER is ORDER_CAUSAL (whose vector clocks count the
+// messages of every room)
+//
+// The default room ("") holds messages broadcast without a room name. Every
+// server is always in it, and its log is MessagesFIFO.
+type tsRooms struct {
+	value map[string]*tsMsgQueue // log of each joined room, keyed by name
+	mutex sync.Mutex             // mutex for accessing contents
+}
+
+// parseRoom returns the name of the room in arg (e.g. "ops" for "#ops") and
+// whether arg is a valid room name
+func parseRoom(arg string) (string, bool) {
+	if !strings.HasPrefix(arg, ROOM_PREFIX) {
+		return "", false
+	}
+	name := arg[len(ROOM_PREFIX):]
+	return name, roomName.MatchString(name)
+}
+
+// roomLogPath returns the path of the message log of the given room in
+// DATA_DIR
+func roomLogPath(name string) string {
+	if name == "" {
+		return filepath.Join(DATA_DIR,
+			"server-"+strconv.Itoa(ID)+".wal")
+	}
+	return filepath.Join(DATA_DIR,
+		"server-"+strconv.Itoa(ID)+"-"+name+".wal")
+}
+
+// Recover rejoins every room this server has a message log for in DATA_DIR
+func (tsr *tsRooms) Recover() error {
+	prefix := "server-" + strconv.Itoa(ID) + "-"
+	paths, err := filepath.Glob(filepath.Join(DATA_DIR, prefix+"*.wal"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(
+			strings.TrimPrefix(filepath.Base(path), prefix), ".wal")
+		if !roomName.MatchString(name) {
+			continue
+		}
+		_, err := tsr.Join(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Join adds this server to the given room (recovering its log if messages are
+// persisted) and returns whether it was not already in it
+func (tsr *tsRooms) Join(name string) (bool, error) {
+	tsr.mutex.Lock()
+	defer tsr.mutex.Unlock()
+
+	if name == "" {
+		return false, nil
+	}
+	if _, isPresent := tsr.value[name]; isPresent {
+		return false, nil
+	}
+	if !roomName.MatchString(name) {
+		return false, fmt.Errorf("invalid room name: %q", name)
+	}
+
+	msgLog := new(tsMsgQueue)
+	if DATA_DIR != "" {
+		walLog, msgs, err := openWAL(roomLogPath(name), FSYNC)
+		if err != nil {
+			return false, err
+		}
+		msgLog.Recover(walLog, msgs)
+	}
+
+	if tsr.value == nil {
+		tsr.value = make(map[string]*tsMsgQueue)
+	}
+	tsr.value[name] = msgLog
+	Membership.SetRooms(tsr.names())
+	return true, nil
+}
+
+// Leave removes this server from the given room (but keeps its log in DATA_DIR
+// for when it joins the room again) and returns whether it was in it
+func (tsr *tsRooms) Leave(name string) bool {
+	tsr.mutex.Lock()
+	defer tsr.mutex.Unlock()
+
+	msgLog, isPresent := tsr.value[name]
+	if !isPresent {
+		return false
+	}
+	err := msgLog.Close()
+	if err != nil {
+		Logger.Error("failed to close message log", "room", name,
+			LOG_ERROR, err)
+	}
+	delete(tsr.value, name)
+	Membership.SetRooms(tsr.names())
+	return true
+}
+
+// Close flushes and closes the log of every room (including the default room),
+// after which messages are only kept in memory (in the same rooms), and returns
+// the first error
+func (tsr *tsRooms) Close() error {
+	tsr.mutex.Lock()
+	defer tsr.mutex.Unlock()
+
+	err := MessagesFIFO.Close()
+	for _, name := range tsr.names() {
+		closeErr := tsr.value[name].Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Log returns the log of the given room, or nil if this server is not in it
+func (tsr *tsRooms) Log(name string) *tsMsgQueue {
+	if name == "" {
+		return &MessagesFIFO
+	}
+
+	tsr.mutex.Lock()
+	defer tsr.mutex.Unlock()
+	return tsr.value[name]
+}
+
+// Names returns the names of the rooms this server is in (in increasing order,
+// excluding the default room)
+func (tsr *tsRooms) Names() []string {
+	tsr.mutex.Lock()
+	defer tsr.mutex.Unlock()
+	return tsr.names()
+}
+
+// names returns the names of the rooms this server is in
+//
+// Assumes tsr.mutex is held
+func (tsr *tsRooms) names() []string {
+	var names []string
+	for name := range tsr.value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Delivered returns whether the message with the given key was delivered to
+// the given room (e.g. before this server restarted)
+func (tsr *tsRooms) Delivered(name string, key msgKey) bool {
+	msgLog := tsr.Log(name)
+	return msgLog != nil && msgLog.Contains(key)
+}
+
+// Deliver appends msg to the log of its room, unless this server is not in it
+func (tsr *tsRooms) Deliver(msg *Message) {
+	msgLog := tsr.Log(msg.Room)
+	if msgLog == nil {
+		return
+	}
+	if msgLog.Enqueue(msg) {
+		Deliveries.Add(msg.Room)
+		Logger.Debug("delivered message", LOG_PEER, msg.Id, LOG_MESSAGE,
+			messageId(msg), "room", msg.Room)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoom(t *testing.T) {
+	cases := []struct {
+		arg   string
+		name  string
+		valid bool
+	}{
+		{"#ops", "ops", true},
+		{"#team-1_a", "team-1_a", true},
+		{"ops", "", false},
+		{"#", "", false},
+		{"#../etc", "../etc", false},
+	}
+	for _, c := range cases {
+		name, valid := parseRoom(c.arg)
+		if name != c.name || valid != c.valid {
+			t.Errorf("parseRoom(%q) = %q, %v, want %q, %v", c.arg,
+				name, valid, c.name, c.valid)
+		}
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	ID = 0
+	var tsm tsMembership
+	tsm.Init(3)
+	tsm.Merge(view{1: {Version: 2, Rooms: []string{"dev", "ops"}}})
+
+	if got := tsm.Subscribers("ops"); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("subscribers of ops: %v, want [1]", got)
+	}
+	if got := tsm.Subscribers(""); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("subscribers of the default room: %v, want [1 2]", got)
+	}
+
+	// a stale state of this server is overridden by its own
+	tsm.SetRooms([]string{"ops"})
+	tsm.Merge(view{0: {Version: 5}})
+	self := tsm.View()[0]
+	if self.Version != 6 ||
+		!reflect.DeepEqual(self.Rooms, []string{"ops"}) {
+		t.Fatalf("own state was not kept: %+v", self)
+	}
+}
@@ -2,6 +2,12 @@
 // participants (servers) can broadcast messages and detect failures. Each
 // server keeps a FIFO log of messages it has received.
 //
+// The "-order" flag selects how received messages are delivered to the log:
+//  - "fifo" (default):  messages from each server in the order they were sent
+//  - "causal":          messages in an order that respects causal precedence
+//  - "total":           messages in the same order at every server (while no
+//                       server is suspected of having failed)
+//
 // "server [id] [numservers] [port]" sets up a server with ID [id] on port
 // [20000 + id] with a master-facing port of [port] (i.e the port which
 // the master process uses to issue commands and accept responses).
@@ -9,16 +15,97 @@
 // connect to the remaining servers. A system of n servers is assumed to have
 // server IDs {0...n-1} and ports {20000...20000 + n-1} respectively.
 //
+// Servers can also be added to a running system with "-join <host:port>"
+// (the address of any server's server-facing port), in which case [id] may be
+// any unused ID and [numservers] is ignored. Servers keep a versioned
+// membership view which they gossip with their heartbeats (see tsMembership),
+// and a server is removed from it with the "leave" command.
+//
+// "-detector swim" replaces all-to-all heartbeats with the SWIM protocol, in
+// which each server probes one other server per period and disseminates
+// failures by piggybacking them on probes (see swim).
+//
 //  The following master commands are supported:
 //  --------------------------------------------
 //  - "get\n:               return a list of all received messages
 //  - "alive\n":            return a list of server IDs believed to be alive
+//  - "alive phi\n":        the same, with the phi value of each server
 //  - "broadcast <m>\n":    send <m> to everyone alive (including the sender)
+//  - "leave\n":            remove this server from the membership view
+//  - "join #<room>\n":     join the room <room> (see tsRooms)
+//  - "leave #<room>\n":    leave the room <room>
+//  - "rooms\n":            return a list of the rooms this server is in
+//  - "get #<room>\n":      return a list of all messages received in <room>
+//  - "get [#<room>] since <pos> limit <n> from <id> after <t> before <t>\n":
+//                          return a page of the messages of a room (every
+//                          filter is optional, see masterRequest)
+//  - "broadcast #<room> <m>\n":
+//                          send <m> to everyone in <room> (the sender must
+//                          be in it)
+//  - "subscribe [#<room>] [<pos>]\n":
+//                          push the messages of a room (default: the
+//                          default room) from position <pos> on (default:
+//                          the next message) as they are delivered
+//  - "unsubscribe [#<room>]\n":
+//                          stop pushing the messages of a room
+//  - "rejected\n":         count the rejected messages from other servers
+//  - "loglevel [<level>]\n":
+//                          set the minimum level of logged records to
+//                          <level> (debug, info, warn or error)
 //
 //  Responses have the following format:
 //  ------------------------------------
 //  - "get\n"   -> "messages <msg1>,<msg2>,...\n"
 //  - "alive\n" -> "alive <id1>,<id2>,...\n"
+//  - "alive phi\n" -> "alive <id1>:<phi1>,<id2>:<phi2>,...\n"
+//  - "rooms\n" -> "rooms #<room1>,#<room2>,...\n"
+//  - "get ... limit <n>\n" -> "page <next> <msg1>,<msg2>,...\n", where
+//                     <next> is the position to continue from
+//  - "subscribe\n" -> "subscribed <pos>\n", followed by
+//                     "message [#<room>] <pos> <msg>\n" for each message
+//  - "rejected\n" -> "rejected <reason1>:<n1>,<reason2>:<n2>,...\n"
+//  - "loglevel\n" -> "loglevel <level>\n"
+//
+// Failed commands are answered with "error <code> <message>\n". "help\n"
+// lists every command, and "hello v2\n" switches the connection to a JSON
+// lines protocol with request IDs and structured replies (see masterRequest).
+// Any number of masters may be connected to the master-facing port at once.
+// The same commands are available over HTTP (with a WebSocket stream of
+// messages) on the address given by "-http" (see serveHTTP).
+//
+// The position of a message is its index in the log of its room. Old messages
+// can be dropped from memory with "-retain-messages" and "-retain-age" (see
+// tsMsgQueue), in which case positions do not start at 0.
+//
+// Servers authenticate each other with mutual TLS if they are given a
+// certificate signed by a common authority ("-tls-cert", "-tls-key" and
+// "-tls-ca"), and "-master-tls" enables TLS for masters (see loadTLS).
+//
+// With "-signing-key" and "-public-keys", every message is signed by its sender
+// and verified by its receivers, which reject (and count) messages that are
+// malformed or forged (see encodeMessage and the "rejected" command). Messages
+// from other servers are validated before they are handled, whether they are
+// signed or not, and their size and rate are limited by "-max-frame-size" and
+// "-peer-rate-limit" (see decodeMessage and serveConn).
+//
+// "-metrics" serves counters (e.g. of messages broadcast and delivered) in the
+// Prometheus text format on /metrics, and a health check on /healthz (see
+// serveMetrics).
+//
+// SIGTERM (or SIGINT) shuts a server down gracefully: it stops accepting
+// master commands, tells the other servers it is leaving (so they stop
+// considering it alive at once), writes out the messages queued for them and
+// flushes its message log before exiting (see shutdown).
+//
+// Errors and events are logged to stderr as structured records with the id of
+// the server (and of the other server, message or command involved), in the
+// format given by "-log-format" (text or json) and from the level given by
+// "-log-level" on (see setupLogger).
+//
+// Servers on other hosts (or ports) can be listed in a JSON cluster
+// configuration file given by "-config" (see clusterConfig), and every timing
+// and size knob has a flag that can also be set through the environment (e.g.
+// "-heartbeat 100ms" or "CHATROOM_HEARTBEAT=100ms", see registerTimingFlags).
 //
 // You can test a server instance using netcat. For example:
 //  ➜  server 0 1 30000 &
@@ -36,35 +123,37 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
+
+	"github.com/sfurman3/chatroom/vector"
 )
 
-const (
+// Tunable timings and sizes (see registerTimingFlags)
+var (
 	// Base port for servers in the system
-	// Port numbers are always START_PORT + ID
+	// Port numbers are START_PORT + ID, unless given by the cluster
+	// configuration (see the -config flag)
 	START_PORT = 20000
 
 	// Duration between heartbeat messages (i.e. empty messages broadcasted
 	// to other servers to indicate the server is alive)
 	HEARTBEAT_INTERVAL = 200 * time.Millisecond
 
-	// Maximum interval after the send timestamp of the last message
-	// received from a server for which the sender is considered alive
+	// Maximum interval after the receipt of the last message from a server
+	// for which the sender is considered alive (5/4 * HEARTBEAT_INTERVAL,
+	// see DETECTOR_FIXED)
 	ALIVE_INTERVAL = 250 * time.Millisecond
 
-	// Constants for printing error messages to the terminal
-	BOLD_RED = "\033[31;1m"
-	NO_STYLE = "\033[0m"
-	ERROR    = "[" + BOLD_RED + "ERROR" + NO_STYLE + "]"
+	// Maximum duration a connection from another server may go without
+	// sending any data before it is closed (5 * HEARTBEAT_INTERVAL)
+	READ_TIMEOUT = 1000 * time.Millisecond
 )
 
 var (
@@ -75,11 +164,63 @@ var (
 
 	PORT = -1 // server's port number
 
-	// struct containing all received messages in FIFO order
+	EPOCH = time.Now().UnixNano() // start time of the server's process
+
+	ORDER = ORDER_FIFO // delivery order of received messages
+
+	// what to do with messages to a server whose outbound queue is full
+	SEND_POLICY = SEND_POLICY_DROP
+
+	// directory containing the message log (messages are not persisted if
+	// empty) and when records are flushed to stable storage
+	DATA_DIR = ""
+	FSYNC    = FSYNC_INTERVAL
+
+	// whether to catch up on missed messages from other servers on startup
+	SYNC = false
+
+	// address ("host:port") of a server to join through (the server starts
+	// out with the view {0, ..., NUM_PROCS-1} if empty) and the address
+	// other servers use to reach this server (see joinCluster)
+	JOIN_ADDR      = ""
+	ADVERTISE_ADDR = ""
+
+	// failure detector used to decide which servers are alive, and the
+	// phi value at which DETECTOR_PHI considers a server dead
+	DETECTOR      = DETECTOR_FIXED
+	PHI_THRESHOLD = 8.0
+
+	// delivers received messages to MessagesFIFO according to ORDER
+	Orderer orderer
+
+	// struct containing all received messages of the default room in FIFO
+	// order
 	MessagesFIFO tsMsgQueue
 
-	// struct containing the timestamp of the last message from each server
+	// struct containing the other rooms this server is in and their
+	// messages
+	Rooms tsRooms
+
+	// struct recording when the last message from each server was received
+	// and deciding which servers are alive
 	LastTimestamp tsTimestampQueue
+
+	// struct containing a long-lived connection to each server
+	Peers tsPeerConns
+
+	// struct containing the set of servers in the system
+	Membership tsMembership
+
+	// struct restoring the send order of messages from each server
+	Inbound *reorderBuffer
+
+	// serializes broadcasts so that every server receives the messages of
+	// this server in the order they were stamped
+	broadcastMutex sync.Mutex
+
+	// sequence number of the last non-empty message broadcast by this
+	// server to each room (protected by broadcastMutex)
+	lastSeq = make(map[string]uint64)
 )
 
 // Message represents a message sent from one server to another
@@ -87,42 +228,230 @@ type Message struct {
 	Id      int       `json:"id"`  // server id
 	Rts     time.Time `json:"rts"` // real-time timestamp
 	Content string    `json:"msg"` // content of the message
+
+	// room the message was broadcast to ("" for the default room, see
+	// tsRooms)
+	Room string `json:"room,omitempty"`
+
+	// start time (in Unix nanoseconds) of the sender's process and the
+	// position of the message among those it sent to its room (starting at
+	// 1), which identify the message and its send order (heartbeats carry
+	// the position of the last message sent before them)
+	Epoch int64  `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+
+	// type of a control message, which is handled by the server itself
+	// rather than delivered (empty for chat messages and heartbeats)
+	Type string `json:"type,omitempty"`
+
+	// contents of control messages (see sync.go)
+	Digest map[int][]syncRange `json:"digest,omitempty"`
+	Batch  []*Message          `json:"batch,omitempty"`
+	Addr   string              `json:"addr,omitempty"`
+	View   view                `json:"view,omitempty"`
+
+	// contents of SWIM messages (see swim.go)
+	Probe   *swimProbe   `json:"probe,omitempty"`
+	Updates []swimUpdate `json:"updates,omitempty"`
+
+	// digest of the sender's membership view (only set for heartbeats and
+	// SWIM messages)
+	ViewVersion uint64 `json:"vv,omitempty"`
+	ViewHash    uint64 `json:"vh,omitempty"`
+
+	// whether the message is a periodic heartbeat (see FailureDetector)
+	Heartbeat bool `json:"hb,omitempty"`
+
+	// vector timestamp of the send event (only set for non-empty messages
+	// when ORDER is ORDER_CAUSAL)
+	Vts *vector.Timestamp `json:"vts,omitempty"`
+
+	// Lamport timestamp of the send event in base logical.MaxBase (only
+	// set when ORDER is ORDER_TOTAL)
+	Lts string `json:"lts,omitempty"`
+
+	// Ed25519 signature of the sender over the rest of the message (see
+	// encodeMessage)
+	Sig []byte `json:"sig,omitempty"`
 }
 
-// emptyMessage returns an empty message with a timestamp of time.Now()
+// emptyMessage returns an empty message with a timestamp of Clock.Now()
 func emptyMessage() *Message {
 	return &Message{
-		Id:  ID,
-		Rts: time.Now(),
+		Id:    ID,
+		Rts:   Clock.Now(),
+		Epoch: EPOCH,
 	}
 }
 
-// newMessage returns a message with Content msg and a timestamp of time.Now()
+// newMessage returns a message with Content msg and a timestamp of Clock.Now()
 func newMessage(msg string) *Message {
 	return &Message{
 		Id:      ID,
-		Rts:     time.Now(),
+		Rts:     Clock.Now(),
 		Content: msg,
+		Epoch:   EPOCH,
 	}
 }
 
-// init parses and validates command line arguments (by name or position) and
+// setup parses and validates command line arguments (by name or position) and
 // initializes global variables
-func init() {
+func setup() {
 	flag.IntVar(&ID, "id", ID, "id of the server {0, ..., n-1}")
 	flag.IntVar(&NUM_PROCS, "n", NUM_PROCS, "total number of servers")
 	flag.IntVar(&MASTER_PORT, "port", MASTER_PORT, "number of the "+
 		"master-facing port")
+	flag.StringVar(&ORDER, "order", ORDER, "delivery order of received "+
+		"messages {"+ORDER_FIFO+", "+ORDER_CAUSAL+", "+ORDER_TOTAL+"}")
+	flag.StringVar(&SEND_POLICY, "send-policy", SEND_POLICY, "what to do "+
+		"with a message to a server whose outbound queue is full {"+
+		SEND_POLICY_DROP+", "+SEND_POLICY_BLOCK+"}")
+	flag.StringVar(&DATA_DIR, "data-dir", DATA_DIR, "directory in which "+
+		"delivered messages are logged and recovered from on restart "+
+		"(messages are only kept in memory if empty)")
+	flag.StringVar(&FSYNC, "fsync", FSYNC, "when logged messages are "+
+		"flushed to stable storage {"+FSYNC_ALWAYS+", "+
+		FSYNC_INTERVAL+", "+FSYNC_NEVER+"}")
+	flag.BoolVar(&SYNC, "sync", SYNC, "request messages missed while "+
+		"down from the other servers on startup")
+	flag.StringVar(&DETECTOR, "detector", DETECTOR, "failure detector "+
+		"used to decide which servers are alive {"+DETECTOR_FIXED+", "+
+		DETECTOR_PHI+", "+DETECTOR_SWIM+"}")
+	flag.Float64Var(&PHI_THRESHOLD, "phi-threshold", PHI_THRESHOLD,
+		"suspicion level at which the \""+DETECTOR_PHI+"\" failure "+
+			"detector considers a server dead")
+	flag.StringVar(&CONFIG, "config", CONFIG, "path of a JSON file "+
+		"listing the id and address of every server")
+	flag.StringVar(&JOIN_ADDR, "join", JOIN_ADDR, "address (host:port) "+
+		"of the server-facing port of a server to join through")
+	flag.StringVar(&ADVERTISE_ADDR, "advertise", ADVERTISE_ADDR, "address "+
+		"(host:port) other servers use to reach this server after it "+
+		"joins (default: the address used to reach -join)")
+	flag.StringVar(&HTTP_ADDR, "http", HTTP_ADDR, "address (host:port) "+
+		"of an HTTP gateway to the master commands, with a WebSocket "+
+		"stream of messages (disabled if empty)")
+	flag.StringVar(&HTTP_ORIGINS, "http-origins", HTTP_ORIGINS, "comma-"+
+		"separated origins (scheme://host:port) of other web pages "+
+		"that may open the HTTP gateway's stream")
+	flag.StringVar(&METRICS_ADDR, "metrics", METRICS_ADDR, "address "+
+		"(host:port) serving /metrics and /healthz (disabled if empty)")
+	registerTimingFlags()
+	registerTLSFlags()
+	registerSigningFlags()
+	registerLogFlags()
 	flag.Parse()
+	err := applyEnvironment()
+	if err != nil {
+		Fatal("invalid environment", LOG_ERROR, err)
+	}
+	deriveTimings()
+	err = validateTimings()
+	if err != nil {
+		Fatal("invalid timings", LOG_ERROR, err)
+	}
+
+	if CONFIG != "" {
+		n, err := loadConfig(CONFIG)
+		if err != nil {
+			Fatal("failed to load cluster configuration",
+				"path", CONFIG, LOG_ERROR, err)
+		}
+		if NUM_PROCS == -1 {
+			NUM_PROCS = n
+		}
+		if NUM_PROCS != n {
+			Fatal("number of servers does not match the cluster "+
+				"configuration", "servers", NUM_PROCS,
+				"members", n)
+		}
+	}
 
 	setArgsPositional()
 
+	err = setupLogger(os.Stderr)
+	if err != nil {
+		Fatal("failed to set up logging", LOG_ERROR, err)
+	}
+
 	if NUM_PROCS <= 0 {
-		Fatal("invalid number of servers: ", NUM_PROCS)
+		Fatal("invalid number of servers", "servers", NUM_PROCS)
+	}
+	if ID < 0 || ID >= MAX_SERVERS ||
+		(ID >= NUM_PROCS && JOIN_ADDR == "") {
+		Fatal("invalid server id", "id", ID)
+	}
+	if ID >= NUM_PROCS && ORDER == ORDER_CAUSAL {
+		Fatal("server id does not fit in vector clocks", "id", ID,
+			"length", NUM_PROCS)
+	}
+
+	err = loadTLS()
+	if err != nil {
+		Fatal("failed to set up TLS", LOG_ERROR, err)
+	}
+	err = loadSigningKeys()
+	if err != nil {
+		Fatal("failed to load signing keys", LOG_ERROR, err)
+	}
+
+	PORT, err = listenPort()
+	if err != nil {
+		Fatal("invalid address of this server", LOG_ERROR, err)
+	}
+
+	if SEND_POLICY != SEND_POLICY_DROP && SEND_POLICY != SEND_POLICY_BLOCK {
+		Fatal("unknown send policy", "policy", SEND_POLICY)
+	}
+
+	if DATA_DIR != "" {
+		recoverMessages()
+	}
+
+	if JOIN_ADDR == "" {
+		Membership.Init(NUM_PROCS)
+	} else {
+		Membership.Init(0)
+	}
+	if DATA_DIR != "" {
+		err := Rooms.Recover()
+		if err != nil {
+			Fatal("failed to recover rooms", LOG_ERROR, err)
+		}
+	}
+
+	if PHI_THRESHOLD <= 0 {
+		Fatal("invalid phi threshold", "threshold", PHI_THRESHOLD)
 	}
 
-	PORT = START_PORT + ID
-	LastTimestamp.value = make([]time.Time, NUM_PROCS)
+	if DETECTOR == DETECTOR_SWIM {
+		Swim = newSwim()
+	}
+	LastTimestamp.detector, err = newFailureDetector(DETECTOR)
+	if err != nil {
+		Fatal("invalid failure detector", LOG_ERROR, err)
+	}
+	Orderer, err = newOrderer(ORDER)
+	if err != nil {
+		Fatal("invalid order", LOG_ERROR, err)
+	}
+	Inbound = newReorderBuffer(func(msg *Message) { Orderer.Receive(msg) },
+		Rooms.Delivered)
+}
+
+// recoverMessages opens the message log of the default room in DATA_DIR and
+// restores MessagesFIFO from it (see tsRooms.Recover for the other rooms)
+func recoverMessages() {
+	err := os.MkdirAll(DATA_DIR, 0755)
+	if err != nil {
+		Fatal("failed to create data directory", "path", DATA_DIR,
+			LOG_ERROR, err)
+	}
+
+	msgLog, msgs, err := openWAL(roomLogPath(""), FSYNC)
+	if err != nil {
+		Fatal("failed to open message log", LOG_ERROR, err)
+	}
+	MessagesFIFO.Recover(msgLog, msgs)
 }
 
 // setArgsPositional parses the first three command line arguments into ID,
@@ -156,43 +485,67 @@ func setArgsPositional() {
 	}
 }
 
-// Error logs the given error
-func Error(err ...interface{}) {
-	log.Println(ERROR + " " + fmt.Sprint(err...))
-}
-
-// Fail logs the given error and exits with status 1
-func Fatal(err ...interface{}) {
-	log.Fatalln(ERROR + " " + fmt.Sprint(err...))
-}
-
 ///////////////////////////////////////////////////////////////////////////////
 // server                                                                    //
 ///////////////////////////////////////////////////////////////////////////////
 
 func main() {
+	setup()
+
 	// Bind the master-facing and server-facing ports and start listening
 	go serveMaster()
 	go fetchMessages()
-	heartbeat()
+	if JOIN_ADDR != "" {
+		go joinCluster()
+	}
+	if SYNC {
+		go syncMessages()
+	}
+	if Swim != nil {
+		go Swim.run()
+	}
+	if HTTP_ADDR != "" {
+		go serveHTTP()
+	}
+	if METRICS_ADDR != "" {
+		go serveMetrics()
+	}
+	go heartbeat()
+	awaitSignal()
 }
 
-// heartbeat sleeps for HEARTBEAT_INTERVAL and broadcasts an empty message to
-// every server to indicate that the server is still alive
+// heartbeat broadcasts a heartbeat carrying a digest of the membership view
+// (see tsMembership) every HEARTBEAT_INTERVAL, unless DETECTOR is DETECTOR_SWIM
+// and ORDER is not ORDER_TOTAL, and skips messages that Inbound has waited on
+// for too long, until the server starts shutting down
 func heartbeat() {
 	for {
-		time.Sleep(HEARTBEAT_INTERVAL)
-		go broadcast(emptyMessage())
+		select {
+		case <-after(HEARTBEAT_INTERVAL):
+		case <-Stopping:
+			return
+		}
+		if Swim == nil || ORDER == ORDER_TOTAL {
+			msg := emptyMessage()
+			msg.Heartbeat = true
+			msg.ViewVersion, msg.ViewHash = Membership.Digest()
+			broadcast(msg)
+		}
+		Inbound.Expire(Clock.Now())
 	}
 }
 
-// fetchMessages retrieves messages from other servers and adds them to the
-// log, listening on PORT (i.e. START_PORT + PORT)
+// fetchMessages accepts connections from other servers, listening on PORT
+// (i.e. START_PORT + ID), and serves each one in its own thread
 func fetchMessages() {
 	// Bind the server-facing port and listen for messages
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(PORT))
+	ln, err := Network.Listen(":" + strconv.Itoa(PORT))
 	if err != nil {
-		Fatal("failed to bind server-facing port: ", strconv.Itoa(PORT))
+		Fatal("failed to bind server-facing port", "port", PORT,
+			LOG_ERROR, err)
+	}
+	if PeerTLS != nil {
+		ln = tls.NewListener(ln, PeerTLS)
 	}
 
 	for {
@@ -201,206 +554,242 @@ func fetchMessages() {
 			continue
 		}
 
-		handleMessage(conn)
+		go serveConn(conn)
 	}
 }
 
-// handleMessage retrieves the first message from conn, adds it to the log, and
-// closes the connection. It also updates LastTimestamp for the sending server.
+// serveConn retrieves newline-delimited messages from a connection with
+// another server (see peerConn) until it is closed, handling each in the
+// order it was received
+//
+// Each server sends all of its messages to this server over a single
+// connection at a time, so FIFO receipt (which every delivery order builds on,
+// see orderer) mostly follows from TCP ordering. Messages are still passed
+// through Inbound, which restores the send order if a newer connection from a
+// server is handled before an older one.
 //
-// NOTE: This function must be called sequentially (NOT by starting a new
-// thread for each new connection) in order to maintain FIFO receipt.
-// Otherwise, depending on scheduling, a message B may be added to MessagesFIFO
-// before another message A, even though A connected first.
+// A server that dies before terminating a message with a '\n' only blocks its
+// own connection, and only until READ_TIMEOUT passes without any data (every
+// server sends a heartbeat every HEARTBEAT_INTERVAL).
 //
-// The disadvantage is that, if the delivery of a message is blocked (e.g. the
-// sender died before it could terminate the message with a '\n'), then all of
-// the subsequent messages to be delivered are also blocked, possibly FOREVER.
+// Frames longer than MAX_FRAME_SIZE close the connection, and frames from a
+// host that sends more than PEER_RATE_LIMIT of them per second are delayed
+// (see tsRateLimiter).
 //
-// NOTE: If FIFO receipt is no longer necessary, we can simply sort
-// MessagesFIFO by send timestamp in order to approximate the send order. We
-// could also use a causal delivery method provided by a data structure such as
-// the vector.MessageReceptacle to deliver messages based on causal precedence.
-func handleMessage(conn net.Conn) {
+// If PeerTLS is set, the other server is authenticated first (see acceptPeer)
+// and only messages with its id are accepted from it.
+func serveConn(conn net.Conn) {
 	defer conn.Close()
 
-	messenger := bufio.NewReader(conn)
-	msg := new(Message)
-	msgBytes, err := messenger.ReadBytes('\n')
+	sender, err := acceptPeer(conn)
 	if err != nil {
+		Logger.Warn("rejected connection", "addr",
+			conn.RemoteAddr().String(), LOG_ERROR, err)
 		return
 	}
 
-	err = json.Unmarshal(msgBytes, msg)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	messenger := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(Clock.Now().Add(READ_TIMEOUT))
+		msgBytes, err := readFrame(messenger, MAX_FRAME_SIZE)
+		if err == errFrameTooLarge {
+			reject(REJECT_OVERSIZED, err, append(peerFields(sender),
+				"addr", conn.RemoteAddr().String())...)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		handleMessage(msgBytes, sender)
+
+		// a host that sends too fast is slowed down by not reading
+		// from its connections (rather than by losing its messages)
+		delay := PeerLimiter.Reserve(host, PEER_RATE_LIMIT, Clock.Now())
+		sleep(delay)
+	}
+}
+
+// handleMessage decodes a message from another server, updates LastTimestamp
+// for the sending server, and passes the message on to Orderer (through
+// Inbound). Control messages are handled directly.
+//
+// Messages that are invalid, do not claim to be from sender (the
+// authenticated id of the server on the other end of the connection, or -1 if
+// servers are not authenticated) or are not signed by their sender are
+// rejected and counted in Rejected before they touch any other state (see
+// decodeMessage)
+func handleMessage(msgBytes []byte, sender int) {
+	msg, reason, err := decodeMessage(msgBytes, sender)
 	if err != nil {
+		reject(reason, err, peerFields(sender)...)
 		return
 	}
 
 	// Update the heartbeat metadata
-	// NOTE: assumes message IDs are in {0..n-1}
-	LastTimestamp.UpdateTimestamp(msg)
+	LastTimestamp.UpdateTimestamp(msg, Clock.Now())
+	handleViewDigest(msg)
 
-	if len(msg.Content) == 0 { // msg is an empty message
+	switch msg.Type {
+	case MSG_JOIN:
+		handleJoin(msg)
+		return
+	case MSG_VIEW:
+		handleView(msg)
+		return
+	case MSG_LEAVE:
+		handleLeave(msg)
+		return
+	case MSG_SYNC:
+		handleSync(msg)
+		return
+	case MSG_SYNC_REPLY:
+		handleSyncReply(msg, sender)
+		return
+	case MSG_PING, MSG_PING_REQ, MSG_ACK:
+		handleSwim(msg)
 		return
 	}
 
-	MessagesFIFO.Enqueue(msg)
+	// NOTE: empty messages are passed on as well, since they may carry
+	// ordering metadata (e.g. Lamport timestamps)
+	if len(msg.Content) == 0 {
+		Heartbeats.Add("received")
+	}
+	Inbound.Receive(msg, Clock.Now())
 }
 
-// serveMaster listens on MASTER_PORT for a connection from a master process
-// and services its commands
-//
-// NOTE: only one master process is served at any given time
+// serveMaster listens on MASTER_PORT for connections from master processes
+// (e.g. the test master, dashboards and bots) and services the commands of
+// each one in its own thread
 func serveMaster() {
 	// Bind the master-facing port and start listening for commands
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(MASTER_PORT))
+	ln, err := Network.Listen(":" + strconv.Itoa(MASTER_PORT))
 	if err != nil {
-		Fatal("failed to bind master-facing port: ",
-			strconv.Itoa(MASTER_PORT))
+		Fatal("failed to bind master-facing port", "port", MASTER_PORT,
+			LOG_ERROR, err)
+	}
+	if MasterTLS != nil {
+		ln = tls.NewListener(ln, MasterTLS)
+	}
+
+	if !MasterConns.Add(ln) {
+		return
 	}
 
-	masterConn, err := ln.Accept()
 	for {
-		if tcpConnIsClosed(masterConn) {
-			masterConn, err = ln.Accept()
-		}
+		masterConn, err := ln.Accept()
 		if err != nil {
+			if stopping() {
+				return
+			}
 			continue
 		}
 
-		handleMaster(masterConn)
+		go handleMaster(masterConn)
 	}
 }
 
-// handleMaster executes commands from the master process and responds with any
-// requested data
+// handleMaster executes commands from a master process and responds with any
+// requested data (see masterSession) until the connection is closed or a reply
+// cannot be written
+//
+// NOTE: Commands from the same master are executed in the order they were
+// sent, but commands from different masters may be interleaved arbitrarily
+// (e.g. concurrent broadcasts are received by every server in the same order,
+// but not necessarily the order in which they were sent)
 func handleMaster(masterConn net.Conn) {
-	master := bufio.NewReadWriter(
+	session := newMasterSession(bufio.NewReadWriter(
 		bufio.NewReader(masterConn),
-		bufio.NewWriter(masterConn))
+		bufio.NewWriter(masterConn)))
+	session.conn = masterConn
+	defer session.Close()
+	defer masterConn.Close()
+	if !MasterConns.Add(masterConn) {
+		return
+	}
+	defer MasterConns.Remove(masterConn)
 
 	for {
-		command, err := master.ReadString('\n')
+		line, err := session.rwr.ReadString('\n')
 		if err != nil {
 			// connection to master lost
 			return
 		}
 
-		command = strings.TrimSpace(command)
-		switch command {
-		case "get":
-			writeMessages(master)
-		case "alive":
-			writeAlive(master)
-		default:
-			broadcastComm := "broadcast "
-			if !strings.HasPrefix(command, broadcastComm) {
-				Error("unrecognized command: \"", command, "\"")
-				continue
-			}
-
-			message := command[len(broadcastComm):]
-			broadcast(newMessage(message))
+		err = session.handle(line)
+		if err != nil {
+			// connection to master lost (which only ends this
+			// session)
+			Logger.Info("closing master session",
+				"addr", masterConn.RemoteAddr().String(),
+				LOG_ERROR, err)
+			return
 		}
 	}
 }
 
-func writeMessages(rwr *bufio.ReadWriter) {
-	rwr.WriteString("messages ")
-	MessagesFIFO.WriteMessages(rwr)
-	rwr.WriteByte('\n')
-
-	err := rwr.Flush()
-	if err != nil {
-		Fatal(err)
-	}
-}
-
-func writeAlive(rwr *bufio.ReadWriter) {
-	now := time.Now()
-
-	rwr.WriteString("alive ")
-	LastTimestamp.WriteAlive(rwr, now)
-	rwr.WriteByte('\n')
-
-	err := rwr.Flush()
-	if err != nil {
-		Fatal(err)
-	}
-}
-
-// broadcast sends the given message to all other servers (including itself and
-// excluding the master)
-//
-// NOTE: Sends are sequential, so that broadcast does not return until an
-// attempt has been made to send the message to all servers
-//
-// NOTE: This function must be called sequentially (NOT by starting a new
-// thread for each new message) in order to maintain FIFO receipt. Otherwise,
-// depending on scheduling, a message B could be broadcast to a server before
-// another message A, even though A's thread was started first.
+// broadcast adds the given message to the outbound queue (see peerConn) of
+// every server in its room (including itself and excluding the master), so it
+// never waits on the network
 //
-// The disadvantage is that, if the receipt of one message is delayed for any
-// of its recipients, then all of the subsequent commands sent by the master
-// are also delayed (until the send times out). This may cause servers to not
-// receive the message on time. This is likely not an issue when working with a
-// small number of servers.
+// NOTE: Broadcasts are serialized by broadcastMutex, so every server receives
+// messages in the order they were stamped. However, callers that need FIFO
+// receipt must still call this function sequentially (NOT by starting a new
+// thread for each new message). Otherwise, depending on scheduling, a message
+// B could be broadcast to a server before another message A, even though A's
+// thread was started first.
 //
 // NOTE: If FIFO receipt is no longer necessary, the recipient can simply sort
 // delivered messages by send timestamp in order to approximate the send order.
 // They could also use a causal delivery method provided by a data structure
 // such as the vector.MessageReceptacle to deliver messages based on causal
-// precedence.
+// precedence (see the "-order" flag).
 func broadcast(msg *Message) {
-	// Convert to JSON
-	msgBytes, err := json.Marshal(msg)
+	broadcastMutex.Lock()
+	defer broadcastMutex.Unlock()
+
+	// heartbeats are not numbered, so that the messages in the log of a
+	// room are numbered consecutively (see tsMsgQueue.Digest)
+	if len(msg.Content) != 0 {
+		lastSeq[msg.Room]++
+	}
+	msg.Seq = lastSeq[msg.Room]
+	Orderer.Stamp(msg)
+
+	// Convert to JSON (and sign)
+	msgBytes, err := encodeMessage(msg)
 	if err != nil {
+		Logger.Error("failed to encode message", LOG_ERROR, err)
 		return
 	}
-	msgJSON := string(msgBytes)
 
 	// send non-empty messages to self
 	if len(msg.Content) != 0 {
-		MessagesFIFO.Enqueue(msg)
+		Broadcasts.Add(msg.Room)
+		Orderer.Receive(msg)
 	}
 
-	// send message to other servers
-	for id := 0; id < NUM_PROCS; id++ {
-		if id == ID {
-			continue
+	// send message to the other servers in its room (see tsRooms for why
+	// causal delivery needs every server)
+	recipients := Membership.Subscribers(msg.Room)
+	if ORDER == ORDER_CAUSAL {
+		recipients = Membership.Peers()
+	}
+	for _, id := range recipients {
+		send(msgBytes, id)
+		if len(msg.Content) == 0 {
+			Heartbeats.Add("sent")
 		}
-
-		send(msgJSON, id)
 	}
 }
 
 // send a message to the server with the given id
 //
-// establishes a connection with the server if none exists and reestablishes
-// one if
-func send(msg string, id int) error {
-	// NOTE: In the future, you may want to consider using
-	// net.DialTimeout (e.g. the recipient is so busy it cannot
-	// service the send in a reasonable amount of time) and/or
-	// consider starting a new thread for every send to prevent
-	// sends from blocking each other (the timeout might help
-	// prevent a buildup of threads that can't progress)
-	conn, err := net.Dial("tcp", ":"+strconv.Itoa(START_PORT+id))
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	_, err = fmt.Fprintln(conn, msg)
-	return err
-}
-
-func tcpConnIsClosed(conn net.Conn) bool {
-	one := []byte{}
-	if _, err := conn.Read(one); err == io.EOF {
-		conn.Close()
-		return true
-	}
-
-	return false
+// The message is added to the outbound queue of the server and written by its
+// writer thread, which establishes a connection with the server if none exists
+// and reestablishes one if the previous connection failed (see peerConn)
+func send(msg []byte, id int) error {
+	return Peers.Get(id).Send(msg)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Maximum duration a graceful shutdown waits for the messages queued for other
+// servers to be written (see registerTimingFlags)
+var SHUTDOWN_TIMEOUT = 2 * time.Second
+
+var (
+	// closed once this server starts shutting down, which stops its
+	// heartbeats (or SWIM probes)
+	Stopping = make(chan struct{})
+
+	// listeners and connections that accept master commands, which are
+	// closed when this server starts shutting down
+	MasterConns tsClosers
+)
+
+// awaitSignal waits for SIGTERM (or SIGINT), shuts the server down gracefully
+// and exits
+//
+// A second signal during the shutdown exits at once.
+func awaitSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	signal.Stop(signals)
+
+	Logger.Info("shutting down", "signal", sig.String())
+	shutdown()
+	Logger.Info("shut down")
+	os.Exit(0)
+}
+
+// shutdown stops this server without it looking like a crash to the others:
+//
+//  1. heartbeats (or SWIM probes) stop
+//  2. master commands are no longer accepted, and masters are disconnected
+//  3. every other server is told that this server is leaving (see
+//     announceLeave)
+//  4. the messages queued for other servers (including the announcement)
+//     are written, waiting up to SHUTDOWN_TIMEOUT
+//  5. the message logs are flushed and closed
+//
+// Unlike the "leave" command, the server stays in the membership view, so it is
+// alive again as soon as it restarts.
+func shutdown() {
+	close(Stopping)
+	MasterConns.CloseAll()
+
+	announceLeave()
+	if !Peers.Drain(Clock.Now().Add(SHUTDOWN_TIMEOUT)) {
+		Logger.Warn("gave up waiting for queued messages to be written",
+			"timeout", SHUTDOWN_TIMEOUT)
+	}
+
+	err := Rooms.Close()
+	if err != nil {
+		Logger.Error("failed to close message logs", LOG_ERROR, err)
+	}
+}
+
+// announceLeave sends a MSG_LEAVE to every other server in the view
+//
+// With SWIM, the message also carries an update that declares this server
+// dead at its current incarnation, which its next incarnation overrides.
+func announceLeave() {
+	msg := emptyMessage()
+	msg.Type = MSG_LEAVE
+	if Swim != nil {
+		Swim.mutex.Lock()
+		msg.Updates = []swimUpdate{{ID, SWIM_DEAD, Swim.incarnation}}
+		Swim.mutex.Unlock()
+	}
+	msgBytes, err := encodeMessage(msg)
+	if err != nil {
+		Logger.Error("failed to encode leave announcement",
+			LOG_ERROR, err)
+		return
+	}
+	for _, id := range Membership.Peers() {
+		send(msgBytes, id)
+	}
+}
+
+// handleLeave stops considering the sender of a MSG_LEAVE alive
+func handleLeave(msg *Message) {
+	if Swim != nil {
+		for _, update := range msg.Updates {
+			if update.Id == msg.Id && update.State == SWIM_DEAD {
+				Swim.apply(update)
+			}
+		}
+	}
+	LastTimestamp.Forget(msg.Id)
+	Logger.Info("server is shutting down", LOG_PEER, msg.Id)
+}
+
+// stopping returns whether this server has started shutting down
+func stopping() bool {
+	select {
+	case <-Stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// tsClosers is a set of listeners and connections that are closed together
+type tsClosers struct {
+	value  map[io.Closer]bool
+	closed bool       // whether CloseAll was called
+	mutex  sync.Mutex // mutex for accessing contents
+}
+
+// Add adds closer to the set and returns true, unless CloseAll was already
+// called, in which case closer is closed and false is returned
+func (tsc *tsClosers) Add(closer io.Closer) bool {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	if tsc.closed {
+		closer.Close()
+		return false
+	}
+	if tsc.value == nil {
+		tsc.value = make(map[io.Closer]bool)
+	}
+	tsc.value[closer] = true
+	return true
+}
+
+// Remove removes closer from the set (without closing it)
+func (tsc *tsClosers) Remove(closer io.Closer) {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+	delete(tsc.value, closer)
+}
+
+// CloseAll closes every member of the set, as well as any that are added
+// later
+func (tsc *tsClosers) CloseAll() {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	tsc.closed = true
+	for closer := range tsc.value {
+		closer.Close()
+	}
+	tsc.value = nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandleLeave(t *testing.T) {
+	Inbound = newReorderBuffer(func(msg *Message) {}, nil)
+	for _, name := range []string{DETECTOR_FIXED, DETECTOR_PHI} {
+		detector, _ := newFailureDetector(name)
+		LastTimestamp = tsTimestampQueue{detector: detector}
+
+		handleMessage([]byte(`{"id": 3}`), -1)
+		if !LastTimestamp.Alive(3, time.Now()) {
+			t.Fatalf("%s: server 3 not alive after a heartbeat",
+				name)
+		}
+		handleMessage([]byte(`{"id": 3, "type": "leave"}`), -1)
+		if LastTimestamp.Alive(3, time.Now()) {
+			t.Errorf("%s: server 3 still alive after leaving", name)
+		}
+		handleMessage([]byte(`{"id": 3}`), -1)
+		if !LastTimestamp.Alive(3, time.Now()) {
+			t.Errorf("%s: server 3 not alive after it restarted",
+				name)
+		}
+	}
+}
+
+func TestPeerConnsDrain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	Membership = tsMembership{}
+	Membership.Init(0)
+	Membership.Add(7, ln.Addr().String())
+
+	var peers tsPeerConns
+	for _, msg := range []string{"a", "b", "c"} {
+		peers.Get(7).Send([]byte(msg))
+	}
+	if !peers.Drain(time.Now().Add(5 * time.Second)) {
+		t.Fatal("queued messages were not written in time")
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"a\n", "b\n", "c\n"} {
+		line, err := reader.ReadString('\n')
+		if line != want {
+			t.Fatalf("read %q (%v), want %q", line, err, want)
+		}
+	}
+}
+
+func TestClosers(t *testing.T) {
+	var closers tsClosers
+	a, b := new(testCloser), new(testCloser)
+	closers.Add(a)
+	closers.Add(b)
+	closers.Remove(b)
+	closers.CloseAll()
+	if !a.closed || b.closed {
+		t.Fatalf("closed a: %v, b: %v, want only a", a.closed, b.closed)
+	}
+
+	c := new(testCloser)
+	if closers.Add(c) || !c.closed {
+		t.Fatal("a closer added after CloseAll was not closed")
+	}
+}
+
+// testCloser records whether it was closed
+type testCloser struct {
+	closed bool
+}
+
+func (tc *testCloser) Close() error {
+	tc.closed = true
+	return nil
+}
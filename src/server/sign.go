@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"os"
+	"strconv"
+)
+
+var (
+	// path of the PEM-encoded (PKCS #8) Ed25519 private key this server
+	// signs its messages with, and of the JSON file listing the public key
+	// of every server (see publicKeySet); messages are neither signed nor
+	// verified if they are empty
+	SIGNING_KEY = ""
+	PUBLIC_KEYS = ""
+
+	// key this server signs its messages with (nil if messages are not
+	// signed)
+	signingKey ed25519.PrivateKey
+
+	// public key of each server, keyed by id (nil if messages are not
+	// verified)
+	publicKeys map[int]ed25519.PublicKey
+)
+
+// publicKeySet is the format of the JSON file given by the -public-keys flag,
+// which lists the base64-encoded Ed25519 public key of every server:
+//
+//	{
+//	  "keys": [
+//	    {"id": 0, "key": "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+//	    {"id": 1, "key": "PUAXw+hDiVqStwqnTRt+vJyYLM8uxJaMwM1V8Sr0Zgw="}
+//	  ]
+//	}
+//
+// Servers that join later must be listed as well, since their messages are
+// rejected otherwise.
+type publicKeySet struct {
+	Keys []struct {
+		Id  int    `json:"id"`
+		Key []byte `json:"key"`
+	} `json:"keys"`
+}
+
+// registerSigningFlags defines the flags that enable message signing
+func registerSigningFlags() {
+	flag.StringVar(&SIGNING_KEY, "signing-key", SIGNING_KEY, "path of the "+
+		"PEM (PKCS #8) Ed25519 private key this server signs its "+
+		"messages with")
+	flag.StringVar(&PUBLIC_KEYS, "public-keys", PUBLIC_KEYS, "path of a "+
+		"JSON file listing the Ed25519 public key of every server, "+
+		"which messages are verified against")
+}
+
+// loadSigningKeys sets signingKey and publicKeys according to SIGNING_KEY and
+// PUBLIC_KEYS
+func loadSigningKeys() error {
+	if SIGNING_KEY == "" && PUBLIC_KEYS == "" {
+		return nil
+	}
+	if SIGNING_KEY == "" || PUBLIC_KEYS == "" {
+		return errors.New("-signing-key and -public-keys must be " +
+			"given together")
+	}
+
+	keyPEM, err := os.ReadFile(SIGNING_KEY)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return errors.New("no PEM data in " + SIGNING_KEY)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	privateKey, isEd25519 := key.(ed25519.PrivateKey)
+	if !isEd25519 {
+		return errors.New(SIGNING_KEY + " is not an Ed25519 key")
+	}
+
+	setBytes, err := os.ReadFile(PUBLIC_KEYS)
+	if err != nil {
+		return err
+	}
+	var set publicKeySet
+	err = json.Unmarshal(setBytes, &set)
+	if err != nil {
+		return err
+	}
+	keys := make(map[int]ed25519.PublicKey)
+	for _, entry := range set.Keys {
+		if len(entry.Key) != ed25519.PublicKeySize {
+			return errors.New("invalid public key of server " +
+				strconv.Itoa(entry.Id))
+		}
+		keys[entry.Id] = ed25519.PublicKey(entry.Key)
+	}
+
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	if !bytes.Equal(keys[ID], publicKey) {
+		return errors.New("the public key of server " +
+			strconv.Itoa(ID) + " does not match " + SIGNING_KEY)
+	}
+	signingKey, publicKeys = privateKey, keys
+	return nil
+}
+
+// encodeMessage signs msg (if signingKey is set) and returns its encoding
+//
+// The signature covers the encoding of msg without the signature, which the
+// receiver reproduces by encoding the message it decoded (see verifyMessage)
+func encodeMessage(msg *Message) ([]byte, error) {
+	if signingKey != nil {
+		msg.Sig = nil
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		msg.Sig = ed25519.Sign(signingKey, body)
+	}
+	return json.Marshal(msg)
+}
+
+// verifyMessage checks the signature of msg against the public key of its
+// sender (if publicKeys is set) and returns the REJECT_* reason it fails, or
+// "" if it does not
+//
+// NOTE: messages logged before signing was enabled are not signed, so they
+// cannot be synced to servers that verify messages
+func verifyMessage(msg *Message) string {
+	if publicKeys == nil {
+		return ""
+	}
+	key, isPresent := publicKeys[msg.Id]
+	if !isPresent {
+		return REJECT_UNKNOWN_KEY
+	}
+	if len(msg.Sig) == 0 {
+		return REJECT_UNSIGNED
+	}
+
+	sig := msg.Sig
+	msg.Sig = nil
+	body, err := json.Marshal(msg)
+	msg.Sig = sig
+	if err != nil || !ed25519.Verify(key, body, sig) {
+		return REJECT_FORGED
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sfurman3/chatroom/vector"
+)
+
+// setupTestKeys makes every server in {0, ..., n-1} sign with its own key and
+// returns the keys
+func setupTestKeys(t *testing.T, n int) []ed25519.PrivateKey {
+	t.Helper()
+	keys := make([]ed25519.PrivateKey, n)
+	publicKeys = make(map[int]ed25519.PublicKey)
+	for id := range keys {
+		public, private, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[id], publicKeys[id] = private, public
+	}
+	signingKey = keys[0]
+	t.Cleanup(func() { signingKey, publicKeys = nil, nil })
+	return keys
+}
+
+// decode returns the message received by decoding msgBytes
+func decode(t *testing.T, msgBytes []byte) *Message {
+	t.Helper()
+	msg := new(Message)
+	err := json.Unmarshal(msgBytes, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSignedMessageRoundTrip(t *testing.T) {
+	setupTestKeys(t, 2)
+
+	msg := newMessage("hello, é <world>")
+	msg.Room = "ops"
+	msg.Rts = time.Date(2020, 1, 2, 3, 4, 5, 600, time.FixedZone("", 3600))
+	msg.Vts = &vector.Timestamp{Id: 1, Vector: []string{"1", "a"}}
+	msg.Digest = map[int][]syncRange{1: {{syncMark{1, 2}, syncMark{1, 4}}},
+		0: {{To: syncMark{3, 4}}}}
+	msg.Batch = []*Message{{Id: 1, Seq: 1, Content: "relayed"}}
+	msgBytes, err := encodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reason := verifyMessage(decode(t, msgBytes)); reason != "" {
+		t.Fatalf("a signed message was rejected: %v", reason)
+	}
+
+	tampered := decode(t, msgBytes)
+	tampered.Content = "goodbye"
+	if reason := verifyMessage(tampered); reason != REJECT_FORGED {
+		t.Errorf("tampered message: %q, want %q", reason, REJECT_FORGED)
+	}
+
+	impostor := decode(t, msgBytes)
+	impostor.Id = 1
+	if reason := verifyMessage(impostor); reason != REJECT_FORGED {
+		t.Errorf("message signed by another server: %q, want %q",
+			reason, REJECT_FORGED)
+	}
+
+	unsigned := decode(t, msgBytes)
+	unsigned.Sig = nil
+	if reason := verifyMessage(unsigned); reason != REJECT_UNSIGNED {
+		t.Errorf("unsigned message: %q, want %q", reason,
+			REJECT_UNSIGNED)
+	}
+
+	unknown := decode(t, msgBytes)
+	unknown.Id = 2
+	if reason := verifyMessage(unknown); reason != REJECT_UNKNOWN_KEY {
+		t.Errorf("message from an unknown server: %q, want %q", reason,
+			REJECT_UNKNOWN_KEY)
+	}
+}
+
+func TestHandleMessageRejectsInvalidMessages(t *testing.T) {
+	setupTestKeys(t, 2)
+	Rejected = tsCounters{}
+
+	// none of these messages may reach any state (e.g. LastTimestamp,
+	// which is not set up)
+	for _, line := range []string{
+		`{"id": 1`,
+		`{"id": -1}`,
+		`{"id": 100000000000}`,
+		`{"id": 5, "sig": "AAAA"}`,
+		`{"id": 1}`,
+		`{"id": 1, "sig": "AAAA"}`,
+	} {
+		handleMessage([]byte(line), -1)
+	}
+
+	want := map[string]uint64{REJECT_MALFORMED: 1, REJECT_INVALID_ID: 2,
+		REJECT_UNKNOWN_KEY: 1, REJECT_UNSIGNED: 1, REJECT_FORGED: 1}
+	counts := Rejected.Counts()
+	for reason, n := range want {
+		if counts[reason] != n {
+			t.Errorf("%d messages rejected as %s, want %d (%v)",
+				counts[reason], reason, n, counts)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of messages pushed to a subscriber before its connection is
+// flushed
+const SUBSCRIBE_BATCH_SIZE = 64
+
+// masterEvent is a message pushed to a subscriber in MASTER_PROTOCOL_V2, e.g.
+//
+//	{"event": "message", "room": "ops", "message": {"pos": 3, ...}}
+//
+// In MASTER_PROTOCOL_V1 the same message is pushed as
+// "message #ops 3 <content>\n" (or "message 3 <content>\n" for the default
+// room).
+type masterEvent struct {
+	Event   string      `json:"event"` // always "message"
+	Room    string      `json:"room,omitempty"`
+	Message messageView `json:"message"`
+}
+
+// parseSubscribeArg parses "[#<room>] [<from>]"
+func parseSubscribeArg(arg string, req *masterRequest) error {
+	fields := strings.Fields(arg)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], ROOM_PREFIX) {
+		err := parseRoomArg(false)(fields[0], req)
+		if err != nil {
+			return err
+		}
+		fields = fields[1:]
+	}
+	switch len(fields) {
+	case 0:
+	case 1:
+		from, err := strconv.Atoi(fields[0])
+		if err != nil || from < 0 {
+			return newMasterError(ERR_INVALID_ARGUMENT,
+				"invalid position: ", strconv.Quote(fields[0]))
+		}
+		req.From = &from
+	default:
+		return newMasterError(ERR_INVALID_ARGUMENT,
+			"unexpected argument")
+	}
+	return nil
+}
+
+// runSubscribe starts pushing the messages of a room to the session from the
+// log of the room as it keeps up (so a slow subscriber only falls behind, until
+// a push takes longer than MASTER_WRITE_TIMEOUT), beginning at position
+// req.From (or at the next message if it is not given), and returns the
+// position of the first message it pushes
+func runSubscribe(session *masterSession,
+	req *masterRequest) (interface{}, error) {
+
+	msgLog := Rooms.Log(req.Room)
+	if msgLog == nil {
+		return nil, newMasterError(ERR_NOT_JOINED, "not in room ",
+			req.Room)
+	}
+	if _, isPresent := session.subscriptions[req.Room]; isPresent {
+		return nil, newMasterError(ERR_INVALID_ARGUMENT,
+			"already subscribed to room ", strconv.Quote(req.Room))
+	}
+
+	first, from := msgLog.Bounds()
+	if req.From != nil {
+		if *req.From > from {
+			return nil, newMasterError(ERR_INVALID_ARGUMENT,
+				"position ", *req.From,
+				" is past the end of the log (", from, ")")
+		}
+		// messages before first were compacted
+		from = max(*req.From, first)
+	}
+
+	cancel := make(chan struct{})
+	session.subscriptions[req.Room] = cancel
+	session.started = append(session.started, func() {
+		session.streams.Add(1)
+		go func() {
+			defer session.streams.Done()
+			session.stream(req.Room, msgLog, from, cancel)
+		}()
+	})
+	return map[string]interface{}{"room": req.Room, "from": from}, nil
+}
+
+func textSubscribe(req *masterRequest, result interface{}) string {
+	return "subscribed " +
+		strconv.Itoa(result.(map[string]interface{})["from"].(int))
+}
+
+// runUnsubscribe stops pushing the messages of a room to the session
+//
+// No messages of the room are pushed after the reply
+func runUnsubscribe(session *masterSession,
+	req *masterRequest) (interface{}, error) {
+
+	cancel, isPresent := session.subscriptions[req.Room]
+	if !isPresent {
+		return nil, newMasterError(ERR_INVALID_ARGUMENT,
+			"not subscribed to room ", strconv.Quote(req.Room))
+	}
+	close(cancel)
+	delete(session.subscriptions, req.Room)
+	return nil, nil
+}
+
+// stream pushes the messages of msgLog to the session, starting at position
+// pos, until the subscription is canceled or the session ends
+func (session *masterSession) stream(room string, msgLog *tsMsgQueue, pos int,
+	cancel <-chan struct{}) {
+
+	for {
+		// a subscriber that falls behind the retention limits of the
+		// room skips the messages that were compacted
+		msgs, start, changed := msgLog.Since(pos, SUBSCRIBE_BATCH_SIZE)
+		pos = start
+		if len(msgs) == 0 {
+			select {
+			case <-changed:
+				continue
+			case <-cancel:
+				return
+			case <-session.done:
+				return
+			}
+		}
+
+		err := session.push(room, pos, msgs, cancel)
+		if err != nil {
+			// the session ends once its reader notices the closed
+			// connection
+			Logger.Info("disconnecting subscriber", "room", room,
+				LOG_ERROR, err)
+			if session.conn != nil {
+				session.conn.Close()
+			}
+			return
+		}
+		pos += len(msgs)
+	}
+}
+
+// push writes msgs (starting at position pos of the log of room) to the
+// session and flushes them within MASTER_WRITE_TIMEOUT, unless the
+// subscription was canceled
+func (session *masterSession) push(room string, pos int, msgs []*Message,
+	cancel <-chan struct{}) error {
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	select {
+	case <-cancel:
+		return nil
+	default:
+	}
+
+	session.setWriteDeadline()
+	for i, msg := range msgs {
+		view := newMessageView(msg, pos+i)
+		if session.version == MASTER_PROTOCOL_V2 {
+			encoder := json.NewEncoder(session.rwr)
+			encoder.SetEscapeHTML(false)
+			event := masterEvent{"message", room, view}
+			err := encoder.Encode(event)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		session.rwr.WriteString("message ")
+		if room != "" {
+			session.rwr.WriteString(ROOM_PREFIX + room + " ")
+		}
+		session.rwr.WriteString(strconv.Itoa(view.Pos) + " " +
+			view.Content + "\n")
+	}
+	return session.rwr.Flush()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMsgQueueSince(t *testing.T) {
+	var tsq tsMsgQueue
+	tsq.Enqueue(&Message{Id: 0, Seq: 1, Content: "a"})
+
+	msgs, _, changed := tsq.Since(0, 10)
+	if len(msgs) != 1 || changed != nil {
+		t.Fatalf("Since(0) = %v, %v", msgs, changed)
+	}
+
+	msgs, _, changed = tsq.Since(1, 10)
+	if len(msgs) != 0 || changed == nil {
+		t.Fatalf("Since(1) = %v, %v", msgs, changed)
+	}
+	tsq.Enqueue(&Message{Id: 0, Seq: 2, Content: "b"})
+	select {
+	case <-changed:
+	default:
+		t.Fatal("adding a message did not close the changed channel")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	MessagesFIFO = tsMsgQueue{}
+	MessagesFIFO.Enqueue(&Message{Id: 1, Seq: 1, Content: "a"})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleMaster(server)
+	rwr := bufio.NewReadWriter(bufio.NewReader(client),
+		bufio.NewWriter(client))
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	expect := func(want string) {
+		t.Helper()
+		line, err := rwr.ReadString('\n')
+		if err != nil || line != want+"\n" {
+			t.Fatalf("got %q (error %v), want %q", line, err, want)
+		}
+	}
+
+	rwr.WriteString("subscribe 0\n")
+	rwr.Flush()
+	expect("subscribed 0")
+	expect("message 0 a")
+
+	MessagesFIFO.Enqueue(&Message{Id: 1, Seq: 2, Content: "b"})
+	expect("message 1 b")
+
+	// nothing is pushed after the subscription is canceled
+	rwr.WriteString("unsubscribe\nrooms\n")
+	rwr.Flush()
+	expect("rooms ")
+	MessagesFIFO.Enqueue(&Message{Id: 1, Seq: 3, Content: "c"})
+	rwr.WriteString("rooms\n")
+	rwr.Flush()
+	expect("rooms ")
+}
+
+func TestSubscriberDisconnected(t *testing.T) {
+	MessagesFIFO = tsMsgQueue{}
+	MessagesFIFO.Enqueue(&Message{Id: 1, Seq: 1, Content: "a"})
+	timeout := MASTER_WRITE_TIMEOUT
+	defer func() { MASTER_WRITE_TIMEOUT = timeout }()
+	MASTER_WRITE_TIMEOUT = 50 * time.Millisecond
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleMaster(server)
+		close(done)
+	}()
+	reader := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("subscribe 0\n"))
+	line, err := reader.ReadString('\n')
+	if line != "subscribed 0\n" {
+		t.Fatalf("got %q (error %v), want \"subscribed 0\"", line, err)
+	}
+
+	// the subscriber stops reading, so the push of a is never written
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a subscriber that stopped reading was not " +
+			"disconnected")
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Types of the control messages used by the SWIM protocol (see swim)
+const (
+	// direct probe of the recipient (the Probe field)
+	MSG_PING = "ping"
+
+	// request that the recipient probe Probe.Target on behalf of
+	// Probe.Origin
+	MSG_PING_REQ = "ping-req"
+
+	// reply to a MSG_PING, which is forwarded to Probe.Origin if it was
+	// sent on behalf of another server
+	MSG_ACK = "ack"
+)
+
+// States of a server in the SWIM membership list
+const (
+	SWIM_ALIVE   = "alive"
+	SWIM_SUSPECT = "suspect"
+	SWIM_DEAD    = "dead"
+)
+
+const (
+	// Number of servers asked to probe a server that did not reply to a
+	// direct probe
+	SWIM_INDIRECT_PROBES = 3
+
+	// Number of protocol periods a server stays suspected before it is
+	// declared dead
+	SWIM_SUSPECT_PERIODS = 3
+
+	// Maximum number of membership updates piggybacked on each message
+	SWIM_MAX_PIGGYBACK = 8
+
+	// Multiplier of log2(n+1) that gives the number of times each update is
+	// piggybacked (n is the number of servers)
+	SWIM_RETRANSMIT_MULT = 3
+)
+
+// Duration of a SWIM protocol period, in which one server is probed
+// (HEARTBEAT_INTERVAL, see registerTimingFlags)
+var SWIM_PERIOD = 200 * time.Millisecond
+
+// swimProbe identifies a probe of Target by Origin
+type swimProbe struct {
+	Seq    uint64 `json:"seq"`
+	Target int    `json:"target"`
+	Origin int    `json:"origin"`
+
+	// incarnation of the sender of the message carrying the probe
+	Incarnation uint64 `json:"inc"`
+}
+
+// swimUpdate is a change in the state of a server, which is disseminated by
+// piggybacking it on SWIM messages
+type swimUpdate struct {
+	Id          int    `json:"id"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"inc"`
+}
+
+// swimMember is the state of a server in the SWIM membership list
+type swimMember struct {
+	state        string
+	incarnation  uint64
+	suspectSince time.Time
+}
+
+// swim is an implementation of the SWIM failure detection and membership
+// protocol (Das, Gupta and Motivala, 2002), which replaces all-to-all
+// heartbeats when DETECTOR is DETECTOR_SWIM
+//
+// Every SWIM_PERIOD, the next server in a shuffled round-robin order is pinged
+// directly. If it does not ack within a third of the period,
+// SWIM_INDIRECT_PROBES other servers are asked to ping it as well. If no ack
+// arrives by the end of the period, the server is suspected, and a suspected
+// server that does not refute the suspicion within SWIM_SUSPECT_PERIODS
+// periods is declared dead.
+//
+// Changes in state are piggybacked on pings and acks rather than broadcast. A
+// server refutes a suspicion by incrementing its incarnation number, which
+// starts out as EPOCH so that a restarted server supersedes its previous
+// process.
+type swim struct {
+	members     map[int]*swimMember // state of every other known server
+	incarnation uint64              // incarnation of this server
+
+	// updates to piggyback and the number of times each was sent, keyed by
+	// the id of the server they are about
+	updates map[int]*pendingUpdate
+
+	order   []int // round-robin order of servers to probe
+	nextIdx int   // index of the next server to probe in order
+
+	probeSeq uint64                 // sequence number of the last probe
+	acks     map[uint64]chan bool   // waiting probes of this server
+	relays   map[uint64]*relayProbe // probes made on behalf of others
+
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// pendingUpdate is an update waiting to be piggybacked
+type pendingUpdate struct {
+	update swimUpdate
+	sent   int
+}
+
+// relayProbe is a probe made on behalf of another server, whose ack must be
+// forwarded to it
+type relayProbe struct {
+	origin   int
+	seq      uint64
+	deadline time.Time
+}
+
+// Swim is the SWIM protocol state of this server (nil unless DETECTOR is
+// DETECTOR_SWIM)
+var Swim *swim
+
+// newSwim returns the SWIM state of this server, which considers every server
+// in the membership view alive until proven otherwise
+func newSwim() *swim {
+	sw := &swim{
+		members:     make(map[int]*swimMember),
+		incarnation: uint64(EPOCH),
+		updates:     make(map[int]*pendingUpdate),
+		acks:        make(map[uint64]chan bool),
+		relays:      make(map[uint64]*relayProbe),
+	}
+	for _, id := range Membership.Peers() {
+		sw.members[id] = &swimMember{state: SWIM_ALIVE}
+	}
+	sw.enqueue(swimUpdate{ID, SWIM_ALIVE, sw.incarnation})
+	return sw
+}
+
+// run probes one server every SWIM_PERIOD until this server starts shutting
+// down
+func (sw *swim) run() {
+	for {
+		start := Clock.Now()
+		target, isPresent := sw.nextTarget()
+		if isPresent {
+			sw.probe(target, start.Add(SWIM_PERIOD))
+		}
+		sw.expireSuspects(Clock.Now())
+		select {
+		case <-after(start.Add(SWIM_PERIOD).Sub(Clock.Now())):
+		case <-Stopping:
+			return
+		}
+	}
+}
+
+// nextTarget returns the next server to probe, reshuffling the round-robin
+// order once every server was probed
+//
+// Servers that are dead or not in the membership view are never probed
+func (sw *swim) nextTarget() (int, bool) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		for sw.nextIdx < len(sw.order) {
+			id := sw.order[sw.nextIdx]
+			sw.nextIdx++
+			m, isPresent := sw.members[id]
+			if Membership.Contains(id) &&
+				(!isPresent || m.state != SWIM_DEAD) {
+				return id, true
+			}
+		}
+
+		sw.order = Membership.Peers()
+		rand.Shuffle(len(sw.order), func(i, j int) {
+			sw.order[i], sw.order[j] = sw.order[j], sw.order[i]
+		})
+		sw.nextIdx = 0
+	}
+	return 0, false
+}
+
+// probe pings target and, if it does not ack in time, asks other servers to
+// ping it. The target is suspected if no ack arrives before deadline.
+func (sw *swim) probe(target int, deadline time.Time) {
+	sw.mutex.Lock()
+	sw.probeSeq++
+	probe := swimProbe{Seq: sw.probeSeq, Target: target, Origin: ID}
+	ack := make(chan bool, 1)
+	sw.acks[probe.Seq] = ack
+	sw.mutex.Unlock()
+
+	defer func() {
+		sw.mutex.Lock()
+		delete(sw.acks, probe.Seq)
+		sw.mutex.Unlock()
+	}()
+
+	sw.send(MSG_PING, target, probe)
+	if waitAck(ack, Clock.Now().Add(SWIM_PERIOD/3)) {
+		return
+	}
+
+	for _, id := range sw.randomPeers(SWIM_INDIRECT_PROBES, target) {
+		sw.send(MSG_PING_REQ, id, probe)
+	}
+	if waitAck(ack, deadline) {
+		return
+	}
+
+	sw.mutex.Lock()
+	m := sw.member(target)
+	sw.mutex.Unlock()
+	sw.apply(swimUpdate{target, SWIM_SUSPECT, m.incarnation})
+}
+
+// waitAck returns whether ack receives a value before deadline
+func waitAck(ack chan bool, deadline time.Time) bool {
+	expired, timer := newTimer(deadline.Sub(Clock.Now()))
+	defer timer.Stop()
+	select {
+	case <-ack:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+// randomPeers returns up to k random servers that are not dead, excluding
+// this server and exclude
+func (sw *swim) randomPeers(k int, exclude int) []int {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	var candidates []int
+	for _, id := range Membership.Peers() {
+		if id != exclude && sw.member(id).state != SWIM_DEAD {
+			candidates = append(candidates, id)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+// expireSuspects declares servers that were suspected for longer than
+// SWIM_SUSPECT_PERIODS periods dead
+func (sw *swim) expireSuspects(now time.Time) {
+	sw.mutex.Lock()
+	var expired []swimUpdate
+	for id, m := range sw.members {
+		timeout := SWIM_SUSPECT_PERIODS * SWIM_PERIOD
+		if m.state == SWIM_SUSPECT &&
+			now.Sub(m.suspectSince) >= timeout {
+			expired = append(expired,
+				swimUpdate{id, SWIM_DEAD, m.incarnation})
+		}
+	}
+	for seq, relay := range sw.relays {
+		if now.After(relay.deadline) {
+			delete(sw.relays, seq)
+		}
+	}
+	sw.mutex.Unlock()
+
+	for _, update := range expired {
+		sw.apply(update)
+	}
+}
+
+// send sends a SWIM message of the given type to the server with the given id,
+// piggybacking pending updates
+func (sw *swim) send(msgType string, id int, probe swimProbe) {
+	sw.mutex.Lock()
+	probe.Incarnation = sw.incarnation
+	updates := sw.piggyback()
+	sw.mutex.Unlock()
+
+	msg := emptyMessage()
+	msg.Type = msgType
+	msg.Probe = &probe
+	msg.Updates = updates
+	msg.ViewVersion, msg.ViewHash = Membership.Digest()
+	msgBytes, err := encodeMessage(msg)
+	if err != nil {
+		Logger.Error("failed to encode probe", "type", msgType,
+			LOG_PEER, id, LOG_ERROR, err)
+		return
+	}
+	send(msgBytes, id)
+}
+
+// handleSwim handles a SWIM message from another server
+func handleSwim(msg *Message) {
+	sw := Swim
+	if sw == nil || msg.Probe == nil {
+		return
+	}
+
+	// any message is evidence that its sender is alive
+	sw.apply(swimUpdate{msg.Id, SWIM_ALIVE, msg.Probe.Incarnation})
+	for _, update := range msg.Updates {
+		sw.apply(update)
+	}
+
+	probe := *msg.Probe
+	switch msg.Type {
+	case MSG_PING:
+		sw.send(MSG_ACK, msg.Id, probe)
+	case MSG_PING_REQ:
+		sw.mutex.Lock()
+		sw.probeSeq++
+		relayed := swimProbe{Seq: sw.probeSeq, Target: probe.Target,
+			Origin: ID}
+		sw.relays[relayed.Seq] = &relayProbe{
+			origin:   probe.Origin,
+			seq:      probe.Seq,
+			deadline: Clock.Now().Add(SWIM_PERIOD),
+		}
+		sw.mutex.Unlock()
+		sw.send(MSG_PING, probe.Target, relayed)
+	case MSG_ACK:
+		if probe.Origin != ID {
+			return
+		}
+		sw.mutex.Lock()
+		ack, isWaiting := sw.acks[probe.Seq]
+		relay, isRelay := sw.relays[probe.Seq]
+		delete(sw.relays, probe.Seq)
+		sw.mutex.Unlock()
+
+		if isWaiting {
+			select {
+			case ack <- true:
+			default:
+			}
+		}
+		if isRelay {
+			sw.send(MSG_ACK, relay.origin, swimProbe{
+				Seq:    relay.seq,
+				Target: probe.Target,
+				Origin: relay.origin,
+			})
+		}
+	}
+}
+
+// apply applies update to the membership list if it overrides the current
+// state of the server, and queues it for dissemination if so
+//
+// An update about this server that is not SWIM_ALIVE is refuted by
+// incrementing the incarnation of this server
+func (sw *swim) apply(update swimUpdate) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if update.Id == ID {
+		if update.State != SWIM_ALIVE &&
+			update.Incarnation >= sw.incarnation {
+			sw.incarnation = update.Incarnation + 1
+			sw.enqueue(swimUpdate{ID, SWIM_ALIVE, sw.incarnation})
+		}
+		return
+	}
+
+	m, isPresent := sw.members[update.Id]
+	if isPresent && !overrides(update, m) {
+		return
+	}
+	if !isPresent {
+		m = new(swimMember)
+		sw.members[update.Id] = m
+	}
+	if update.State == SWIM_SUSPECT && m.state != SWIM_SUSPECT {
+		m.suspectSince = Clock.Now()
+	}
+	m.state = update.State
+	m.incarnation = update.Incarnation
+	sw.enqueue(update)
+}
+
+// overrides returns whether update supersedes the current state m of a
+// server:
+//   - alive overrides alive and suspect with a lower incarnation
+//   - suspect overrides alive with a lower or equal incarnation and suspect
+//     with a lower incarnation
+//   - dead overrides alive and suspect with any incarnation
+//   - anything with a higher incarnation overrides dead (the server
+//     restarted)
+func overrides(update swimUpdate, m *swimMember) bool {
+	if m.state == SWIM_DEAD {
+		return update.State != SWIM_DEAD &&
+			update.Incarnation > m.incarnation
+	}
+	switch update.State {
+	case SWIM_ALIVE:
+		return update.Incarnation > m.incarnation
+	case SWIM_SUSPECT:
+		return update.Incarnation > m.incarnation ||
+			(update.Incarnation == m.incarnation &&
+				m.state == SWIM_ALIVE)
+	case SWIM_DEAD:
+		return true
+	}
+	return false
+}
+
+// member returns the state of the server with the given id (alive with
+// incarnation 0 if it is unknown)
+//
+// Assumes sw.mutex is held
+func (sw *swim) member(id int) swimMember {
+	m, isPresent := sw.members[id]
+	if !isPresent {
+		return swimMember{state: SWIM_ALIVE}
+	}
+	return *m
+}
+
+// enqueue queues update for dissemination, replacing any older update about
+// the same server
+//
+// Assumes sw.mutex is held
+func (sw *swim) enqueue(update swimUpdate) {
+	sw.updates[update.Id] = &pendingUpdate{update: update}
+}
+
+// piggyback returns up to SWIM_MAX_PIGGYBACK pending updates (those sent the
+// fewest times first) and removes updates that were sent
+// SWIM_RETRANSMIT_MULT * log2(n+1) times
+//
+// Assumes sw.mutex is held
+func (sw *swim) piggyback() []swimUpdate {
+	pending := make([]*pendingUpdate, 0, len(sw.updates))
+	for _, pu := range sw.updates {
+		pending = append(pending, pu)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].sent < pending[j].sent
+	})
+	if len(pending) > SWIM_MAX_PIGGYBACK {
+		pending = pending[:SWIM_MAX_PIGGYBACK]
+	}
+
+	n := float64(len(sw.members) + 1)
+	limit := int(SWIM_RETRANSMIT_MULT * math.Ceil(math.Log2(n+1)))
+	updates := make([]swimUpdate, len(pending))
+	for i, pu := range pending {
+		updates[i] = pu.update
+		pu.sent++
+		if pu.sent >= limit {
+			delete(sw.updates, pu.update.Id)
+		}
+	}
+	return updates
+}
+
+// swimDetector is a FailureDetector that reports the SWIM membership list
+//
+// Suspected servers are still alive (as in SWIM itself). Their phi value is 1,
+// that of alive servers is 0, and that of dead or unknown servers is +Inf.
+type swimDetector struct {
+	swim *swim
+}
+
+// Heartbeat does nothing, since SWIM does not rely on heartbeats
+func (sd *swimDetector) Heartbeat(id int, now time.Time) {}
+
+// Arrival does nothing, since SWIM does not rely on heartbeats
+func (sd *swimDetector) Arrival(id int, now time.Time) {}
+
+func (sd *swimDetector) Alive(id int, now time.Time) bool {
+	return !math.IsInf(sd.Phi(id, now), 1)
+}
+
+// Forget declares the server dead (at the incarnation it was last known by),
+// which a restarted server overrides with its new incarnation
+func (sd *swimDetector) Forget(id int) {
+	sd.swim.mutex.Lock()
+	m := sd.swim.member(id)
+	sd.swim.mutex.Unlock()
+	sd.swim.apply(swimUpdate{id, SWIM_DEAD, m.incarnation})
+}
+
+func (sd *swimDetector) Phi(id int, now time.Time) float64 {
+	sd.swim.mutex.Lock()
+	defer sd.swim.mutex.Unlock()
+
+	m, isPresent := sd.swim.members[id]
+	switch {
+	case !isPresent || m.state == SWIM_DEAD:
+		return math.Inf(1)
+	case m.state == SWIM_SUSPECT:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSwimOverrides(t *testing.T) {
+	// the member is in the given state with incarnation 1
+	cases := []struct {
+		update swimUpdate
+		state  string
+		want   bool
+	}{
+		{swimUpdate{1, SWIM_ALIVE, 2}, SWIM_ALIVE, true},
+		{swimUpdate{1, SWIM_ALIVE, 1}, SWIM_SUSPECT, false},
+		{swimUpdate{1, SWIM_SUSPECT, 1}, SWIM_ALIVE, true},
+		{swimUpdate{1, SWIM_SUSPECT, 1}, SWIM_SUSPECT, false},
+		{swimUpdate{1, SWIM_SUSPECT, 0}, SWIM_ALIVE, false},
+		{swimUpdate{1, SWIM_DEAD, 0}, SWIM_ALIVE, true},
+		{swimUpdate{1, SWIM_ALIVE, 1}, SWIM_DEAD, false},
+		{swimUpdate{1, SWIM_ALIVE, 2}, SWIM_DEAD, true},
+	}
+	for _, c := range cases {
+		state := swimMember{state: c.state, incarnation: 1}
+		if got := overrides(c.update, &state); got != c.want {
+			t.Errorf("overrides(%+v, %+v) = %v, want %v",
+				c.update, c.state, got, c.want)
+		}
+	}
+}
+
+func TestSwimRefute(t *testing.T) {
+	ID = 0
+	sw := &swim{
+		members:     map[int]*swimMember{1: {state: SWIM_ALIVE}},
+		incarnation: 5,
+		updates:     make(map[int]*pendingUpdate),
+	}
+
+	sw.apply(swimUpdate{0, SWIM_SUSPECT, 5})
+	if sw.incarnation != 6 {
+		t.Fatalf("suspicion was not refuted: incarnation %d",
+			sw.incarnation)
+	}
+	u := sw.updates[0].update
+	if u.State != SWIM_ALIVE || u.Incarnation != 6 {
+		t.Fatalf("refutation was not queued: %+v", u)
+	}
+
+	sd := &swimDetector{swim: sw}
+	sw.apply(swimUpdate{1, SWIM_SUSPECT, 0})
+	if !sd.Alive(1, time.Now()) {
+		t.Fatal("suspected server should still be alive")
+	}
+	sw.apply(swimUpdate{1, SWIM_DEAD, 0})
+	if sd.Alive(1, time.Now()) {
+		t.Fatal("dead server should not be alive")
+	}
+}
+
+func TestSwimPiggybackLimit(t *testing.T) {
+	sw := &swim{
+		members: map[int]*swimMember{1: {}},
+		updates: make(map[int]*pendingUpdate),
+	}
+	sw.enqueue(swimUpdate{1, SWIM_SUSPECT, 0})
+
+	// 2 servers: each update is sent SWIM_RETRANSMIT_MULT * log2(3) times
+	sends := 0
+	for len(sw.piggyback()) > 0 {
+		sends++
+	}
+	if sends != 2*SWIM_RETRANSMIT_MULT {
+		t.Fatalf("update was sent %d times, want %d", sends,
+			2*SWIM_RETRANSMIT_MULT)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of the control messages used to catch up on messages missed while a
+// server was down (see syncMessages)
+const (
+	// request for missing messages (the Digest field holds the ranges of
+	// messages the requester has from each server)
+	MSG_SYNC = "sync"
+
+	// reply to a MSG_SYNC request (the Batch field holds up to
+	// SYNC_BATCH_SIZE missing messages, and is empty if none are missing)
+	MSG_SYNC_REPLY = "sync-reply"
+)
+
+// Maximum number of messages in a single MSG_SYNC_REPLY
+const SYNC_BATCH_SIZE = 64
+
+// Duration after which the sync request for a room is sent again if no server
+// has replied to it (5 * HEARTBEAT_INTERVAL, see registerTimingFlags)
+var SYNC_RETRY_INTERVAL = time.Second
+
+// rooms for which a MSG_SYNC_REPLY has arrived
+var SyncReplies tsSyncReplies
+
+// syncMark is the position of a message among all messages sent by a server
+// (across restarts)
+type syncMark struct {
+	Epoch int64  `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// Before returns whether the message at mark was sent before the one at other
+func (mark syncMark) Before(other syncMark) bool {
+	if mark.Epoch != other.Epoch {
+		return mark.Epoch < other.Epoch
+	}
+	return mark.Seq < other.Seq
+}
+
+// syncRange is the range of messages sent by a server from From to To
+// (inclusive)
+type syncRange struct {
+	From syncMark `json:"from"`
+	To   syncMark `json:"to"`
+}
+
+// Contains returns whether the message at mark is in the range
+func (r syncRange) Contains(mark syncMark) bool {
+	return !mark.Before(r.From) && !r.To.Before(mark)
+}
+
+// tsSyncReplies is a set of room names
+type tsSyncReplies struct {
+	value map[string]bool
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// Add adds the given room to the set
+func (tss *tsSyncReplies) Add(room string) {
+	tss.mutex.Lock()
+	defer tss.mutex.Unlock()
+
+	if tss.value == nil {
+		tss.value = make(map[string]bool)
+	}
+	tss.value[room] = true
+}
+
+// Contains returns whether the given room is in the set
+func (tss *tsSyncReplies) Contains(room string) bool {
+	tss.mutex.Lock()
+	defer tss.mutex.Unlock()
+	return tss.value[room]
+}
+
+// syncMessages asks every other server for the messages it has that this
+// server is missing (e.g. messages broadcast while this server was down), in
+// the default room and every room this server is in
+//
+// The request for a room is sent again every SYNC_RETRY_INTERVAL until a
+// server replies to it. Replies are passed on to Orderer like the messages
+// received from their senders (see handleSyncReply).
+func syncMessages() {
+	// wait for the server-facing port to be bound, since replies are sent
+	// to it
+	sleep(HEARTBEAT_INTERVAL)
+
+	rooms := append([]string{""}, Rooms.Names()...)
+	for {
+		waiting := rooms[:0]
+		for _, room := range rooms {
+			if !SyncReplies.Contains(room) && requestSync(room) {
+				waiting = append(waiting, room)
+			}
+		}
+		rooms = waiting
+		if len(rooms) == 0 {
+			return
+		}
+
+		select {
+		case <-after(SYNC_RETRY_INTERVAL):
+		case <-Stopping:
+			return
+		}
+	}
+}
+
+// requestSync sends a MSG_SYNC request with the digest of the log of the given
+// room to the other servers in the room, and returns false if this server is
+// no longer in the room (or the request cannot be encoded)
+func requestSync(room string) bool {
+	msgLog := Rooms.Log(room)
+	if msgLog == nil {
+		return false
+	}
+
+	msg := emptyMessage()
+	msg.Type = MSG_SYNC
+	msg.Room = room
+	msg.Digest = msgLog.Digest()
+	msgBytes, err := encodeMessage(msg)
+	if err != nil {
+		Logger.Error("failed to encode sync request", "room", room,
+			LOG_ERROR, err)
+		return false
+	}
+
+	for _, id := range Membership.Subscribers(room) {
+		send(msgBytes, id)
+	}
+	return true
+}
+
+// handleSync replies to a MSG_SYNC request with every message in the log of
+// its room that the requester is missing (in batches of up to SYNC_BATCH_SIZE,
+// or an empty batch if it is missing none)
+func handleSync(request *Message) {
+	msgLog := Rooms.Log(request.Room)
+	if msgLog == nil {
+		return
+	}
+
+	missing := msgLog.Missing(request.Digest)
+	for {
+		n := len(missing)
+		if n > SYNC_BATCH_SIZE {
+			n = SYNC_BATCH_SIZE
+		}
+
+		reply := emptyMessage()
+		reply.Type = MSG_SYNC_REPLY
+		reply.Room = request.Room
+		reply.Batch = missing[:n]
+		missing = missing[n:]
+
+		msgBytes, err := encodeMessage(reply)
+		if err != nil {
+			Logger.Error("failed to encode sync reply", LOG_PEER,
+				request.Id, LOG_ERROR, err)
+			return
+		}
+		send(msgBytes, request.Id)
+		if len(missing) == 0 {
+			return
+		}
+	}
+}
+
+// handleSyncReply passes the messages in a MSG_SYNC_REPLY on to Orderer
+// through Inbound (which discards the ones it already skipped), so they are
+// delivered in the same order as the messages received from their senders
+//
+// The messages of other servers are relayed, so they are verified against
+// their own sender. If messages are not signed, only the messages of sender
+// (the authenticated id of the server that replied, or -1 if servers are not
+// authenticated) are accepted, since the others cannot be verified.
+func handleSyncReply(reply *Message, sender int) {
+	SyncReplies.Add(reply.Room)
+	if Rooms.Log(reply.Room) == nil {
+		return
+	}
+
+	for _, msg := range reply.Batch {
+		reason := verifyMessage(msg)
+		if reason == "" && publicKeys == nil && sender != -1 &&
+			msg.Id != sender {
+			reason = REJECT_IMPOSTOR
+		}
+		if reason != "" {
+			reject(reason, nil, LOG_PEER, msg.Id, LOG_MESSAGE,
+				messageId(msg), "synced_by", reply.Id)
+			continue
+		}
+		Inbound.Receive(msg, Clock.Now())
+	}
+}
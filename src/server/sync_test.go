@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// loggedMessage returns a chat message from server id that was sent as the
+// seq-th message of the given epoch
+func loggedMessage(id int, epoch int64, seq uint64, content string) *Message {
+	return &Message{Id: id, Epoch: epoch, Seq: seq, Content: content,
+		Rts: time.Now()}
+}
+
+func TestSyncDigest(t *testing.T) {
+	var have, want tsMsgQueue
+	for _, seq := range []uint64{1, 2, 4} {
+		have.Enqueue(loggedMessage(1, 1, seq, "a"))
+	}
+	have.Enqueue(loggedMessage(2, 2, 1, "b"))
+	have.Enqueue(loggedMessage(2, 1, 7, "b"))
+	for seq := uint64(1); seq <= 5; seq++ {
+		want.Enqueue(loggedMessage(1, 1, seq, "a"))
+	}
+	want.Enqueue(loggedMessage(2, 1, 6, "b"))
+
+	digest := have.Digest()
+	ranges := digest[1]
+	if len(ranges) != 2 || ranges[0].From.Seq != 1 ||
+		ranges[0].To.Seq != 2 || ranges[1].From.Seq != 4 ||
+		ranges[1].To.Seq != 4 {
+		t.Errorf("ranges of server 1 are %+v, want 1-2 and 4", ranges)
+	}
+	ranges = digest[2]
+	if len(ranges) != 2 || ranges[0].From != (syncMark{1, 7}) ||
+		ranges[1].From != (syncMark{2, 1}) {
+		t.Errorf("ranges of server 2 are %+v, want them in send order",
+			ranges)
+	}
+
+	// the gap below the last message of server 1 is requested as well
+	var missing []syncMark
+	for _, msg := range want.Missing(digest) {
+		missing = append(missing, msg.mark())
+	}
+	if len(missing) != 3 || missing[0].Seq != 3 || missing[1].Seq != 5 ||
+		missing[2] != (syncMark{1, 6}) {
+		t.Errorf("missing %+v, want 3, 5 and the first 6", missing)
+	}
+}
+
+func TestSyncReply(t *testing.T) {
+	resetLog(2)
+	_, ln := simulatePeer(t, 7)
+	defer Peers.Retain(nil)
+	for seq := uint64(1); seq <= SYNC_BATCH_SIZE+1; seq++ {
+		MessagesFIFO.Enqueue(loggedMessage(1, 1, seq, "a"))
+	}
+
+	// a server that is missing every message gets them in two batches,
+	// and one that is missing none still gets a reply
+	request := newTestMessage(7, "")
+	handleSync(request)
+	request.Digest = MessagesFIFO.Digest()
+	handleSync(request)
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, want := range []int{SYNC_BATCH_SIZE, 1, 0} {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply Message
+		err = json.Unmarshal(line, &reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != MSG_SYNC_REPLY || len(reply.Batch) != want {
+			t.Fatalf("got a %q with %d messages, want a %q with "+
+				"%d", reply.Type, len(reply.Batch),
+				MSG_SYNC_REPLY, want)
+		}
+	}
+}
+
+func TestSyncReplyMerge(t *testing.T) {
+	resetLog(2)
+	SyncReplies = tsSyncReplies{}
+	Orderer = new(fifoOrderer)
+	Inbound = newReorderBuffer(Orderer.Receive, Rooms.Delivered)
+
+	// this server delivered messages 1, 2 and 4 of server 1 before it
+	// restarted, and receives message 6 before its sync reply
+	for _, msg := range []*Message{loggedMessage(1, 1, 1, "a"),
+		loggedMessage(1, 1, 2, "b"), loggedMessage(1, 1, 4, "d")} {
+		MessagesFIFO.Enqueue(msg)
+	}
+	Inbound.Receive(loggedMessage(1, 1, 6, "f"), time.Now())
+	if got := logContents(&MessagesFIFO); got != "a,b,d" {
+		t.Fatalf("delivered %s before the sync reply, want a,b,d", got)
+	}
+
+	reply := newTestMessage(0, "")
+	reply.Type = MSG_SYNC_REPLY
+	reply.Batch = []*Message{loggedMessage(1, 1, 3, "c"),
+		loggedMessage(1, 1, 5, "e")}
+	handleSyncReply(reply, -1)
+
+	if got := logContents(&MessagesFIFO); got != "a,b,d,c,e,f" {
+		t.Fatalf("delivered %s, want a,b,d,c,e,f", got)
+	}
+	if !SyncReplies.Contains("") {
+		t.Error("the reply was not recorded")
+	}
+}
+
+func TestSyncReplyCausalOrder(t *testing.T) {
+	resetLog(3)
+	co, _ := newCausalOrderer(0, 3)
+	co1, _ := newCausalOrderer(1, 3)
+	co2, _ := newCausalOrderer(2, 3)
+	Orderer = co
+	Inbound = newReorderBuffer(Orderer.Receive, Rooms.Delivered)
+
+	// server 2 sends b after delivering a, which this server missed
+	a := loggedMessage(1, 1, 1, "a")
+	co1.Stamp(a)
+	clk, _ := a.Vts.Clock()
+	co2.clock.TickReceive(clk)
+	b := loggedMessage(2, 1, 1, "b")
+	co2.Stamp(b)
+
+	Inbound.Receive(b, time.Now())
+	if got := logContents(&MessagesFIFO); got != "" {
+		t.Fatalf("delivered %s before a", got)
+	}
+
+	// a is recovered from server 2, which is authenticated but cannot
+	// vouch for a message of server 1 without a signature
+	reply := newTestMessage(2, "")
+	reply.Type = MSG_SYNC_REPLY
+	reply.Batch = []*Message{a}
+	rejected := Rejected.Counts()[REJECT_IMPOSTOR]
+	handleSyncReply(reply, 2)
+	if got := logContents(&MessagesFIFO); got != "" {
+		t.Fatalf("delivered %s from an unverifiable relay", got)
+	}
+	if Rejected.Counts()[REJECT_IMPOSTOR] != rejected+1 {
+		t.Error("the relayed message was not rejected")
+	}
+
+	handleSyncReply(reply, -1)
+	if got := logContents(&MessagesFIFO); got != "a,b" {
+		t.Fatalf("delivered %s, want a,b", got)
+	}
+}
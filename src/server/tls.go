@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modes of TLS on the master-facing port and the HTTP gateway
+const (
+	MASTER_TLS_OFF    = "off"
+	MASTER_TLS_ON     = "on"     // only the server is authenticated
+	MASTER_TLS_MUTUAL = "mutual" // masters need a certificate from TLS_CA
+)
+
+// Prefix of the common name of a server's certificate, which is followed by
+// the id of the server (e.g. "server-3")
+const TLS_IDENTITY_PREFIX = "server-"
+
+var (
+	// paths of the PEM-encoded certificate and private key of this server
+	// and of the certificate authority that signs the certificate of every
+	// server (servers use plaintext TCP if they are empty)
+	TLS_CERT = ""
+	TLS_KEY  = ""
+	TLS_CA   = ""
+
+	// TLS mode of the master-facing port and the HTTP gateway
+	MASTER_TLS = MASTER_TLS_OFF
+
+	// configuration of the server-facing port, whose ClientCAs also verify
+	// the servers this server connects to (nil if peers use plaintext TCP)
+	PeerTLS *tls.Config
+
+	// configuration of the master-facing port (nil if masters use
+	// plaintext TCP)
+	MasterTLS *tls.Config
+)
+
+// registerTLSFlags defines the flags that enable TLS
+func registerTLSFlags() {
+	flag.StringVar(&TLS_CERT, "tls-cert", TLS_CERT, "path of the PEM "+
+		"certificate of this server, whose common name must be \""+
+		TLS_IDENTITY_PREFIX+"<id>\" (enables mutual TLS between "+
+		"servers)")
+	flag.StringVar(&TLS_KEY, "tls-key", TLS_KEY, "path of the PEM "+
+		"private key of -tls-cert")
+	flag.StringVar(&TLS_CA, "tls-ca", TLS_CA, "path of the PEM "+
+		"certificate of the authority that signs every server's "+
+		"certificate")
+	flag.StringVar(&MASTER_TLS, "master-tls", MASTER_TLS, "TLS on the "+
+		"master-facing port and the HTTP gateway {"+MASTER_TLS_OFF+", "+
+		MASTER_TLS_ON+", "+MASTER_TLS_MUTUAL+"} (requires -tls-cert)")
+}
+
+// loadTLS sets PeerTLS and MasterTLS according to the TLS flags
+//
+// The certificate of this server must be signed by TLS_CA and name ID (see
+// certIdentity), and it is used both to accept connections and to connect to
+// other servers, so it must allow client as well as server authentication.
+func loadTLS() error {
+	switch MASTER_TLS {
+	case MASTER_TLS_OFF, MASTER_TLS_ON, MASTER_TLS_MUTUAL:
+	default:
+		return errors.New("unknown master TLS mode: " + MASTER_TLS)
+	}
+	if TLS_CERT == "" && TLS_KEY == "" && TLS_CA == "" &&
+		MASTER_TLS == MASTER_TLS_OFF {
+		return nil
+	}
+	if TLS_CERT == "" || TLS_KEY == "" || TLS_CA == "" {
+		return errors.New("-tls-cert, -tls-key and -tls-ca must be " +
+			"given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(TLS_CERT, TLS_KEY)
+	if err != nil {
+		return err
+	}
+	caPEM, err := os.ReadFile(TLS_CA)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return errors.New("no certificates in " + TLS_CA)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth}})
+	if err != nil {
+		return err
+	}
+	id, err := certIdentity(leaf)
+	if err != nil {
+		return err
+	}
+	if id != ID {
+		return errors.New("certificate " + TLS_CERT + " belongs to " +
+			"server " + strconv.Itoa(id) + ", not " +
+			strconv.Itoa(ID))
+	}
+
+	PeerTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		MinVersion:   tls.VersionTLS13,
+	}
+	if MASTER_TLS != MASTER_TLS_OFF {
+		MasterTLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if MASTER_TLS == MASTER_TLS_MUTUAL {
+			MasterTLS.ClientAuth = tls.RequireAndVerifyClientCert
+			MasterTLS.ClientCAs = roots
+		}
+	}
+	return nil
+}
+
+// certIdentity returns the id of the server named by the common name of cert
+// (e.g. 3 for "server-3")
+func certIdentity(cert *x509.Certificate) (int, error) {
+	name := cert.Subject.CommonName
+	id, err := strconv.Atoi(strings.TrimPrefix(name, TLS_IDENTITY_PREFIX))
+	if !strings.HasPrefix(name, TLS_IDENTITY_PREFIX) || err != nil ||
+		id < 0 {
+		return 0, errors.New("certificate does not name a server: " +
+			strconv.Quote(name))
+	}
+	return id, nil
+}
+
+// dialPeer connects to the server-facing port at addr, which must belong to
+// the server with the given id (or any server if id is -1) if PeerTLS is set
+//
+// NOTE: the certificate of the other server is verified against the id rather
+// than the host name, since servers are identified by id (and addresses are
+// often just "localhost")
+func dialPeer(addr string, id int) (net.Conn, error) {
+	conn, err := Network.Dial(addr, DIAL_TIMEOUT)
+	if err != nil || PeerTLS == nil {
+		return conn, err
+	}
+
+	config := PeerTLS.Clone()
+	config.InsecureSkipVerify = true // verified by VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		peer, err := verifyPeer(state, x509.ExtKeyUsageServerAuth)
+		if err == nil && id != -1 && peer != id {
+			err = errors.New("expected server " +
+				strconv.Itoa(id) + " but " + addr +
+				" is server " + strconv.Itoa(peer))
+		}
+		return err
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(Clock.Now().Add(DIAL_TIMEOUT))
+	err = tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// acceptPeer completes the TLS handshake of a connection accepted on the
+// server-facing port and returns the id of the server on the other end
+//
+// Returns -1 if PeerTLS is not set, since the other end is unknown
+func acceptPeer(conn net.Conn) (int, error) {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return -1, nil
+	}
+
+	tlsConn.SetDeadline(Clock.Now().Add(READ_TIMEOUT))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	return verifyPeer(tlsConn.ConnectionState(),
+		x509.ExtKeyUsageClientAuth)
+}
+
+// verifyPeer verifies the certificate chain of the other end of a connection
+// against the CA of PeerTLS and returns the id of the server it names
+func verifyPeer(state tls.ConnectionState, usage x509.ExtKeyUsage) (int,
+	error) {
+
+	if len(state.PeerCertificates) == 0 {
+		return 0, errors.New("no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := state.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         PeerTLS.ClientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return certIdentity(leaf)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key}
+}
+
+// issue returns a certificate with the given common name signed by ca
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert,
+		&key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes the given PEM block to a file in dir and returns its path
+func writePEM(t *testing.T, dir string, name string, blockType string,
+	der []byte) string {
+
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType,
+		Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setupTestTLS sets up PeerTLS for server 1 with certificates from ca
+func setupTestTLS(t *testing.T, ca *testCA) {
+	t.Helper()
+	dir := t.TempDir()
+	cert := ca.issue(t, TLS_IDENTITY_PREFIX+"1")
+	key := cert.PrivateKey.(*ecdsa.PrivateKey)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	ID = 1
+	TLS_CERT = writePEM(t, dir, "cert.pem", "CERTIFICATE",
+		cert.Certificate[0])
+	TLS_KEY = writePEM(t, dir, "key.pem", "EC PRIVATE KEY", keyDER)
+	TLS_CA = writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.cert.Raw)
+	t.Cleanup(func() {
+		ID, TLS_CERT, TLS_KEY, TLS_CA = 0, "", "", ""
+		PeerTLS, MasterTLS = nil, nil
+	})
+
+	err := loadTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	cases := map[string]int{"server-0": 0, "server-12": 12, "server-": -1,
+		"server--1": -1, "client-1": -1, "1": -1}
+	for name, want := range cases {
+		id, err := certIdentity(&x509.Certificate{
+			Subject: pkix.Name{CommonName: name}})
+		if (err != nil) != (want == -1) || (err == nil && id != want) {
+			t.Errorf("certIdentity(%q) = %d, %v", name, id, err)
+		}
+	}
+}
+
+func TestLoadTLSChecksIdentity(t *testing.T) {
+	setupTestTLS(t, newTestCA(t))
+	ID = 2
+	if loadTLS() == nil {
+		t.Fatal("server 2 loaded the certificate of server 1")
+	}
+}
+
+func TestPeerTLS(t *testing.T) {
+	setupTestTLS(t, newTestCA(t))
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", PeerTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan int)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			id, err := acceptPeer(conn)
+			if err != nil {
+				id = -2
+			}
+			conn.Close()
+			accepted <- id
+		}
+	}()
+	addr := ln.Addr().String()
+
+	// the certificate of each end names server 1
+	conn, err := dialPeer(addr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if id := <-accepted; id != 1 {
+		t.Fatalf("accepted server %d, want 1", id)
+	}
+
+	conn, err = dialPeer(addr, 2)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialed server 2 but reached server 1")
+	}
+	<-accepted
+
+	// a certificate for server 1 from another authority is rejected
+	rogue := newTestCA(t).issue(t, TLS_IDENTITY_PREFIX+"1")
+	conn, err = tls.Dial("tcp", addr, &tls.Config{
+		Certificates:       []tls.Certificate{rogue},
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		// TLS 1.3 clients only learn of the failure on their first read
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if id := <-accepted; id != -2 || err == nil {
+		t.Fatalf("accepted a certificate from another authority as "+
+			"server %d", id)
+	}
+}
+
+func TestHandleMessageRejectsImpostors(t *testing.T) {
+	detector, _ := newFailureDetector(DETECTOR_FIXED)
+	LastTimestamp = tsTimestampQueue{detector: detector}
+	handleMessage([]byte(`{"id": 3}`), 2)
+	for _, server := range LastTimestamp.AliveServers(time.Now()) {
+		if server.Id == 3 {
+			t.Fatal("accepted a message from server 3 over a " +
+				"connection from server 2")
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Transport listens for and dials the connections between servers, and the
+// connections from masters
+//
+// NOTE: The HTTP and metrics endpoints always use TCP (see serveHTTP and
+// serveMetrics).
+type Transport interface {
+	// Listen listens on address (e.g. ":20000")
+	Listen(address string) (net.Listener, error)
+
+	// Dial connects to address (e.g. "localhost:20000"), giving up after
+	// timeout
+	Dial(address string, timeout time.Duration) (net.Conn, error)
+}
+
+// transport of this server, which tests may replace with a host of a
+// simulated network (see package simnet) to inject delays, losses and
+// partitions between this server and the peers the test plays
+var Network Transport = tcpTransport{}
+
+// tcpTransport is the Transport of the net package
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (tcpTransport) Dial(address string, timeout time.Duration) (net.Conn,
+	error) {
+
+	return net.DialTimeout("tcp", address, timeout)
+}
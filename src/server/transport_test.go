@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sfurman3/chatroom/simnet"
+)
+
+// simulateConn serves the connections to this server (host "0" of a new
+// network with the given seed and default link, whose VirtualClock is also
+// the Clock of this server) like fetchMessages, and returns the network, its
+// clock and a connection to this server from server 1
+func simulateConn(t *testing.T, seed int64, link simnet.Link) (
+	*simnet.Network, *simnet.VirtualClock, net.Conn) {
+
+	t.Helper()
+	resetLog(2)
+	Orderer = new(fifoOrderer)
+	Inbound = newReorderBuffer(Orderer.Receive, Rooms.Delivered)
+	detector, _ := newFailureDetector(DETECTOR_FIXED)
+	LastTimestamp = tsTimestampQueue{detector: detector}
+
+	clock := simnet.NewVirtualClock(time.Now())
+	Clock = clock
+	network := simnet.New(seed, clock)
+	network.SetDefaultLink(link)
+	Network = network.Host("0")
+	ln, err := Network.Listen(":27000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served sync.WaitGroup
+	served.Add(1)
+	go func() {
+		defer served.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			served.Add(1)
+			go func() {
+				defer served.Done()
+				serveConn(conn)
+			}()
+		}
+	}()
+
+	conn, err := network.Host("1").Dial("localhost:27000", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		ln.Close()
+		clock.Advance(READ_TIMEOUT) // in case serveConn still reads
+		served.Wait()
+		Network, Clock = tcpTransport{}, simnet.WallClock
+	})
+	return network, clock, conn
+}
+
+// writeMessage writes msg to conn as a single frame
+func writeMessage(t *testing.T, conn net.Conn, msg *Message) {
+	t.Helper()
+	msgBytes, err := encodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write(append(msgBytes, '\n'))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// await calls done until it returns true, letting the server handle the
+// messages delivered to it in between, and fails the test if it does not
+// within 5 seconds
+//
+// Handling a message takes no virtual time, so only the scheduler is waited
+// for (not the clock of the network).
+func await(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting until " + what)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestSimulatedTransport(t *testing.T) {
+	network := simnet.New(1, nil)
+	Network = network.Host("0")
+	defer func() { Network = tcpTransport{} }()
+
+	ln, err := network.Host("7").Listen(":27007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	Membership = tsMembership{}
+	Membership.Init(0)
+	Membership.Add(7, "localhost:27007")
+
+	var peers tsPeerConns
+	peers.Get(7).Send([]byte("hello"))
+	if !peers.Drain(time.Now().Add(5 * time.Second)) {
+		t.Fatal("queued message was not written in time")
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if line != "hello\n" {
+		t.Fatalf("read %q (%v), want %q", line, err, "hello\n")
+	}
+
+	network.Partition([]string{"0"}, []string{"7"})
+	_, err = dialPeer(peerAddr(7), 7)
+	if err == nil {
+		t.Fatal("connected to a partitioned server")
+	}
+	network.Heal()
+	conn, err = dialPeer(peerAddr(7), 7)
+	if err != nil {
+		t.Fatalf("failed to connect after the partition healed: %v",
+			err)
+	}
+	conn.Close()
+}
+
+func TestSimulatedDelay(t *testing.T) {
+	// every message takes 1-21ms, so most overtake each other
+	_, clock, conn := simulateConn(t, 1, simnet.Link{
+		Latency: time.Millisecond, Jitter: 20 * time.Millisecond})
+	var want []string
+	for seq := uint64(1); seq <= 20; seq++ {
+		content := strconv.FormatUint(seq, 10)
+		writeMessage(t, conn, loggedMessage(1, 1, seq, content))
+		want = append(want, content)
+	}
+	clock.Advance(21 * time.Millisecond)
+
+	await(t, "every message is delivered", func() bool {
+		first, next := MessagesFIFO.Bounds()
+		return next-first == len(want)
+	})
+	if got := logContents(&MessagesFIFO); got != strings.Join(want, ",") {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestSimulatedDrop(t *testing.T) {
+	network, clock, conn := simulateConn(t, 1, simnet.Link{Drop: 0.3})
+	for seq := uint64(1); seq <= 20; seq++ {
+		writeMessage(t, conn, loggedMessage(1, 1, seq,
+			strconv.FormatUint(seq, 10)))
+	}
+
+	// message 21 is not lost, and the messages before it that were are
+	// skipped once REORDER_TIMEOUT has passed
+	network.SetDefaultLink(simnet.Link{})
+	writeMessage(t, conn, loggedMessage(1, 1, 21, "21"))
+	await(t, "21 is delivered", func() bool {
+		clock.Advance(REORDER_TIMEOUT)
+		Inbound.Expire(clock.Now())
+		return strings.HasSuffix(logContents(&MessagesFIFO), ",21")
+	})
+
+	// the lost messages are skipped, and the rest are delivered in order
+	// (and only once)
+	contents := strings.Split(logContents(&MessagesFIFO), ",")
+	prev := 0
+	for _, content := range contents {
+		seq, _ := strconv.Atoi(content)
+		if seq <= prev {
+			t.Fatalf("delivered %v, want increasing sequence "+
+				"numbers", contents)
+		}
+		prev = seq
+	}
+	if len(contents) >= 21 {
+		t.Errorf("delivered all of %v, although messages were lost",
+			contents)
+	}
+}
+
+func TestSimulatedPartition(t *testing.T) {
+	network, clock, conn := simulateConn(t, 1, simnet.Link{})
+	alive := func() bool {
+		return LastTimestamp.Alive(1, clock.Now())
+	}
+	heartbeat := func() {
+		writeMessage(t, conn,
+			&Message{Id: 1, Epoch: 1, Heartbeat: true})
+	}
+
+	// heartbeats keep server 1 alive until they are lost in a partition,
+	// and again once it heals
+	heartbeat()
+	await(t, "server 1 is alive", alive)
+	network.Partition([]string{"0"}, []string{"1"})
+	for elapsed := time.Duration(0); elapsed <= ALIVE_INTERVAL; {
+		heartbeat()
+		clock.Advance(HEARTBEAT_INTERVAL)
+		elapsed += HEARTBEAT_INTERVAL
+	}
+	if alive() {
+		t.Fatal("server 1 is still alive in another partition")
+	}
+	network.Heal()
+	heartbeat()
+	await(t, "server 1 is alive after the partition healed", alive)
+}
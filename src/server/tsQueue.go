@@ -1,72 +1,450 @@
 package main
 
 import (
-	"bufio"
-	"strconv"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Retention limits of the messages each room keeps in memory (0 for no limit,
+// see registerTimingFlags)
+var (
+	// maximum number of messages
+	RETAIN_MESSAGES = 0
+
+	// maximum age of a message (by its send timestamp)
+	RETAIN_AGE time.Duration = 0
+)
+
+// tsMsgQueue is the log of the messages delivered to a room
+//
+// The position of a message is the number of messages added before it
+// (starting at 0), which never changes once the message is added. Messages
+// beyond the limits of RETAIN_MESSAGES and RETAIN_AGE are dropped from the
+// front of the queue as new messages are added (see compact), after which the
+// queue starts at a later position. Only the queue in memory is compacted: the
+// message log keeps every message.
 type tsMsgQueue struct {
 	value []*Message
-	mutex sync.Mutex // mutex for accessing contents
+	base  int             // position of value[0]
+	log   *wal            // log of value (nil if not persisted)
+	seen  map[msgKey]bool // keys of the messages in value
+	mutex sync.Mutex      // mutex for accessing contents
+
+	// mark of the last message from each server that was compacted, at or
+	// before which messages are no longer added
+	compacted map[int]syncMark
+
+	// closed (and reset) when a message is added (nil if nobody waits)
+	changed chan struct{}
+}
+
+// msgKey uniquely identifies a message sent by a server
+type msgKey struct {
+	id    int
+	epoch int64
+	seq   uint64
 }
 
-func (tsq *tsMsgQueue) Enqueue(msg *Message) {
+// key returns the msgKey of msg
+func (msg *Message) key() msgKey {
+	return msgKey{msg.Id, msg.Epoch, msg.Seq}
+}
+
+// mark returns the syncMark of msg
+func (msg *Message) mark() syncMark {
+	return syncMark{msg.Epoch, msg.Seq}
+}
+
+// Recover sets the contents of the queue to msgs (e.g. the messages replayed
+// from msgLog) and appends any new messages to msgLog
+func (tsq *tsMsgQueue) Recover(msgLog *wal, msgs []*Message) {
 	tsq.mutex.Lock()
-	tsq.value = append(tsq.value, msg)
+	tsq.value = msgs
+	tsq.base = 0
+	tsq.log = msgLog
+	tsq.seen = make(map[msgKey]bool)
+	tsq.compacted = nil
+	for _, msg := range msgs {
+		tsq.seen[msg.key()] = true
+	}
+	tsq.compact(Clock.Now())
 	tsq.mutex.Unlock()
 }
 
-func (tsq *tsMsgQueue) WriteMessages(rwr *bufio.ReadWriter) {
+// Close closes the log of the queue (if any), after which messages are only
+// kept in memory
+func (tsq *tsMsgQueue) Close() error {
 	tsq.mutex.Lock()
-	if len(tsq.value) > 0 {
-		msgs := tsq.value
-		lst := len(msgs) - 1
-		for _, msg := range msgs[:lst] {
-			rwr.WriteString(msg.Content)
-			rwr.WriteByte(',')
-		}
-		rwr.WriteString(msgs[lst].Content)
+	defer tsq.mutex.Unlock()
+
+	if tsq.log == nil {
+		return nil
 	}
+	err := tsq.log.Close()
+	tsq.log = nil
+	return err
+}
+
+// Enqueue appends msg to the queue (and its log, if any) unless it is already
+// present, and returns whether it did
+//
+// NOTE: The message is still added if it cannot be logged, since losing it on a
+// restart is better than never delivering it
+func (tsq *tsMsgQueue) Enqueue(msg *Message) bool {
+	tsq.mutex.Lock()
+	added := tsq.enqueue(msg)
+	tsq.compact(Clock.Now())
 	tsq.mutex.Unlock()
+	return added
 }
 
-type tsTimestampQueue struct {
-	value []time.Time
-	mutex sync.Mutex // mutex for accessing contents
+// Merge appends every message in msgs that is not already present, in order
+func (tsq *tsMsgQueue) Merge(msgs []*Message) {
+	tsq.mutex.Lock()
+	for _, msg := range msgs {
+		tsq.enqueue(msg)
+	}
+	tsq.compact(Clock.Now())
+	tsq.mutex.Unlock()
+}
+
+// enqueue appends msg to the queue (and its log, if any) unless it is already
+// present (or was compacted), and returns whether it did
+//
+// Assumes tsq.mutex is held
+func (tsq *tsMsgQueue) enqueue(msg *Message) bool {
+	if tsq.seen == nil {
+		tsq.seen = make(map[msgKey]bool)
+	}
+	key := msg.key()
+	if tsq.seen[key] {
+		return false
+	}
+	if mark, isPresent := tsq.compacted[msg.Id]; isPresent &&
+		!mark.Before(msg.mark()) {
+		return false
+	}
+	tsq.seen[key] = true
+
+	if tsq.log != nil {
+		err := tsq.log.Append(msg)
+		if err != nil {
+			Logger.Error("failed to log message", LOG_PEER, msg.Id,
+				LOG_MESSAGE, messageId(msg), LOG_ERROR, err)
+		}
+	}
+	tsq.value = append(tsq.value, msg)
+
+	if tsq.changed != nil {
+		close(tsq.changed)
+		tsq.changed = nil
+	}
+	return true
 }
 
-// NOTE: assumes message IDs are in {0..n-1}
-func (tsq *tsTimestampQueue) UpdateTimestamp(msg *Message) {
-	LastTimestamp.mutex.Lock()
-	LastTimestamp.value[msg.Id] = msg.Rts
-	LastTimestamp.mutex.Unlock()
-}
-
-func (tsq *tsTimestampQueue) WriteAlive(rwr *bufio.ReadWriter, now time.Time) {
-	LastTimestamp.mutex.Lock()
-	{
-		stmps := LastTimestamp.value
-		for id := 0; id < ID; id++ {
-			// add all server ids for which a
-			// heartbeat was sent within the
-			// alive interval
-			if now.Sub(stmps[id]) < ALIVE_INTERVAL {
-				rwr.WriteString(strconv.Itoa(id))
-				rwr.WriteByte(',')
+// compact drops messages from the front of the queue while there are more
+// than RETAIN_MESSAGES or the first is older than RETAIN_AGE at now
+//
+// Assumes tsq.mutex is held
+func (tsq *tsMsgQueue) compact(now time.Time) {
+	n := 0
+	for n < len(tsq.value) {
+		excess := RETAIN_MESSAGES > 0 &&
+			len(tsq.value)-n > RETAIN_MESSAGES
+		expired := RETAIN_AGE > 0 &&
+			now.Sub(tsq.value[n].Rts) > RETAIN_AGE
+		if !excess && !expired {
+			break
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	if tsq.compacted == nil {
+		tsq.compacted = make(map[int]syncMark)
+	}
+	for _, msg := range tsq.value[:n] {
+		delete(tsq.seen, msg.key())
+		if last, isPresent := tsq.compacted[msg.Id]; !isPresent ||
+			last.Before(msg.mark()) {
+			tsq.compacted[msg.Id] = msg.mark()
+		}
+	}
+
+	// copy the rest, so that the dropped messages can be collected
+	tsq.value = append([]*Message(nil), tsq.value[n:]...)
+	tsq.base += n
+}
+
+// Since returns up to limit messages starting at position pos (or the first
+// position in the queue, if pos was compacted) and the position of the first
+// one, or if there are none, a channel that is closed once another message is
+// added
+func (tsq *tsMsgQueue) Since(pos int, limit int) ([]*Message, int,
+	<-chan struct{}) {
+
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	if pos < tsq.base {
+		pos = tsq.base
+	}
+	start := pos - tsq.base
+	if start >= len(tsq.value) {
+		if tsq.changed == nil {
+			tsq.changed = make(chan struct{})
+		}
+		return nil, pos, tsq.changed
+	}
+
+	end := len(tsq.value)
+	if end-start > limit {
+		end = start + limit
+	}
+	msgs := make([]*Message, end-start)
+	copy(msgs, tsq.value[start:end])
+	return msgs, pos, nil
+}
+
+// Bounds returns the position of the first message in the queue and that of
+// the next message added to it
+func (tsq *tsMsgQueue) Bounds() (int, int) {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+	return tsq.base, tsq.base + len(tsq.value)
+}
+
+// Digest returns the ranges of consecutive messages in the queue (or compacted
+// from it) from each server, in increasing order
+func (tsq *tsMsgQueue) Digest() map[int][]syncRange {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	marks := make(map[int][]syncMark)
+	for _, msg := range tsq.value {
+		marks[msg.Id] = append(marks[msg.Id], msg.mark())
+	}
+
+	digest := make(map[int][]syncRange)
+	for id, mark := range tsq.compacted {
+		// every message at or before the mark
+		digest[id] = []syncRange{{To: mark}}
+	}
+	for id, ms := range marks {
+		sort.Slice(ms, func(i, j int) bool {
+			return ms[i].Before(ms[j])
+		})
+		ranges := digest[id]
+		for _, mark := range ms {
+			n := len(ranges)
+			if n > 0 && !ranges[n-1].To.Before(mark) {
+				continue
+			}
+			if n > 0 && ranges[n-1].To.Epoch == mark.Epoch &&
+				ranges[n-1].To.Seq+1 == mark.Seq {
+				ranges[n-1].To = mark
+				continue
 			}
+			ranges = append(ranges, syncRange{From: mark, To: mark})
 		}
-		rwr.WriteString(strconv.Itoa(ID))
-		for id := ID + 1; id < NUM_PROCS; id++ {
-			// add all server ids for which a
-			// heartbeat was sent within the
-			// heartbeat interval
-			if now.Sub(stmps[id]) < HEARTBEAT_INTERVAL {
-				rwr.WriteByte(',')
-				rwr.WriteString(strconv.Itoa(id))
+		digest[id] = ranges
+	}
+	return digest
+}
+
+// Missing returns the messages in the queue (in order) that are not in any
+// range of their sender in digest (i.e. the messages a server with the given
+// digest has not received)
+func (tsq *tsMsgQueue) Missing(digest map[int][]syncRange) []*Message {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	var missing []*Message
+	for _, msg := range tsq.value {
+		ranges, mark := digest[msg.Id], msg.mark()
+		i := sort.Search(len(ranges), func(i int) bool {
+			return !ranges[i].To.Before(mark)
+		})
+		if i == len(ranges) || !ranges[i].Contains(mark) {
+			missing = append(missing, msg)
+		}
+	}
+	return missing
+}
+
+// Contains returns whether the message with the given key is in the queue (or
+// was compacted from it)
+func (tsq *tsMsgQueue) Contains(key msgKey) bool {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	if tsq.seen[key] {
+		return true
+	}
+	mark, isPresent := tsq.compacted[key.id]
+	return isPresent && !mark.Before(syncMark{key.epoch, key.seq})
+}
+
+// msgFilter selects messages of a tsMsgQueue (see Query)
+type msgFilter struct {
+	since  int       // first position to consider
+	limit  int       // maximum number of messages (0 for no limit)
+	sender *int      // id of the sender (nil for any server)
+	after  time.Time // earliest send timestamp (zero for no limit)
+	before time.Time // send timestamp from which on messages are excluded
+}
+
+// match returns whether msg passes the filter (other than its position)
+func (filter *msgFilter) match(msg *Message) bool {
+	if filter.sender != nil && msg.Id != *filter.sender {
+		return false
+	}
+	if !filter.after.IsZero() && msg.Rts.Before(filter.after) {
+		return false
+	}
+	if !filter.before.IsZero() && !msg.Rts.Before(filter.before) {
+		return false
+	}
+	return true
+}
+
+// logEntry is a message in a tsMsgQueue and its position
+type logEntry struct {
+	pos int
+	msg *Message
+}
+
+// Query returns the messages in the queue that pass filter (in order), along
+// with the position at which to continue for the next page and whether the
+// queue holds any messages past it
+//
+// NOTE: The queue is only locked to take a snapshot of its contents (messages
+// are never modified and only appended to the end), so a long query does not
+// delay deliveries
+func (tsq *tsMsgQueue) Query(filter msgFilter) ([]logEntry, int, bool) {
+	tsq.mutex.Lock()
+	value, base := tsq.value, tsq.base
+	tsq.mutex.Unlock()
+
+	start := filter.since - base
+	if start < 0 {
+		start = 0
+	}
+
+	var entries []logEntry
+	next := base + len(value)
+	for i := start; i < len(value); i++ {
+		if filter.limit > 0 && len(entries) == filter.limit {
+			next = base + i
+			break
+		}
+		if filter.match(value[i]) {
+			entries = append(entries, logEntry{base + i, value[i]})
+		}
+	}
+	return entries, next, next < base+len(value)
+}
+
+// tsTimestampQueue records when messages are received from each server and
+// decides which servers are alive using a FailureDetector
+type tsTimestampQueue struct {
+	detector FailureDetector
+	mutex    sync.Mutex // mutex for accessing contents
+}
+
+// UpdateTimestamp records that msg was received at now (the local receipt
+// time, NOT the send timestamp of msg)
+func (tsq *tsTimestampQueue) UpdateTimestamp(msg *Message, now time.Time) {
+	tsq.mutex.Lock()
+	if msg.Heartbeat {
+		tsq.detector.Heartbeat(msg.Id, now)
+	} else {
+		tsq.detector.Arrival(msg.Id, now)
+	}
+	tsq.mutex.Unlock()
+}
+
+// Forget records that the server with the given id is shutting down (see
+// FailureDetector)
+func (tsq *tsTimestampQueue) Forget(id int) {
+	tsq.mutex.Lock()
+	tsq.detector.Forget(id)
+	tsq.mutex.Unlock()
+}
+
+// aliveServer is a server that is believed to be alive and its phi value (see
+// FailureDetector)
+type aliveServer struct {
+	Id  int     `json:"id"`
+	Phi float64 `json:"phi"`
+}
+
+// AliveServers returns the servers in the membership view that are alive at now
+// (in increasing order of id, always including this server)
+func (tsq *tsTimestampQueue) AliveServers(now time.Time) []aliveServer {
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+
+	ids := Membership.Ids()
+	if !Membership.Contains(ID) {
+		ids = append([]int{ID}, ids...)
+		sort.Ints(ids)
+	}
+
+	var servers []aliveServer
+	for _, id := range ids {
+		phi := 0.0
+		if id != ID {
+			if !tsq.detector.Alive(id, now) {
+				continue
 			}
+			phi = tsq.detector.Phi(id, now)
 		}
+		servers = append(servers, aliveServer{id, phi})
+	}
+	return servers
+}
+
+// Alive returns whether the server with the given id is alive at now (this
+// server is always alive)
+func (tsq *tsTimestampQueue) Alive(id int, now time.Time) bool {
+	if id == ID {
+		return true
+	}
+
+	tsq.mutex.Lock()
+	defer tsq.mutex.Unlock()
+	return tsq.detector.Alive(id, now)
+}
+
+// tsCounters is a set of named event counters (e.g. see Rejected)
+type tsCounters struct {
+	value map[string]uint64
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+// Add increments the counter with the given name
+func (tsc *tsCounters) Add(name string) {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	if tsc.value == nil {
+		tsc.value = make(map[string]uint64)
+	}
+	tsc.value[name]++
+}
+
+// Counts returns a copy of every counter that is not zero
+func (tsc *tsCounters) Counts() map[string]uint64 {
+	tsc.mutex.Lock()
+	defer tsc.mutex.Unlock()
+
+	counts := make(map[string]uint64, len(tsc.value))
+	for name, count := range tsc.value {
+		counts[name] = count
 	}
-	LastTimestamp.mutex.Unlock()
+	return counts
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMsgQueueQuery(t *testing.T) {
+	start := time.Now()
+	var tsq tsMsgQueue
+	for i := 0; i < 6; i++ {
+		tsq.Enqueue(&Message{Id: i % 2, Seq: uint64(i + 1),
+			Content: string(rune('a' + i)),
+			Rts:     start.Add(time.Duration(i) * time.Second)})
+	}
+
+	contents := func(entries []logEntry) string {
+		s := ""
+		for _, entry := range entries {
+			s += entry.msg.Content
+		}
+		return s
+	}
+
+	one := 1
+	cases := []struct {
+		filter msgFilter
+		want   string
+		next   int
+		more   bool
+	}{
+		{msgFilter{}, "abcdef", 6, false},
+		{msgFilter{limit: 2}, "ab", 2, true},
+		{msgFilter{since: 2, limit: 2}, "cd", 4, true},
+		{msgFilter{since: 4, limit: 2}, "ef", 6, false},
+		{msgFilter{sender: &one}, "bdf", 6, false},
+		{msgFilter{sender: &one, limit: 1, since: 2}, "d", 4, true},
+		{msgFilter{after: start.Add(2 * time.Second),
+			before: start.Add(4 * time.Second)}, "cd", 6, false},
+	}
+	for _, c := range cases {
+		entries, next, more := tsq.Query(c.filter)
+		if got := contents(entries); got != c.want || next != c.next ||
+			more != c.more {
+			t.Errorf("Query(%+v) = %q, %d, %v, want %q, %d, %v",
+				c.filter, got, next, more, c.want, c.next,
+				c.more)
+		}
+	}
+}
+
+func TestMsgQueueCompaction(t *testing.T) {
+	RETAIN_MESSAGES = 2
+	defer func() { RETAIN_MESSAGES = 0 }()
+
+	var tsq tsMsgQueue
+	for i := 1; i <= 5; i++ {
+		tsq.Enqueue(&Message{Id: 1, Seq: uint64(i), Rts: time.Now()})
+	}
+
+	first, next := tsq.Bounds()
+	if first != 3 || next != 5 {
+		t.Fatalf("bounds are %d, %d, want 3, 5", first, next)
+	}
+	entries, _, _ := tsq.Query(msgFilter{})
+	if len(entries) != 2 || entries[0].pos != 3 || entries[0].msg.Seq != 4 {
+		t.Fatalf("unexpected entries after compaction: %+v", entries)
+	}
+
+	// compacted messages are neither added again nor requested again
+	tsq.Merge([]*Message{{Id: 1, Seq: 2}})
+	if _, next := tsq.Bounds(); next != 5 {
+		t.Fatal("a compacted message was added again")
+	}
+	ranges := tsq.Digest()[1]
+	if len(ranges) != 1 || ranges[0].To.Seq != 5 {
+		t.Fatalf("digest ranges are %+v, want one up to seq 5", ranges)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Policies accepted by the -fsync flag, which decide when records appended to
+// the message log are flushed to stable storage
+const (
+	// after every record (a delivered message survives a power failure)
+	FSYNC_ALWAYS = "always"
+
+	// every WAL_SYNC_INTERVAL (a delivered message survives a crash of the
+	// server but not necessarily of the host)
+	FSYNC_INTERVAL = "interval"
+
+	// whenever the operating system decides to
+	FSYNC_NEVER = "never"
+)
+
+// Duration between flushes of the message log (only used by FSYNC_INTERVAL,
+// see registerTimingFlags)
+var WAL_SYNC_INTERVAL = 100 * time.Millisecond
+
+const (
+	// Maximum size of the payload of a single record in the message log
+	WAL_MAX_RECORD_SIZE = 1 << 24
+
+	// Size of a record header: a big-endian uint32 payload length followed
+	// by the big-endian CRC-32 (IEEE) checksum of the payload
+	walHeaderSize = 8
+)
+
+// errTornRecord is returned when a record in the message log is incomplete or
+// fails its checksum
+var errTornRecord = errors.New("torn or corrupt record")
+
+// wal is an append-only, write-ahead log of delivered messages
+//
+// Each record holds a single JSON encoded Message. Records are written to the
+// file as a whole (without any buffering in the process), so a record is never
+// lost once Append returns unless the host itself fails before the record is
+// flushed (see the FSYNC_* policies).
+type wal struct {
+	file   *os.File
+	size   int64      // size of the valid records in file
+	policy string     // one of the FSYNC_* policies
+	dirty  bool       // whether there are records that were not flushed
+	closed bool       // whether Close was called
+	mutex  sync.Mutex // mutex for accessing contents
+}
+
+// openWAL opens (or creates) the message log at path and returns it along with
+// the messages it contains, in the order they were appended
+//
+// Replay stops at the first record that is incomplete or fails its checksum
+// (e.g. the server crashed in the middle of an append), and the log is
+// truncated at that record so that new records are appended after the last
+// valid one. A complete record whose message cannot be decoded is reported as
+// corrupt and skipped.
+func openWAL(path string, policy string) (*wal, []*Message, error) {
+	switch policy {
+	case FSYNC_ALWAYS, FSYNC_INTERVAL, FSYNC_NEVER:
+	default:
+		return nil, nil, fmt.Errorf("unknown fsync policy: %q", policy)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var msgs []*Message
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		msg, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errTornRecord) {
+			Logger.Error("truncating message log", "path", path,
+				"offset", offset, LOG_ERROR, err)
+			err = file.Truncate(offset)
+			if err != nil {
+				file.Close()
+				return nil, nil, err
+			}
+			break
+		}
+		if err != nil {
+			// the record was written as a whole, so the records
+			// after it are intact
+			Logger.Error("skipping corrupt record in message log",
+				"path", path, "offset", offset, LOG_ERROR, err)
+		} else {
+			msgs = append(msgs, msg)
+		}
+		offset += size
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	w := &wal{file: file, size: offset, policy: policy}
+	if policy == FSYNC_INTERVAL {
+		go w.syncPeriodically()
+	}
+	return w, msgs, nil
+}
+
+// readRecord reads the next record from r and returns the message it contains
+// along with the size of the record in bytes
+//
+// Returns io.EOF if there are no more records and errTornRecord if the next
+// record is incomplete or fails its checksum. If the message in a complete
+// record cannot be decoded, the decoding error is returned along with the size
+// of the record.
+func readRecord(r *bufio.Reader) (*Message, int64, error) {
+	var header [walHeaderSize]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w (%d byte header)",
+			errTornRecord, n)
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if size > WAL_MAX_RECORD_SIZE {
+		return nil, 0, fmt.Errorf("%w (%d byte payload)",
+			errTornRecord, size)
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil || crc32.ChecksumIEEE(payload) != checksum {
+		return nil, 0, errTornRecord
+	}
+
+	msg := new(Message)
+	err = json.Unmarshal(payload, msg)
+	if err != nil {
+		return nil, int64(walHeaderSize + size), err
+	}
+	return msg, int64(walHeaderSize + size), nil
+}
+
+// Append adds a record containing msg to the end of the log, flushing it to
+// stable storage if the policy is FSYNC_ALWAYS
+func (w *wal) Append(msg *Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	_, err = w.file.Write(record)
+	if err != nil {
+		// remove whatever part of the record was written, so that
+		// later records are not lost on replay
+		w.file.Truncate(w.size)
+		w.file.Seek(w.size, io.SeekStart)
+		return err
+	}
+	w.size += int64(len(record))
+	if w.policy == FSYNC_ALWAYS {
+		return w.file.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// Sync flushes any records that were not yet flushed to stable storage
+func (w *wal) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.dirty || w.closed {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// Close flushes any records that were not yet flushed and closes the log
+func (w *wal) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncPeriodically calls Sync every WAL_SYNC_INTERVAL until the log is closed
+func (w *wal) syncPeriodically() {
+	for {
+		sleep(WAL_SYNC_INTERVAL)
+		w.mutex.Lock()
+		closed := w.closed
+		w.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		err := w.Sync()
+		if err != nil {
+			Logger.Error("failed to flush message log",
+				LOG_ERROR, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWAL_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, msgs, err := openWAL(path, FSYNC_ALWAYS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("expected an empty log, got: %v", msgs)
+	}
+
+	for _, content := range []string{"a", "b,c", ""} {
+		err = w.Append(&Message{Id: 1, Content: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.file.Close()
+
+	_, msgs, err = openWAL(path, FSYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[0].Content != "a" ||
+		msgs[1].Content != "b,c" || msgs[2].Content != "" {
+		t.Fatalf("expected [a b,c \"\"], got: %v", msgs)
+	}
+}
+
+func TestWAL_TruncatesTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _, err := openWAL(path, FSYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(&Message{Id: 1, Content: "a"})
+	w.Append(&Message{Id: 1, Content: "b"})
+	size := w.size
+	w.file.Close()
+
+	// simulate a crash in the middle of appending a record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 42, 1, 2})
+	file.Close()
+
+	w, msgs, err := openWAL(path, FSYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got: %v", msgs)
+	}
+	info, _ := os.Stat(path)
+	if info.Size() != size {
+		t.Fatalf("expected log size %d, got: %d", size, info.Size())
+	}
+
+	// new records are appended after the last valid one
+	w.Append(&Message{Id: 1, Content: "c"})
+	w.file.Close()
+	_, msgs, _ = openWAL(path, FSYNC_NEVER)
+	if len(msgs) != 3 || msgs[2].Content != "c" {
+		t.Fatalf("expected [a b c], got: %v", msgs)
+	}
+}
+
+func TestWAL_TruncatesCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _, _ := openWAL(path, FSYNC_NEVER)
+	w.Append(&Message{Id: 1, Content: "a"})
+	size := w.size
+	w.Append(&Message{Id: 1, Content: "b"})
+	w.file.Close()
+
+	// flip a bit in the payload of the last record
+	data, _ := os.ReadFile(path)
+	data[len(data)-2] ^= 1
+	os.WriteFile(path, data, 0644)
+
+	_, msgs, err := openWAL(path, FSYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Content != "a" {
+		t.Fatalf("expected [a], got: %v", msgs)
+	}
+	info, _ := os.Stat(path)
+	if info.Size() != size {
+		t.Fatalf("expected log size %d, got: %d", size, info.Size())
+	}
+}
+
+func TestWAL_SkipsUndecodableRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _, _ := openWAL(path, FSYNC_NEVER)
+	w.Append(&Message{Id: 1, Content: "a"})
+
+	// a record with a valid checksum that is not a message
+	payload := []byte("not a message")
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+	w.file.Write(record)
+	w.size += int64(len(record))
+
+	w.Append(&Message{Id: 1, Content: "c"})
+	size := w.size
+	w.file.Close()
+
+	w, msgs, err := openWAL(path, FSYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Content != "a" || msgs[1].Content != "c" {
+		t.Fatalf("expected [a c], got: %v", msgs)
+	}
+	info, _ := os.Stat(path)
+	if info.Size() != size {
+		t.Fatalf("expected log size %d, got: %d", size, info.Size())
+	}
+
+	// new records are appended after the last one
+	w.Append(&Message{Id: 1, Content: "d"})
+	w.file.Close()
+	_, msgs, _ = openWAL(path, FSYNC_NEVER)
+	if len(msgs) != 3 || msgs[2].Content != "d" {
+		t.Fatalf("expected [a c d], got: %v", msgs)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// GUID appended to the key of a WebSocket handshake (see RFC 6455, section
+// 4.2.2)
+const WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Maximum size of a message received over a WebSocket
+const WS_MAX_MESSAGE_SIZE = 1 << 20
+
+// WebSocket frame opcodes (see RFC 6455, section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+// wsConn is the server side of a WebSocket connection (RFC 6455), with just
+// enough of the protocol for pushing JSON lines to browsers and reading their
+// requests: no extensions, subprotocols or binary messages
+//
+// Every complete line written to the connection is sent as a text message
+// (without the '\n'), so it can be used as the writer of a masterSession.
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	pending []byte     // start of a line that was not completed yet
+	mutex   sync.Mutex // mutex for writing frames and accessing pending
+}
+
+// wsAccept completes the WebSocket handshake of r and takes over its
+// connection
+func wsAccept(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "expected a WebSocket handshake",
+			http.StatusBadRequest)
+		return nil, errWSProtocol
+	}
+
+	hijacker, isHijacker := w.(http.Hijacker)
+	if !isHijacker {
+		http.Error(w, "connection cannot be upgraded",
+			http.StatusInternalServerError)
+		return nil, errWSProtocol
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + WS_GUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// headerContains returns whether the comma-separated values of the given
+// header include value (ignoring case)
+func headerContains(header http.Header, name string, value string) bool {
+	for _, line := range header.Values(name) {
+		for _, v := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Write sends every line completed by p as a text message
+func (ws *wsConn) Write(p []byte) (int, error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	ws.pending = append(ws.pending, p...)
+	for {
+		i := bytes.IndexByte(ws.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		err := ws.writeFrame(wsOpText, ws.pending[:i])
+		if err != nil {
+			return 0, err
+		}
+		ws.pending = ws.pending[i+1:]
+	}
+}
+
+// ReadMessage returns the payload of the next text message, answering pings
+// and closes along the way
+//
+// Returns io.EOF once the client closes the connection
+func (ws *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			ws.mutex.Lock()
+			err = ws.writeFrame(wsOpPong, payload)
+			ws.mutex.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			ws.mutex.Lock()
+			ws.writeFrame(wsOpClose, nil)
+			ws.mutex.Unlock()
+			return nil, io.EOF
+		case wsOpText, wsOpBinary, wsOpContinuation:
+		default:
+			return nil, errWSProtocol
+		}
+
+		if len(message)+len(payload) > WS_MAX_MESSAGE_SIZE {
+			return nil, errWSProtocol
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame from the client (which must be masked)
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(ws.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	if !masked {
+		return false, 0, nil, errWSProtocol
+	}
+
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(ws.reader, ext[:])
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(ws.reader, ext[:])
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if size > WS_MAX_MESSAGE_SIZE {
+		return false, 0, nil, errWSProtocol
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(ws.reader, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(ws.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a single unfragmented frame
+//
+// Assumes ws.mutex is held
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch size := len(payload); {
+	case size < 126:
+		header = append(header, byte(size))
+	case size <= 0xFFFF:
+		header = append(header, 126, byte(size>>8), byte(size))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(size))
+	}
+
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+// Close closes the underlying connection
+func (ws *wsConn) Close() error {
+	return ws.conn.Close()
+}
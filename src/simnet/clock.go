@@ -0,0 +1,149 @@
+package simnet
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time of a Network and schedules its deliveries
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f once d has elapsed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a call scheduled by a Clock
+type Timer interface {
+	// Stop prevents the call from happening, and returns false if it
+	// already happened (or was already stopped)
+	Stop() bool
+}
+
+// WallClock is the Clock of the time package
+var WallClock Clock = wallClock{}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// VirtualClock is a Clock whose time only moves when it is advanced, which
+// makes the timing of a Network reproducible
+//
+// NOTE: Unlike the time package, calls scheduled by a VirtualClock are run in
+// the goroutine that advances it (in order of their time, and then of their
+// scheduling), so they must not advance the clock themselves.
+type VirtualClock struct {
+	now    time.Time
+	timers []*virtualTimer // scheduled calls, in the order they are run
+	mutex  sync.Mutex      // mutex for accessing contents
+}
+
+// NewVirtualClock returns a VirtualClock set to start
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+	return vc.now
+}
+
+func (vc *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+
+	timer := &virtualTimer{clock: vc, when: vc.now.Add(d), f: f}
+	i := sort.Search(len(vc.timers), func(i int) bool {
+		return vc.timers[i].when.After(timer.when)
+	})
+	vc.timers = append(vc.timers, nil)
+	copy(vc.timers[i+1:], vc.timers[i:])
+	vc.timers[i] = timer
+	return timer
+}
+
+// Advance moves the time forward by d, running every call scheduled up to the
+// new time
+func (vc *VirtualClock) Advance(d time.Duration) {
+	vc.mutex.Lock()
+	end := vc.now.Add(d)
+	vc.mutex.Unlock()
+
+	for vc.runNext(end) {
+	}
+
+	vc.mutex.Lock()
+	vc.now = end
+	vc.mutex.Unlock()
+}
+
+// Step moves the time forward to the next scheduled call and runs it (as well
+// as any other call scheduled for the same time), returning false if no call
+// is scheduled
+func (vc *VirtualClock) Step() bool {
+	vc.mutex.Lock()
+	if len(vc.timers) == 0 {
+		vc.mutex.Unlock()
+		return false
+	}
+	when := vc.timers[0].when
+	vc.mutex.Unlock()
+
+	vc.Advance(when.Sub(vc.Now()))
+	return true
+}
+
+// Pending returns the number of scheduled calls
+func (vc *VirtualClock) Pending() int {
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+	return len(vc.timers)
+}
+
+// runNext runs the first scheduled call if it is due by end, setting the time
+// to its time, and returns whether it did
+func (vc *VirtualClock) runNext(end time.Time) bool {
+	vc.mutex.Lock()
+	if len(vc.timers) == 0 || vc.timers[0].when.After(end) {
+		vc.mutex.Unlock()
+		return false
+	}
+	timer := vc.timers[0]
+	vc.timers = vc.timers[1:]
+	if timer.when.After(vc.now) {
+		vc.now = timer.when
+	}
+	vc.mutex.Unlock()
+
+	timer.f()
+	return true
+}
+
+// virtualTimer is a call scheduled by a VirtualClock
+type virtualTimer struct {
+	clock *VirtualClock
+	when  time.Time
+	f     func()
+}
+
+func (vt *virtualTimer) Stop() bool {
+	vc := vt.clock
+	vc.mutex.Lock()
+	defer vc.mutex.Unlock()
+	for i, timer := range vc.timers {
+		if timer == vt {
+			vc.timers = append(vc.timers[:i], vc.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
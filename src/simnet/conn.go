@@ -0,0 +1,268 @@
+package simnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// conn is one end of a simulated connection
+//
+// NOTE: Deadlines are compared with the Clock of the Network, so code that
+// computes them from time.Now only gets the expected timeouts with WallClock.
+type conn struct {
+	network *Network
+	host    string // name of the host of this end
+	addr    addr   // address of this end
+	peer    *conn  // other end
+
+	buffer        []byte    // data received but not read yet
+	eof           bool      // whether the other end closed (after buffer)
+	closed        bool      // whether this end was closed
+	readDeadline  time.Time // zero if none
+	writeDeadline time.Time // zero if none
+	deadlineTimer Timer     // wakes up Read at readDeadline (if any)
+	lastDelivery  time.Time // time of the last delivery to the other end
+
+	// closed (and replaced) whenever one of the above changes
+	signal chan struct{}
+
+	mutex sync.Mutex // mutex for accessing contents
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, opError("read", string(c.addr), net.ErrClosed)
+		case len(c.buffer) > 0:
+			n := copy(p, c.buffer)
+			c.buffer = c.buffer[n:]
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case expired(c.readDeadline, c.network.clock):
+			return 0, opError("read", string(c.addr),
+				timeoutError{})
+		}
+		signal := c.signal
+		c.mutex.Unlock()
+		<-signal
+		c.mutex.Lock()
+	}
+}
+
+// Write schedules the delivery of p to the other end (unless it is lost) and
+// returns at once
+//
+// Returns an error if the other end was closed, like a TCP connection reset by
+// its peer.
+func (c *conn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mutex.Unlock()
+	if closed {
+		return 0, opError("write", string(c.addr), net.ErrClosed)
+	}
+	if expired(deadline, c.network.clock) {
+		return 0, opError("write", string(c.addr), timeoutError{})
+	}
+	c.peer.mutex.Lock()
+	reset := c.peer.closed
+	c.peer.mutex.Unlock()
+	if reset {
+		return 0, opError("write", string(c.addr),
+			errors.New("connection reset by peer"))
+	}
+
+	n := c.network
+	n.mutex.Lock()
+	delay, delivered := n.delay(c.host, c.peer.host)
+	n.mutex.Unlock()
+	if !delivered {
+		return len(p), nil
+	}
+
+	data := append([]byte(nil), p...)
+	c.mutex.Lock()
+	if at := n.clock.Now().Add(delay); at.After(c.lastDelivery) {
+		c.lastDelivery = at
+	}
+	c.mutex.Unlock()
+	n.after(delay, func() { c.peer.receive(data) })
+	return len(p), nil
+}
+
+// receive appends data sent by the other end to the buffer
+func (c *conn) receive(data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.buffer = append(c.buffer, data...)
+	c.notify()
+}
+
+// Close closes this end, which the other end reads as EOF once everything
+// written before is delivered
+func (c *conn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return opError("close", string(c.addr), net.ErrClosed)
+	}
+	c.closed = true
+	c.buffer = nil
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+	}
+	c.notify()
+	delay := c.lastDelivery.Sub(c.network.clock.Now())
+	c.mutex.Unlock()
+
+	peer := c.peer
+	c.network.after(delay, func() {
+		peer.mutex.Lock()
+		defer peer.mutex.Unlock()
+		peer.eof = true
+		peer.notify()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.peer.addr
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+		c.deadlineTimer = nil
+	}
+	if !t.IsZero() {
+		c.deadlineTimer = c.network.clock.AfterFunc(
+			t.Sub(c.network.clock.Now()), c.wake)
+	}
+	c.notify()
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// wake wakes up a Read blocked until the read deadline
+func (c *conn) wake() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notify()
+}
+
+// notify wakes up every goroutine waiting on signal
+//
+// NOTE: must be called with c.mutex held
+func (c *conn) notify() {
+	close(c.signal)
+	c.signal = make(chan struct{})
+}
+
+// expired returns whether deadline (if any) has passed on clock
+func expired(deadline time.Time, clock Clock) bool {
+	return !deadline.IsZero() && !clock.Now().Before(deadline)
+}
+
+// listener accepts the connections dialed to a port of a host
+type listener struct {
+	network *Network
+	host    string // name of the host
+	port    string
+
+	queue  []*conn       // connections not accepted yet
+	closed bool          // whether the listener was closed
+	signal chan struct{} // closed (and replaced) when the above change
+	mutex  sync.Mutex    // mutex for accessing contents
+}
+
+// enqueue queues a new connection to be accepted, returning false if the
+// listener is closed
+func (ln *listener) enqueue(c *conn) bool {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	if ln.closed {
+		return false
+	}
+	ln.queue = append(ln.queue, c)
+	close(ln.signal)
+	ln.signal = make(chan struct{})
+	return true
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	for {
+		if ln.closed {
+			return nil, opError("accept", ln.host+":"+ln.port,
+				net.ErrClosed)
+		}
+		if len(ln.queue) > 0 {
+			c := ln.queue[0]
+			ln.queue = ln.queue[1:]
+			return c, nil
+		}
+		signal := ln.signal
+		ln.mutex.Unlock()
+		<-signal
+		ln.mutex.Lock()
+	}
+}
+
+// Close stops listening, and closes the connections that were not accepted
+func (ln *listener) Close() error {
+	ln.mutex.Lock()
+	if ln.closed {
+		ln.mutex.Unlock()
+		return opError("close", ln.host+":"+ln.port, net.ErrClosed)
+	}
+	ln.closed = true
+	queue := ln.queue
+	ln.queue = nil
+	close(ln.signal)
+	ln.signal = make(chan struct{})
+	ln.mutex.Unlock()
+
+	for _, c := range queue {
+		c.Close()
+	}
+	n := ln.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.listeners[ln.port] == ln {
+		delete(n.listeners, ln.port)
+	}
+	return nil
+}
+
+func (ln *listener) Addr() net.Addr {
+	return addr(ln.host + ":" + ln.port)
+}
@@ -0,0 +1,245 @@
+// Package simnet simulates a network of hosts in a single process, for tests
+// that need reproducible latency, reordering, message loss and partitions
+//
+// Hosts listen on and dial addresses of the form "<host>:<port>", where only
+// the port is significant (as if every host shared the address of localhost,
+// like the servers of a chatroom usually do). Connections are reliable and
+// ordered, except for the faults configured on the Network:
+//
+//   - each write is delivered as a whole after the Latency (plus a random
+//     Jitter) of its link, so writes with different delays are reordered
+//   - each write is lost as a whole with the Drop probability of its link
+//   - writes between partitioned hosts are lost, and dials between them fail
+//
+// Random choices are made by a source seeded with the seed of the Network, and
+// deliveries are scheduled by its Clock. With a VirtualClock, a test that
+// performs the same writes in the same order (e.g. from a single goroutine)
+// gets the same deliveries in the same order every time.
+package simnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Link is the behavior of the connections from one host to another
+type Link struct {
+	Latency time.Duration // delay of every write
+	Jitter  time.Duration // maximum random extra delay of a write
+	Drop    float64       // probability that a write is lost
+}
+
+// A Network is a set of simulated hosts and the links between them
+type Network struct {
+	clock       Clock
+	rand        *rand.Rand
+	link        Link                 // default link between two hosts
+	links       map[[2]string]Link   // link from a host to another
+	partitioned map[[2]string]bool   // whether two hosts are partitioned
+	listeners   map[string]*listener // listeners by port
+	lastPort    int                  // last local port of a dialed conn
+	mutex       sync.Mutex           // mutex for accessing contents
+}
+
+// New returns a Network whose random choices are seeded with seed and whose
+// deliveries are scheduled by clock (WallClock if nil)
+func New(seed int64, clock Clock) *Network {
+	if clock == nil {
+		clock = WallClock
+	}
+	return &Network{
+		clock:       clock,
+		rand:        rand.New(rand.NewSource(seed)),
+		links:       make(map[[2]string]Link),
+		partitioned: make(map[[2]string]bool),
+		listeners:   make(map[string]*listener),
+		lastPort:    40000,
+	}
+}
+
+// Clock returns the Clock of the network
+func (n *Network) Clock() Clock {
+	return n.clock
+}
+
+// SetDefaultLink sets the link between hosts that have no link of their own
+func (n *Network) SetDefaultLink(link Link) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.link = link
+}
+
+// SetLink sets the link from host from to host to (but not the reverse)
+func (n *Network) SetLink(from, to string, link Link) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.links[[2]string{from, to}] = link
+}
+
+// Partition prevents every host in a from communicating with every host in b,
+// until Heal is called
+func (n *Network) Partition(a, b []string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, x := range a {
+		for _, y := range b {
+			n.partitioned[[2]string{x, y}] = true
+			n.partitioned[[2]string{y, x}] = true
+		}
+	}
+}
+
+// Heal removes every partition
+func (n *Network) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.partitioned = make(map[[2]string]bool)
+}
+
+// Host returns the host with the given name, which identifies it in links and
+// partitions
+func (n *Network) Host(name string) *Host {
+	return &Host{network: n, name: name}
+}
+
+// delay returns the delay of a write from host from to host to, and false if
+// the write is lost
+//
+// NOTE: must be called with n.mutex held
+func (n *Network) delay(from, to string) (time.Duration, bool) {
+	if n.partitioned[[2]string{from, to}] {
+		return 0, false
+	}
+	link, ok := n.links[[2]string{from, to}]
+	if !ok {
+		link = n.link
+	}
+	if link.Drop > 0 && n.rand.Float64() < link.Drop {
+		return 0, false
+	}
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(link.Jitter) + 1))
+	}
+	return delay, true
+}
+
+// after calls f once d has elapsed on the clock of the network, or at once if
+// d is not positive
+func (n *Network) after(d time.Duration, f func()) {
+	if d <= 0 {
+		f()
+		return
+	}
+	n.clock.AfterFunc(d, f)
+}
+
+// A Host is a machine of a Network, which listens on and dials its addresses
+//
+// A Host provides the same methods as the transport of the servers, so that it
+// can replace it in tests.
+type Host struct {
+	network *Network
+	name    string
+}
+
+// Name returns the name of the host
+func (h *Host) Name() string {
+	return h.name
+}
+
+// Listen listens for connections to the port of address (e.g. ":20000")
+func (h *Host) Listen(address string) (net.Listener, error) {
+	port, err := portOf(address)
+	if err != nil {
+		return nil, err
+	}
+	n := h.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.listeners[port] != nil {
+		return nil, opError("listen", address,
+			errors.New("address already in use"))
+	}
+	ln := &listener{network: n, host: h.name, port: port,
+		signal: make(chan struct{})}
+	n.listeners[port] = ln
+	return ln, nil
+}
+
+// Dial connects to the host listening on the port of address (e.g.
+// "localhost:20000")
+//
+// NOTE: A dial to a partitioned host fails at once with a timeout error (rather
+// than after timeout), and the connection is established without delay.
+func (h *Host) Dial(address string, timeout time.Duration) (net.Conn,
+	error) {
+
+	port, err := portOf(address)
+	if err != nil {
+		return nil, err
+	}
+	n := h.network
+	n.mutex.Lock()
+	ln := n.listeners[port]
+	if ln == nil {
+		n.mutex.Unlock()
+		return nil, opError("dial", address,
+			errors.New("connection refused"))
+	}
+	if n.partitioned[[2]string{h.name, ln.host}] {
+		n.mutex.Unlock()
+		return nil, opError("dial", address, timeoutError{})
+	}
+	n.lastPort++
+	localPort := n.lastPort
+	n.mutex.Unlock()
+
+	local := &conn{network: n, host: h.name,
+		addr: addr(h.name + ":" + strconv.Itoa(localPort))}
+	remote := &conn{network: n, host: ln.host, addr: addr(address)}
+	local.peer, remote.peer = remote, local
+	local.signal, remote.signal = make(chan struct{}), make(chan struct{})
+	if !ln.enqueue(remote) {
+		return nil, opError("dial", address,
+			errors.New("connection refused"))
+	}
+	return local, nil
+}
+
+// portOf returns the port of address (of the form "<host>:<port>")
+func portOf(address string) (string, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	return port, nil
+}
+
+// addr is the address of a simulated connection or listener
+type addr string
+
+func (a addr) Network() string {
+	return "simnet"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+// timeoutError is the error of an operation that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// opError returns the error of a network operation (e.g. "dial") on address
+func opError(op, address string, err error) error {
+	return &net.OpError{Op: op, Net: "simnet", Addr: addr(address),
+		Err: err}
+}
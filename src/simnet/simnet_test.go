@@ -0,0 +1,184 @@
+package simnet
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connect returns both ends of a connection from host a to host b
+func connect(t *testing.T, network *Network, a, b string) (net.Conn,
+	net.Conn) {
+
+	t.Helper()
+	ln, err := network.Host(b).Listen(":20000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := network.Host(a).Dial("localhost:20000", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// buffered returns the data received by c but not read yet
+func buffered(c net.Conn) string {
+	sc := c.(*conn)
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return string(sc.buffer)
+}
+
+func TestLatency(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	network := New(1, clock)
+	network.SetLink("a", "b", Link{Latency: 10 * time.Millisecond})
+	client, server := connect(t, network, "a", "b")
+
+	client.Write([]byte("hello\n"))
+	clock.Advance(9 * time.Millisecond)
+	if got := buffered(server); got != "" {
+		t.Fatalf("received %q before the latency elapsed", got)
+	}
+	clock.Advance(time.Millisecond)
+	if got := buffered(server); got != "hello\n" {
+		t.Fatalf("received %q, want %q", got, "hello\n")
+	}
+
+	// the reverse link has no latency
+	server.Write([]byte("hi\n"))
+	if got := buffered(client); got != "hi\n" {
+		t.Fatalf("received %q, want %q", got, "hi\n")
+	}
+}
+
+// deliveries returns the order in which 20 writes from a to b are delivered
+// (or lost) with the given link and seed
+func deliveries(t *testing.T, seed int64, link Link) string {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	network := New(seed, clock)
+	network.SetDefaultLink(link)
+	client, server := connect(t, network, "a", "b")
+	for i := 0; i < 20; i++ {
+		client.Write([]byte(strconv.Itoa(i) + "\n"))
+	}
+	for clock.Step() {
+	}
+	return strings.ReplaceAll(buffered(server), "\n", ",")
+}
+
+func TestFaultsReproducible(t *testing.T) {
+	link := Link{Latency: time.Millisecond, Jitter: 10 * time.Millisecond,
+		Drop: 0.2}
+	first := deliveries(t, 42, link)
+	if second := deliveries(t, 42, link); second != first {
+		t.Fatalf("seed 42 delivered %s, then %s", first, second)
+	}
+	if strings.Count(first, ",") == 20 {
+		t.Errorf("no write was lost: %s", first)
+	}
+
+	ordered := deliveries(t, 42, Link{Latency: time.Millisecond})
+	if first == ordered {
+		t.Errorf("writes were not reordered or lost: %s", first)
+	}
+	want := "0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,"
+	if ordered != want {
+		t.Errorf("delivered %s without faults, want %s", ordered, want)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	network := New(1, nil)
+	client, server := connect(t, network, "a", "b")
+	ln, err := network.Host("b").Listen(":20001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	network.Partition([]string{"a"}, []string{"b", "c"})
+	_, err = network.Host("a").Dial("localhost:20001", time.Second)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("dial across a partition returned %v, want a "+
+			"timeout", err)
+	}
+	client.Write([]byte("lost\n"))
+	if got := buffered(server); got != "" {
+		t.Fatalf("received %q across a partition", got)
+	}
+
+	network.Heal()
+	client.Write([]byte("hello\n"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(server).ReadString('\n')
+	if line != "hello\n" {
+		t.Fatalf("read %q (%v) after healing, want %q", line, err,
+			"hello\n")
+	}
+}
+
+func TestDeadlineAndClose(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	network := New(1, clock)
+	network.SetDefaultLink(Link{Latency: 5 * time.Millisecond})
+	client, server := connect(t, network, "a", "b")
+
+	server.SetReadDeadline(clock.Now().Add(time.Second))
+	result := make(chan error)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		result <- err
+	}()
+	clock.Advance(time.Second)
+	err := <-result
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("read past its deadline returned %v, want a timeout",
+			err)
+	}
+
+	server.SetReadDeadline(time.Time{})
+	client.Write([]byte("bye"))
+	client.Close()
+	for clock.Step() {
+	}
+	data, err := io.ReadAll(server)
+	if string(data) != "bye" || err != nil {
+		t.Fatalf("read %q (%v), want %q and EOF", data, err, "bye")
+	}
+	_, err = server.Write([]byte("anyone?"))
+	if err == nil {
+		t.Error("write to a closed connection succeeded")
+	}
+}
+
+func TestListen(t *testing.T) {
+	network := New(1, nil)
+	ln, err := network.Host("a").Listen(":20000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = network.Host("b").Listen("localhost:20000")
+	if err == nil {
+		t.Error("two hosts listened on the same port")
+	}
+	ln.Close()
+	_, err = network.Host("b").Dial("localhost:20000", time.Second)
+	if err == nil {
+		t.Error("dial to a closed listener succeeded")
+	}
+	_, err = ln.Accept()
+	if err == nil {
+		t.Error("accept on a closed listener succeeded")
+	}
+}
@@ -148,6 +148,26 @@ func (rcp *MessageReceptacle) Length() int {
 	return len(rcp.counter)
 }
 
+// Delivered reports whether a message from the sender of msg with the same
+// or a later send event has already been delivered (e.g. because the sender
+// restarted with a new clock)
+//
+// Returns an error if the message's timestamp is invalid or does not have the
+// same length as the message receptacle
+func (rcp *MessageReceptacle) Delivered(msg *Message) (bool, error) {
+	if rcp.Length() != len(msg.Timestamp.Vector) {
+		return false, fmt.Errorf("message timestamp length (%d) != "+
+			"receptacle length (%d)", len(msg.Timestamp.Vector),
+			rcp.Length())
+	}
+
+	ts, err := msg.Timestamp.ClockBase(logical.MaxBase)
+	if err != nil {
+		return false, err
+	}
+	return rcp.counter[ts.id-1].Cmp(&ts.vector[ts.id-1]) >= 0, nil
+}
+
 // Deliverables returns any messages in the receptacle that are ready to be
 // delivered (i.e. the message can be safely passed to a process since all
 // messages that causally precede it have already been delivered) in order of
@@ -318,6 +318,33 @@ func TestMessageReceptacle_NewMessageReceptacle(t *testing.T) {
 	}
 }
 
+func TestMessageReceptacle_Delivered(t *testing.T) {
+	clk, _ := NewClockBuilder().Id(1).Length(2).Build()
+	rcp := NewMessageReceptacle(2)
+
+	clk.TickLocal()
+	msg := NewMessage("first", clk)
+	if delivered, err := rcp.Delivered(&msg); delivered || err != nil {
+		t.Fatalf("Delivered() = %v, %v before delivery", delivered, err)
+	}
+	_ = rcp.Receive(&msg)
+	rcp.Deliverables()
+
+	// a restarted process sends the same timestamp again
+	restarted, _ := NewClockBuilder().Id(1).Length(2).Build()
+	restarted.TickLocal()
+	stale := NewMessage("again", restarted)
+	if delivered, err := rcp.Delivered(&stale); !delivered || err != nil {
+		t.Fatalf("Delivered() = %v, %v after delivery", delivered, err)
+	}
+
+	clk.TickLocal()
+	next := NewMessage("second", clk)
+	if delivered, _ := rcp.Delivered(&next); delivered {
+		t.Fatal("the next message was reported as delivered")
+	}
+}
+
 func ToString(counter []logical.Clock) string {
 	return "[" + counter[0].String() + " " + counter[1].String() + "]"
 }